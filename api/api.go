@@ -0,0 +1,261 @@
+// Package api serves a balloon over HTTP, encoding the commitments and
+// proofs as defined by the protocol package.
+//
+//	POST /events                           add an event, returns its commitment
+//	GET  /events/{digest}/proof            membership proof of an event digest
+//	GET  /history/{index}/proof?version=N  proof that index is part of version N
+//	GET  /consistency?start=N&end=M        proof that version M extends version N
+//	GET  /root[?version=N]                 commitment of a version, the last one by default
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aalda/trees/balloon"
+	"github.com/aalda/trees/common"
+	"github.com/aalda/trees/log"
+	"github.com/aalda/trees/protocol"
+)
+
+// MaxRequestSize bounds the body of the requests adding events.
+const MaxRequestSize = 1 << 20
+
+var errEmptyBalloon = errors.New("no event has been added yet")
+
+// Handler serves the balloon. The hasher is the name the balloon hasher has
+// in the protocol package, which is written in the proofs.
+type Handler struct {
+	balloon *balloon.Balloon
+	hasher  string
+	hasherF func() common.Hasher
+	logger  *log.Logger
+}
+
+func NewHandler(b *balloon.Balloon, hasher string) (*Handler, error) {
+	hasherF, err := protocol.Hasher(hasher)
+	if err != nil {
+		return nil, err
+	}
+	return &Handler{
+		balloon: b,
+		hasher:  hasher,
+		hasherF: hasherF,
+		logger:  log.Default().Named("api"),
+	}, nil
+}
+
+func (h *Handler) SetLogger(logger *log.Logger) {
+	h.logger = logger
+}
+
+// httpError is a failure caused by the request, reported with its status.
+type httpError struct {
+	status int
+	msg    string
+}
+
+func (e httpError) Error() string {
+	return e.msg
+}
+
+func badRequest(format string, v ...interface{}) error {
+	return httpError{http.StatusBadRequest, fmt.Sprintf(format, v...)}
+}
+
+func notFound(format string, v ...interface{}) error {
+	return httpError{http.StatusNotFound, fmt.Sprintf(format, v...)}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	var method string
+	var serve func(w http.ResponseWriter, r *http.Request, segments []string) error
+	switch {
+	case len(segments) == 1 && segments[0] == "events":
+		method, serve = http.MethodPost, h.addEvent
+	case len(segments) == 3 && segments[0] == "events" && segments[2] == "proof":
+		method, serve = http.MethodGet, h.getEventProof
+	case len(segments) == 3 && segments[0] == "history" && segments[2] == "proof":
+		method, serve = http.MethodGet, h.getHistoryProof
+	case len(segments) == 1 && segments[0] == "consistency":
+		method, serve = http.MethodGet, h.getConsistencyProof
+	case len(segments) == 1 && segments[0] == "root":
+		method, serve = http.MethodGet, h.getRoot
+	default:
+		h.writeError(w, r, notFound("unknown path %s", r.URL.Path))
+		return
+	}
+
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		h.writeError(w, r, httpError{http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method)})
+		return
+	}
+	if err := serve(w, r, segments); err != nil {
+		h.writeError(w, r, err)
+	}
+}
+
+func (h *Handler) addEvent(w http.ResponseWriter, r *http.Request, segments []string) error {
+	if contentType := r.Header.Get("Content-Type"); contentType != "" && !strings.HasPrefix(contentType, "application/json") {
+		return httpError{http.StatusUnsupportedMediaType, fmt.Sprintf("unsupported content type %q", contentType)}
+	}
+
+	var request protocol.AddRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxRequestSize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		return badRequest("invalid request: %v", err)
+	}
+	if decoder.More() {
+		return badRequest("invalid request: trailing data")
+	}
+
+	var commitment *balloon.Commitment
+	var err error
+	switch {
+	case request.Event != nil && request.Digest != nil:
+		return badRequest("invalid request: either an event or a digest is expected, not both")
+	case request.Event != nil:
+		commitment, err = h.balloon.Add(r.Context(), request.Event)
+	case request.Digest != nil:
+		if len(request.Digest) != int(h.hasherF().Len()/8) {
+			return badRequest("invalid digest: expected %d bytes, got %d", h.hasherF().Len()/8, len(request.Digest))
+		}
+		commitment, err = h.balloon.AddDigest(r.Context(), common.Digest(request.Digest))
+	default:
+		return badRequest("invalid request: an event or a digest is expected")
+	}
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusCreated, protocol.NewCommitment(commitment))
+}
+
+func (h *Handler) getEventProof(w http.ResponseWriter, r *http.Request, segments []string) error {
+	digest, err := protocol.ParseDigest(segments[1], h.hasherF())
+	if err != nil {
+		return badRequest("%v", err)
+	}
+	proof, err := h.balloon.Get(r.Context(), digest)
+	if err == common.ErrKeyNotFound {
+		return notFound("event %s not found", segments[1])
+	}
+	if err != nil {
+		return err
+	}
+	return h.writeProof(w, protocol.NewMembershipProof(proof))
+}
+
+func (h *Handler) getHistoryProof(w http.ResponseWriter, r *http.Request, segments []string) error {
+	index, err := parseVersion("index", segments[1])
+	if err != nil {
+		return err
+	}
+	version, err := parseVersion("version", r.URL.Query().Get("version"))
+	if err != nil {
+		return err
+	}
+	proof, err := h.balloon.ProveMembership(r.Context(), index, version)
+	if err != nil {
+		return err
+	}
+	return h.writeProof(w, protocol.NewHistoryProof(proof))
+}
+
+func (h *Handler) getConsistencyProof(w http.ResponseWriter, r *http.Request, segments []string) error {
+	query := r.URL.Query()
+	start, err := parseVersion("start", query.Get("start"))
+	if err != nil {
+		return err
+	}
+	end, err := parseVersion("end", query.Get("end"))
+	if err != nil {
+		return err
+	}
+	proof, err := h.balloon.ProveConsistency(r.Context(), start, end)
+	if err != nil {
+		return err
+	}
+	return h.writeProof(w, protocol.NewConsistencyProof(proof))
+}
+
+func (h *Handler) getRoot(w http.ResponseWriter, r *http.Request, segments []string) error {
+	var version uint64
+	if value := r.URL.Query().Get("version"); value != "" {
+		var err error
+		if version, err = parseVersion("version", value); err != nil {
+			return err
+		}
+	} else {
+		next := h.balloon.Version()
+		if next == 0 {
+			return notFound("%v", errEmptyBalloon)
+		}
+		version = next - 1
+	}
+	commitment, err := h.balloon.Commitment(r.Context(), version)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, protocol.NewCommitment(commitment))
+}
+
+func parseVersion(name, value string) (uint64, error) {
+	if value == "" {
+		return 0, badRequest("missing %s", name)
+	}
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, badRequest("invalid %s %q", name, value)
+	}
+	return n, nil
+}
+
+func (h *Handler) writeProof(w http.ResponseWriter, proof interface{}) error {
+	envelope, err := protocol.NewEnvelope(h.hasher, proof)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, envelope)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+	return nil
+}
+
+// writeError maps the errors of the balloon to their status. The unexpected
+// ones are logged and reported without their details.
+func (h *Handler) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status, msg := http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)
+	switch e := err.(type) {
+	case httpError:
+		status, msg = e.status, e.msg
+	default:
+		switch err {
+		case balloon.ErrVersionNotFound:
+			status, msg = http.StatusNotFound, err.Error()
+		case balloon.ErrInvalidRange:
+			status, msg = http.StatusBadRequest, err.Error()
+		default:
+			h.logger.Error("Request failed", log.String("method", r.Method), log.String("path", r.URL.Path), log.Err(err))
+		}
+	}
+	body, _ := json.Marshal(protocol.Error{Error: msg})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,186 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aalda/trees/balloon"
+	"github.com/aalda/trees/common"
+	"github.com/aalda/trees/log"
+	"github.com/aalda/trees/protocol"
+	"github.com/aalda/trees/storage/bplus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var ctx = context.Background()
+
+func newServer(t *testing.T) *httptest.Server {
+	b, err := balloon.NewBalloon(bplus.NewBPlusTreeStorage(), func() common.Hasher { return common.NewSha256Hasher() })
+	require.NoError(t, err)
+	handler, err := NewHandler(b, "sha256")
+	require.NoError(t, err)
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func event(i int) []byte {
+	return []byte(fmt.Sprintf("event %d", i))
+}
+
+func digest(i int) string {
+	return hex.EncodeToString(common.NewSha256Hasher().Do(event(i)))
+}
+
+func post(t *testing.T, server *httptest.Server, body string) (int, []byte) {
+	response, err := http.Post(server.URL+"/events", "application/json", strings.NewReader(body))
+	require.NoError(t, err)
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	require.NoError(t, err)
+	return response.StatusCode, data
+}
+
+func get(t *testing.T, server *httptest.Server, path string) (int, []byte) {
+	response, err := http.Get(server.URL + path)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	require.NoError(t, err)
+	return response.StatusCode, data
+}
+
+func addEvents(t *testing.T, server *httptest.Server, n int) []protocol.Commitment {
+	commitments := make([]protocol.Commitment, n)
+	for i := 0; i < n; i++ {
+		body, err := json.Marshal(protocol.AddRequest{Event: event(i)})
+		require.NoError(t, err)
+		status, data := post(t, server, string(body))
+		require.Equal(t, http.StatusCreated, status, string(data))
+		require.NoError(t, json.Unmarshal(data, &commitments[i]))
+		require.Equal(t, uint64(i), commitments[i].Version, "Incorrect version")
+	}
+	return commitments
+}
+
+func verify(t *testing.T, data []byte, kind string, root []byte) {
+	envelope, err := protocol.ReadEnvelope(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, kind, envelope.Kind, "Incorrect kind")
+	assert.Equal(t, "sha256", envelope.Hasher, "Incorrect hasher")
+	assert.Equal(t, common.Digest(root), envelope.Root(), "Incorrect root")
+	ok, err := envelope.Verify(ctx)
+	require.NoError(t, err)
+	assert.True(t, ok, "The proof should verify")
+}
+
+func TestEndToEnd(t *testing.T) {
+
+	log.SetLogger("TestEndToEnd", log.SILENT)
+
+	server := newServer(t)
+
+	status, _ := get(t, server, "/root")
+	assert.Equal(t, http.StatusNotFound, status, "An empty balloon should have no root")
+
+	commitments := addEvents(t, server, 10)
+
+	body := fmt.Sprintf(`{"digest": %q}`, hex.EncodeToString(common.NewSha256Hasher().Do(event(10))))
+	status, data := post(t, server, body)
+	require.Equal(t, http.StatusCreated, status, string(data))
+	var last protocol.Commitment
+	require.NoError(t, json.Unmarshal(data, &last))
+	assert.Equal(t, uint64(10), last.Version, "Incorrect version")
+
+	status, data = get(t, server, "/root")
+	require.Equal(t, http.StatusOK, status, string(data))
+	var root protocol.Commitment
+	require.NoError(t, json.Unmarshal(data, &root))
+	assert.Equal(t, last, root, "Incorrect root")
+
+	status, data = get(t, server, "/root?version=4")
+	require.Equal(t, http.StatusOK, status, string(data))
+	require.NoError(t, json.Unmarshal(data, &root))
+	assert.Equal(t, commitments[4], root, "Incorrect root of version 4")
+
+	for i := 0; i < 10; i++ {
+		status, data = get(t, server, "/events/"+digest(i)+"/proof")
+		require.Equal(t, http.StatusOK, status, string(data))
+		verify(t, data, protocol.KindMembership, last.HyperDigest)
+
+		status, data = get(t, server, fmt.Sprintf("/history/%d/proof?version=9", i))
+		require.Equal(t, http.StatusOK, status, string(data))
+		verify(t, data, protocol.KindHistory, commitments[9].HistoryDigest)
+
+		status, data = get(t, server, fmt.Sprintf("/consistency?start=%d&end=9", i))
+		require.Equal(t, http.StatusOK, status, string(data))
+		verify(t, data, protocol.KindConsistency, commitments[9].HistoryDigest)
+	}
+}
+
+func TestValidation(t *testing.T) {
+
+	log.SetLogger("TestValidation", log.SILENT)
+
+	server := newServer(t)
+	addEvents(t, server, 3)
+
+	testCases := []struct {
+		method, path, body string
+		status             int
+	}{
+		{http.MethodPost, "/events", `{}`, http.StatusBadRequest},
+		{http.MethodPost, "/events", `not json`, http.StatusBadRequest},
+		{http.MethodPost, "/events", `{"event": "ZXZlbnQ="} {}`, http.StatusBadRequest},
+		{http.MethodPost, "/events", `{"unknown": 1}`, http.StatusBadRequest},
+		{http.MethodPost, "/events", `{"digest": "0a0b"}`, http.StatusBadRequest},
+		{http.MethodPost, "/events", `{"digest": "zz"}`, http.StatusBadRequest},
+		{http.MethodPost, "/events", fmt.Sprintf(`{"event": "ZXZlbnQ=", "digest": %q}`, digest(0)), http.StatusBadRequest},
+		{http.MethodPost, "/events", fmt.Sprintf(`{"event": %q}`, strings.Repeat("a", MaxRequestSize)), http.StatusBadRequest},
+		{http.MethodGet, "/events", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/root", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/events/0a0b/proof", "", http.StatusBadRequest},
+		{http.MethodGet, "/events/" + digest(3) + "/proof", "", http.StatusNotFound},
+		{http.MethodGet, "/history/one/proof?version=2", "", http.StatusBadRequest},
+		{http.MethodGet, "/history/1/proof", "", http.StatusBadRequest},
+		{http.MethodGet, "/history/2/proof?version=1", "", http.StatusBadRequest},
+		{http.MethodGet, "/history/1/proof?version=3", "", http.StatusNotFound},
+		{http.MethodGet, "/consistency?start=1", "", http.StatusBadRequest},
+		{http.MethodGet, "/consistency?start=2&end=1", "", http.StatusBadRequest},
+		{http.MethodGet, "/consistency?start=1&end=-1", "", http.StatusBadRequest},
+		{http.MethodGet, "/consistency?start=1&end=3", "", http.StatusNotFound},
+		{http.MethodGet, "/root?version=3", "", http.StatusNotFound},
+		{http.MethodGet, "/unknown", "", http.StatusNotFound},
+	}
+
+	for i, c := range testCases {
+		request, err := http.NewRequest(c.method, server.URL+c.path, strings.NewReader(c.body))
+		require.NoError(t, err)
+		response, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+
+		var failure protocol.Error
+		err = json.NewDecoder(response.Body).Decode(&failure)
+		response.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, c.status, response.StatusCode, "Incorrect status in test case %d: %s", i, failure.Error)
+		assert.NotEmpty(t, failure.Error, "The error should be reported in test case %d", i)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, server.URL+"/events", strings.NewReader(`{"event": "ZXZlbnQ="}`))
+	require.NoError(t, err)
+	request.Header.Set("Content-Type", "text/plain")
+	response, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusUnsupportedMediaType, response.StatusCode, "Incorrect status")
+}
@@ -0,0 +1,368 @@
+// Package archive dumps the entries of a store to a portable archive and
+// loads them into another store, whatever their backends.
+//
+// An archive starts with the "TREESARC" magic and a format version byte,
+// followed by chunks of entries of a single prefix:
+//
+//	prefix    1 byte
+//	count     uvarint, at most ChunkSize
+//	entries   count times: uvarint key length, key, uvarint value length, value
+//	checksum  4 bytes, big endian CRC-32C of the chunk from its prefix on
+//
+// and ends with the 0xff byte, the total number of entries as a big endian
+// uint64 and the SHA-256 of every byte before it, magic included. Chunks are
+// checked before being written to the store, so a corrupted chunk is never
+// imported, and the trailer detects truncated archives.
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/aalda/trees/balloon"
+	"github.com/aalda/trees/common"
+	"github.com/aalda/trees/storage/bplus"
+)
+
+const (
+	magic         = "TREESARC"
+	formatVersion = byte(1)
+	endMarker     = byte(0xff)
+
+	// ChunkSize is the number of entries of a chunk, which are imported
+	// with a single mutation.
+	ChunkSize = 1024
+)
+
+// Prefixes are the prefixes of the store exported, in archive order.
+var Prefixes = []byte{common.VersionPrefix, common.IndexPrefix, common.HyperCachePrefix, common.HistoryCachePrefix}
+
+var (
+	ErrInvalidArchive = errors.New("invalid archive")
+	ErrRootMismatch   = errors.New("the recomputed roots do not match the recorded commitment")
+	ErrEntryMismatch  = errors.New("the imported entries do not match the replayed ones")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Export writes all the entries of the store to the archive.
+func Export(ctx context.Context, store common.Store, w io.Writer) error {
+	digest := sha256.New()
+	buffered := bufio.NewWriter(io.MultiWriter(w, digest))
+
+	buffered.WriteString(magic)
+	buffered.WriteByte(formatVersion)
+
+	var total uint64
+	for _, prefix := range Prefixes {
+		n, err := exportPrefix(ctx, store, prefix, buffered)
+		if err != nil {
+			return err
+		}
+		total += n
+	}
+
+	buffered.WriteByte(endMarker)
+	var count [8]byte
+	binary.BigEndian.PutUint64(count[:], total)
+	buffered.Write(count[:])
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+	_, err := w.Write(digest.Sum(nil))
+	return err
+}
+
+func exportPrefix(ctx context.Context, store common.Store, prefix byte, w io.Writer) (uint64, error) {
+	it := store.GetAll(ctx, prefix)
+	defer it.Close()
+
+	var total uint64
+	chunk := make([]common.KVPair, 0, ChunkSize)
+	for it.Next() {
+		chunk = append(chunk, it.Pair())
+		if len(chunk) == ChunkSize {
+			if err := writeChunk(w, prefix, chunk); err != nil {
+				return 0, err
+			}
+			total += uint64(len(chunk))
+			chunk = chunk[:0]
+		}
+	}
+	if err := it.Err(); err != nil {
+		return 0, err
+	}
+	if len(chunk) > 0 {
+		if err := writeChunk(w, prefix, chunk); err != nil {
+			return 0, err
+		}
+		total += uint64(len(chunk))
+	}
+	return total, nil
+}
+
+func writeChunk(w io.Writer, prefix byte, chunk []common.KVPair) error {
+	var buf bytes.Buffer
+	var scratch [binary.MaxVarintLen64]byte
+	buf.WriteByte(prefix)
+	buf.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(chunk)))])
+	for _, pair := range chunk {
+		buf.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(pair.Key)))])
+		buf.Write(pair.Key)
+		buf.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(pair.Value)))])
+		buf.Write(pair.Value)
+	}
+	var checksum [4]byte
+	binary.BigEndian.PutUint32(checksum[:], crc32.Checksum(buf.Bytes(), crcTable))
+	buf.Write(checksum[:])
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// ImportOptions are the zero value by default, which imports the archive
+// without verifying it.
+type ImportOptions struct {
+	// Verify replays the event digests of the imported versions with the
+	// hasher once the archive is imported, and checks that the roots they
+	// lead to match the commitments recorded and that the replayed entries
+	// are the imported ones.
+	Verify bool
+	Hasher func() common.Hasher
+}
+
+// Import loads the archive into the store, which should be empty. The
+// entries are written chunk by chunk as they are read, so the store must be
+// discarded if Import fails.
+func Import(ctx context.Context, r io.Reader, store common.Store, opts ImportOptions) error {
+	if opts.Verify && opts.Hasher == nil {
+		return errors.New("verifying an import needs a hasher")
+	}
+
+	reader := &archiveReader{r: bufio.NewReader(r), digest: sha256.New()}
+	header := make([]byte, len(magic)+1)
+	if err := reader.readFull(header); err != nil {
+		return err
+	}
+	if string(header[:len(magic)]) != magic {
+		return fmt.Errorf("%w: not an archive", ErrInvalidArchive)
+	}
+	if header[len(magic)] != formatVersion {
+		return fmt.Errorf("%w: unsupported format version %d", ErrInvalidArchive, header[len(magic)])
+	}
+
+	var total uint64
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		prefix, err := reader.readByte()
+		if err != nil {
+			return err
+		}
+		if prefix == endMarker {
+			break
+		}
+		mutations, err := reader.readChunk(prefix)
+		if err != nil {
+			return err
+		}
+		if err := store.Mutate(ctx, mutations); err != nil {
+			return err
+		}
+		total += uint64(len(mutations))
+	}
+
+	var count [8]byte
+	if err := reader.readFull(count[:]); err != nil {
+		return err
+	}
+	expected := reader.digest.Sum(nil)
+	checksum := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(reader.r, checksum); err != nil {
+		return fmt.Errorf("%w: truncated trailer", ErrInvalidArchive)
+	}
+	if !bytes.Equal(checksum, expected) {
+		return fmt.Errorf("%w: checksum mismatch", ErrInvalidArchive)
+	}
+	if binary.BigEndian.Uint64(count[:]) != total {
+		return fmt.Errorf("%w: expected %d entries, read %d", ErrInvalidArchive, binary.BigEndian.Uint64(count[:]), total)
+	}
+
+	if opts.Verify {
+		return verify(ctx, store, opts.Hasher)
+	}
+	return nil
+}
+
+// archiveReader hashes everything read before the trailer checksum.
+type archiveReader struct {
+	r      *bufio.Reader
+	digest hash.Hash
+	chunk  bytes.Buffer
+}
+
+func (r *archiveReader) readFull(buf []byte) error {
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+	r.digest.Write(buf)
+	r.chunk.Write(buf)
+	return nil
+}
+
+func (r *archiveReader) readByte() (byte, error) {
+	var b [1]byte
+	err := r.readFull(b[:])
+	return b[0], err
+}
+
+func (r *archiveReader) readUvarint() (uint64, error) {
+	n, err := binary.ReadUvarint(byteReader{r})
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+	return n, nil
+}
+
+// readBytes reads a length prefixed slice, bounding the length so that a
+// corrupted one does not make it allocate an arbitrary amount of memory.
+func (r *archiveReader) readBytes() ([]byte, error) {
+	n, err := r.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	if n > 1<<30 {
+		return nil, fmt.Errorf("%w: entry of %d bytes", ErrInvalidArchive, n)
+	}
+	buf := make([]byte, n)
+	return buf, r.readFull(buf)
+}
+
+func (r *archiveReader) readChunk(prefix byte) ([]common.Mutation, error) {
+	if !validPrefix(prefix) {
+		return nil, fmt.Errorf("%w: unknown prefix %d", ErrInvalidArchive, prefix)
+	}
+	r.chunk.Reset()
+	r.chunk.WriteByte(prefix)
+
+	count, err := r.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 || count > ChunkSize {
+		return nil, fmt.Errorf("%w: chunk of %d entries", ErrInvalidArchive, count)
+	}
+	mutations := make([]common.Mutation, 0, count)
+	for i := uint64(0); i < count; i++ {
+		key, err := r.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		value, err := r.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		mutations = append(mutations, *common.NewMutation(prefix, key, value))
+	}
+
+	expected := crc32.Checksum(r.chunk.Bytes(), crcTable)
+	var checksum [4]byte
+	if err := r.readFull(checksum[:]); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(checksum[:]) != expected {
+		return nil, fmt.Errorf("%w: chunk checksum mismatch", ErrInvalidArchive)
+	}
+	return mutations, nil
+}
+
+type byteReader struct {
+	r *archiveReader
+}
+
+func (b byteReader) ReadByte() (byte, error) {
+	return b.r.readByte()
+}
+
+func validPrefix(prefix byte) bool {
+	for _, p := range Prefixes {
+		if p == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// verify replays the event digests of the committed versions recorded in
+// the imported store into a balloon kept in memory, checking the commitment
+// of every version on the way. The imported store is only read, as opening a
+// balloon over it could recover it. The entries of the replayed store must
+// then be the imported ones, so that forged cache or index entries, which
+// no commitment covers, are not trusted. A store exported with a pending
+// version does not verify, as its entries are left to be recovered.
+func verify(ctx context.Context, store common.Store, hasherF func() common.Hasher) error {
+	replayed := bplus.NewBPlusTreeStorage()
+	b, err := balloon.NewBalloon(replayed, hasherF)
+	if err != nil {
+		return err
+	}
+	for version := uint64(0); ; version++ {
+		recorded, err := balloon.RecordedCommitment(ctx, store, version)
+		if err == balloon.ErrVersionNotFound {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		commitment, err := b.AddDigest(ctx, recorded.EventDigest)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(commitment.HyperDigest, recorded.HyperDigest) || !bytes.Equal(commitment.HistoryDigest, recorded.HistoryDigest) {
+			return fmt.Errorf("%w of version %d", ErrRootMismatch, version)
+		}
+	}
+	for _, prefix := range Prefixes {
+		if err := compareEntries(ctx, store, replayed, prefix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compareEntries checks that both stores hold the same entries under the
+// prefix.
+func compareEntries(ctx context.Context, imported, replayed common.Store, prefix byte) error {
+	importedIt := imported.GetAll(ctx, prefix)
+	defer importedIt.Close()
+	replayedIt := replayed.GetAll(ctx, prefix)
+	defer replayedIt.Close()
+
+	for {
+		more, expected := importedIt.Next(), replayedIt.Next()
+		if !more || !expected {
+			if err := importedIt.Err(); err != nil {
+				return err
+			}
+			if err := replayedIt.Err(); err != nil {
+				return err
+			}
+			if more != expected {
+				return fmt.Errorf("%w: the entries of prefix %d differ in number", ErrEntryMismatch, prefix)
+			}
+			return nil
+		}
+		pair, replayedPair := importedIt.Pair(), replayedIt.Pair()
+		if !bytes.Equal(pair.Key, replayedPair.Key) || !bytes.Equal(pair.Value, replayedPair.Value) {
+			return fmt.Errorf("%w: entry %x of prefix %d", ErrEntryMismatch, pair.Key, prefix)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/aalda/trees/balloon"
+	"github.com/aalda/trees/balloon/balloontest"
+	"github.com/aalda/trees/common"
+	"github.com/aalda/trees/log"
+	"github.com/aalda/trees/storage/bolt"
+	"github.com/aalda/trees/storage/bplus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newStore(t *testing.T, events uint64) common.Store {
+	store := bplus.NewBPlusTreeStorage()
+	balloontest.NewBalloon(t, store, events)
+	return store
+}
+
+func export(t *testing.T, store common.Store) []byte {
+	var buf bytes.Buffer
+	require.NoError(t, Export(balloontest.Ctx, store, &buf))
+	return buf.Bytes()
+}
+
+func TestExportImport(t *testing.T) {
+
+	log.SetLogger("TestExportImport", log.SILENT)
+
+	// more entries than fit in a chunk
+	source := newStore(t, 100)
+	archive := export(t, source)
+
+	target, err := bolt.NewBoltStore(filepath.Join(t.TempDir(), "store.db"))
+	require.NoError(t, err)
+	defer target.Close()
+	require.NoError(t, Import(balloontest.Ctx, bytes.NewReader(archive), target, ImportOptions{Verify: true, Hasher: balloontest.Sha256Hasher}))
+
+	for _, prefix := range Prefixes {
+		expected, err := common.CollectRange(source.GetAll(balloontest.Ctx, prefix))
+		require.NoError(t, err)
+		imported, err := common.CollectRange(target.GetAll(balloontest.Ctx, prefix))
+		require.NoError(t, err)
+		assert.Equal(t, expected, imported, "Incorrect entries of prefix %d", prefix)
+	}
+
+	b, err := balloon.NewBalloon(target, balloontest.Sha256Hasher)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(100), b.Version(), "Incorrect version")
+	proof, err := b.Get(balloontest.Ctx, balloontest.Sha256Hasher().Do(balloontest.Event(42)))
+	require.NoError(t, err)
+	verified, err := proof.Verify(balloontest.Ctx, balloontest.Sha256Hasher())
+	require.NoError(t, err)
+	assert.True(t, verified, "The imported balloon should prove its events")
+
+	// the imported store exports the same archive
+	assert.Equal(t, archive, export(t, target), "Incorrect exported archive")
+}
+
+func TestImportEmpty(t *testing.T) {
+
+	log.SetLogger("TestImportEmpty", log.SILENT)
+
+	target := bplus.NewBPlusTreeStorage()
+	require.NoError(t, Import(balloontest.Ctx, bytes.NewReader(export(t, newStore(t, 0))), target, ImportOptions{Verify: true, Hasher: balloontest.Sha256Hasher}))
+
+	b, err := balloon.NewBalloon(target, balloontest.Sha256Hasher)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), b.Version(), "Incorrect version")
+}
+
+func TestImportInvalidArchives(t *testing.T) {
+
+	log.SetLogger("TestImportInvalidArchives", log.SILENT)
+
+	archive := export(t, newStore(t, 10))
+	corrupt := func(pos int) []byte {
+		corrupted := append([]byte{}, archive...)
+		corrupted[pos] ^= 0xff
+		return corrupted
+	}
+
+	testCases := []struct {
+		name    string
+		archive []byte
+	}{
+		{"empty", nil},
+		{"magic", corrupt(0)},
+		{"format version", corrupt(len(magic))},
+		{"first chunk", corrupt(len(magic) + 20)},
+		{"entry count", corrupt(len(archive) - sha256.Size - 1)},
+		{"trailer checksum", corrupt(len(archive) - 1)},
+		{"truncated chunk", archive[:len(archive)/2]},
+		{"truncated trailer", archive[:len(archive)-10]},
+		{"missing trailer", archive[:len(archive)-sha256.Size-9]},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := Import(balloontest.Ctx, bytes.NewReader(tc.archive), bplus.NewBPlusTreeStorage(), ImportOptions{})
+			assert.True(t, errors.Is(err, ErrInvalidArchive), "The archive should be rejected: %v", err)
+		})
+	}
+}
+
+func TestImportVerify(t *testing.T) {
+
+	log.SetLogger("TestImportVerify", log.SILENT)
+
+	// a log whose event digest of version 3 does not lead to the recorded
+	// roots, which the checksums of the archive cannot detect
+	source := newStore(t, 10)
+	pair, err := source.Get(balloontest.Ctx, common.VersionPrefix, []byte{0, 0, 0, 0, 0, 0, 0, 3})
+	require.NoError(t, err)
+	pair.Value[2] ^= 0xff
+	require.NoError(t, source.Mutate(balloontest.Ctx, []common.Mutation{*common.NewMutation(common.VersionPrefix, pair.Key, pair.Value)}))
+	archive := export(t, source)
+
+	require.NoError(t, Import(balloontest.Ctx, bytes.NewReader(archive), bplus.NewBPlusTreeStorage(), ImportOptions{}))
+
+	err = Import(balloontest.Ctx, bytes.NewReader(archive), bplus.NewBPlusTreeStorage(), ImportOptions{Verify: true, Hasher: balloontest.Sha256Hasher})
+	assert.True(t, errors.Is(err, ErrRootMismatch), "The roots should not match: %v", err)
+
+	err = Import(balloontest.Ctx, bytes.NewReader(archive), bplus.NewBPlusTreeStorage(), ImportOptions{Verify: true})
+	assert.Error(t, err, "Verifying needs a hasher")
+}
+
+func TestImportVerifyEntries(t *testing.T) {
+
+	log.SetLogger("TestImportVerifyEntries", log.SILENT)
+
+	// entries no commitment covers, which a balloon opened over the store
+	// would serve without replaying the log
+	forge := func(prefix byte) func(store common.Store) {
+		return func(store common.Store) {
+			it := store.GetAll(balloontest.Ctx, prefix)
+			defer it.Close()
+			require.True(t, it.Next(), "The store should hold entries of prefix %d", prefix)
+			pair := it.Pair()
+			value := append([]byte{}, pair.Value...)
+			value[len(value)-1] ^= 0xff
+			require.NoError(t, store.Mutate(balloontest.Ctx, []common.Mutation{*common.NewMutation(prefix, pair.Key, value)}))
+		}
+	}
+
+	testCases := []struct {
+		name  string
+		forge func(store common.Store)
+	}{
+		{"index", forge(common.IndexPrefix)},
+		{"hyper cache", forge(common.HyperCachePrefix)},
+		{"history cache", forge(common.HistoryCachePrefix)},
+		{"extra index", func(store common.Store) {
+			digest := balloontest.Sha256Hasher().Do([]byte("forged"))
+			require.NoError(t, store.Mutate(balloontest.Ctx, []common.Mutation{*common.NewMutation(common.IndexPrefix, digest, []byte{0, 0, 0, 0, 0, 0, 0, 3})}))
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			source := newStore(t, 10)
+			tc.forge(source)
+			archive := export(t, source)
+
+			err := Import(balloontest.Ctx, bytes.NewReader(archive), bplus.NewBPlusTreeStorage(), ImportOptions{Verify: true, Hasher: balloontest.Sha256Hasher})
+			assert.True(t, errors.Is(err, ErrEntryMismatch), "The forged entry should be detected: %v", err)
+		})
+	}
+}
@@ -0,0 +1,273 @@
+package balloon
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/bits"
+	"sync"
+
+	"github.com/aalda/trees/common"
+	"github.com/aalda/trees/history"
+	"github.com/aalda/trees/hyper"
+	"github.com/aalda/trees/log"
+	"github.com/aalda/trees/trace"
+	"github.com/aalda/trees/util"
+)
+
+// Balloon keeps a hyper tree and a history tree over the same events, so that
+// both membership and consistency between versions can be proven.
+type Balloon struct {
+	lock        sync.RWMutex
+	version     uint64
+	dirty       bool
+	hasher      common.Hasher
+	store       common.Store
+	hyperTree   *hyper.HyperTree
+	historyTree *history.HistoryTree
+	logger      *log.Logger
+
+	// added is closed and replaced every time the version moves forward,
+	// waking up the watchers. It has its own lock so that watchers do not
+	// contend with Add.
+	addedLock sync.Mutex
+	added     chan struct{}
+}
+
+type Commitment struct {
+	EventDigest   common.Digest
+	HyperDigest   common.Digest
+	HistoryDigest common.Digest
+	Version       uint64
+}
+
+var ErrDivergedVersion = errors.New("replayed version does not match its committed digests")
+
+// hyperCacheSize bounds the number of hyper tree nodes kept in memory, the
+// rest being read from the store.
+const hyperCacheSize = 1 << 20
+
+func hyperCacheLevel(hasher common.Hasher) uint16 {
+	if hasher.Len() < 48 {
+		return hasher.Len() / 2
+	}
+	return hasher.Len() - 24
+}
+
+// NewBalloon opens a balloon over the given store, loading the hyper tree
+// cache and recovering the last version if the previous process died while
+// adding it. Every tree gets its own hasher, as hashers are not safe for
+// concurrent use.
+func NewBalloon(store common.Store, hasherF func() common.Hasher) (*Balloon, error) {
+	hasher := hasherF()
+	hyperCache := common.NewTwoLevelCacheWithFirstLevel(common.NewLRUCache(hyperCacheSize), common.NewPassThroughCache(common.HyperCachePrefix, store))
+	historyCache := common.NewPassThroughCache(common.HistoryCachePrefix, store)
+	b := &Balloon{
+		hasher:      hasher,
+		store:       store,
+		hyperTree:   hyper.NewHyperTree(hasherF(), store, hyperCache, hyperCacheLevel(hasher)),
+		historyTree: history.NewHistoryTree(hasherF(), store, historyCache),
+		logger:      log.Default().Named("balloon"),
+		added:       make(chan struct{}),
+	}
+	ctx := context.Background()
+	if err := b.hyperTree.LoadCache(ctx); err != nil {
+		return nil, err
+	}
+	if err := b.recover(ctx); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// SetLogger makes the balloon and its trees log through the given logger,
+// each one as its own component.
+func (b *Balloon) SetLogger(logger *log.Logger) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.logger = logger.Named("balloon")
+	b.hyperTree.SetLogger(logger.Named("hyper"))
+	b.historyTree.SetLogger(logger.Named("history"))
+}
+
+// Version returns the version the next event will be added with.
+func (b *Balloon) Version() uint64 {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.version
+}
+
+// Add appends the event to both trees. If it fails once the event has reached
+// the write-ahead log, the event is applied when the balloon recovers: on
+// Recover, on the next call to Add or when it is opened again.
+func (b *Balloon) Add(ctx context.Context, event []byte) (*Commitment, error) {
+	return b.AddDigest(ctx, b.digest(event))
+}
+
+// AddDigest appends an event whose digest has already been computed by the
+// caller with the same hasher as the balloon.
+func (b *Balloon) AddDigest(ctx context.Context, eventDigest common.Digest) (*Commitment, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	ctx, span := trace.Start(ctx, "balloon.Add")
+	defer span.End()
+
+	if b.dirty {
+		if err := b.recover(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	version := b.version
+	b.logger.Debug("Adding event", log.Hex("event", eventDigest), log.Uint64("version", version))
+
+	span.SetAttribute("version", version)
+	commitment, err := b.add(ctx, version, eventDigest)
+	if err != nil {
+		b.dirty = true
+		return nil, err
+	}
+	b.version++
+	b.notifyAdded()
+	return commitment, nil
+}
+
+// digest hashes the event with the hasher of the balloon, which is not safe
+// for concurrent use.
+func (b *Balloon) digest(event []byte) common.Digest {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.hasher.Do(event)
+}
+
+func (b *Balloon) add(ctx context.Context, version uint64, eventDigest common.Digest) (*Commitment, error) {
+	if err := b.writeRecord(ctx, version, walRecord{state: walPending, eventDigest: eventDigest}); err != nil {
+		return nil, err
+	}
+	commitment, err := b.apply(ctx, version, eventDigest)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.commit(ctx, commitment); err != nil {
+		return nil, err
+	}
+	return commitment, nil
+}
+
+// apply adds the event to both trees. Applying an event twice with the same
+// version leaves the trees as they were after the first time.
+func (b *Balloon) apply(ctx context.Context, version uint64, eventDigest common.Digest) (*Commitment, error) {
+	hyperCommitment, err := b.hyperTree.Add(ctx, eventDigest, version)
+	if err != nil {
+		return nil, err
+	}
+	historyCommitment, err := b.historyTree.Add(ctx, eventDigest, version)
+	if err != nil {
+		return nil, err
+	}
+	return &Commitment{
+		EventDigest:   eventDigest,
+		HyperDigest:   hyperCommitment.Digest,
+		HistoryDigest: historyCommitment.Digest,
+		Version:       version,
+	}, nil
+}
+
+func (b *Balloon) commit(ctx context.Context, c *Commitment) error {
+	return b.writeRecord(ctx, c.Version, walRecord{walCommitted, c.EventDigest, c.HyperDigest, c.HistoryDigest})
+}
+
+// Recover replays the version left incomplete by a failed Add, so that
+// Version tells whether the event made it to the trees.
+func (b *Balloon) Recover(ctx context.Context) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.recover(ctx)
+}
+
+// recover brings the trees up to the last version in the write-ahead log. A
+// pending version, or a committed one whose entries did not make it to the
+// store, is replayed from the event digest kept in its record.
+func (b *Balloon) recover(ctx context.Context) error {
+	ctx, span := trace.Start(ctx, "balloon.Recover")
+	defer span.End()
+
+	last, ok, err := b.lastVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		b.version, b.dirty = 0, false
+		return nil
+	}
+
+	record, err := b.readRecord(ctx, last)
+	if err != nil {
+		return err
+	}
+	persisted := false
+	if record.state == walCommitted {
+		persisted, err = b.isPersisted(ctx, last, record)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !persisted {
+		b.logger.Info("Replaying incomplete version", log.Uint64("version", last))
+		commitment, err := b.apply(ctx, last, record.eventDigest)
+		if err != nil {
+			return err
+		}
+		if record.state == walCommitted &&
+			(!bytes.Equal(commitment.HyperDigest, record.hyperDigest) ||
+				!bytes.Equal(commitment.HistoryDigest, record.historyDigest)) {
+			return ErrDivergedVersion
+		}
+		if err := b.commit(ctx, commitment); err != nil {
+			return err
+		}
+	}
+
+	b.version, b.dirty = last+1, false
+	b.notifyAdded()
+	return nil
+}
+
+// isPersisted checks that the store holds the entries written by a version:
+// its leaf in the hyper tree, the hyper tree cache nodes its root is made of,
+// and its leaf and the last complete node above it in the history tree.
+// Entries left by earlier versions cannot pass for them, so a store that lost
+// some writes of the version while keeping its committed record is replayed.
+func (b *Balloon) isPersisted(ctx context.Context, version uint64, record *walRecord) (bool, error) {
+	pair, err := b.store.Get(ctx, common.IndexPrefix, record.eventDigest)
+	switch {
+	case err == common.ErrKeyNotFound:
+		return false, nil
+	case err != nil:
+		return false, err
+	case !bytes.Equal(pair.Value, util.Uint64AsBytes(version)):
+		return false, nil
+	}
+
+	root, err := b.hyperTree.StoredRoot(ctx)
+	if err != nil || !bytes.Equal(root, record.hyperDigest) {
+		return false, err
+	}
+
+	for _, pos := range []*history.HistoryPosition{history.NewPosition(version, 0), lastCompleteNode(version)} {
+		ok, err := b.store.Has(ctx, common.HistoryCachePrefix, pos.Bytes())
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// lastCompleteNode returns the highest node of the history tree completed by
+// the given version, which is the last one it caches.
+func lastCompleteNode(version uint64) *history.HistoryPosition {
+	height := uint16(bits.TrailingZeros64(^version))
+	return history.NewPosition(version-(1<<height)+1, height)
+}
@@ -0,0 +1,256 @@
+package balloon
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/aalda/trees/common"
+	"github.com/aalda/trees/history"
+	"github.com/aalda/trees/log"
+	"github.com/aalda/trees/storage/bplus"
+	"github.com/aalda/trees/storage/storetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var ctx = context.Background()
+
+func sha256Hasher() common.Hasher {
+	return common.NewSha256Hasher()
+}
+
+func event(i uint64) []byte {
+	return []byte(fmt.Sprintf("event %d", i))
+}
+
+// addEvents adds the events from the current version up to the given one and
+// returns the last commitment.
+func addEvents(t *testing.T, b *Balloon, until uint64) *Commitment {
+	var commitment *Commitment
+	for i := b.Version(); i < until; i++ {
+		var err error
+		commitment, err = b.Add(ctx, event(i))
+		require.NoError(t, err)
+		require.Equal(t, i, commitment.Version, "Incorrect version")
+	}
+	return commitment
+}
+
+func TestAdd(t *testing.T) {
+
+	log.SetLogger("TestAdd", log.SILENT)
+
+	b, err := NewBalloon(bplus.NewBPlusTreeStorage(), sha256Hasher)
+	require.NoError(t, err)
+
+	hasher := common.NewSha256Hasher()
+	for i := uint64(0); i < 10; i++ {
+		commitment, err := b.Add(ctx, event(i))
+		require.NoError(t, err)
+		assert.Equal(t, i, commitment.Version, "Incorrect version")
+		assert.Equal(t, common.Digest(hasher.Do(event(i))), commitment.EventDigest, "Incorrect event digest")
+	}
+	assert.Equal(t, uint64(10), b.Version(), "Incorrect next version")
+}
+
+func TestReopen(t *testing.T) {
+
+	log.SetLogger("TestReopen", log.SILENT)
+
+	reference, err := NewBalloon(bplus.NewBPlusTreeStorage(), sha256Hasher)
+	require.NoError(t, err)
+	expected := addEvents(t, reference, 20)
+
+	store := bplus.NewBPlusTreeStorage()
+	b, err := NewBalloon(store, sha256Hasher)
+	require.NoError(t, err)
+	addEvents(t, b, 10)
+
+	b, err = NewBalloon(store, sha256Hasher)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), b.Version(), "The version should survive reopening")
+	assert.Equal(t, expected, addEvents(t, b, 20), "Incorrect commitment after reopening")
+}
+
+func TestRecovery(t *testing.T) {
+
+	log.SetLogger("TestRecovery", log.SILENT)
+
+	reference, err := NewBalloon(bplus.NewBPlusTreeStorage(), sha256Hasher)
+	require.NoError(t, err)
+	expected := addEvents(t, reference, 10)
+
+	// an add does four writes: the pending record, the hyper tree, the history
+	// tree and the committed record
+	for writes := 0; writes < 4; writes++ {
+		for _, torn := range []bool{false, true} {
+			for _, reopen := range []bool{false, true} {
+				name := fmt.Sprintf("failing after %d writes (torn: %v, reopen: %v)", writes, torn, reopen)
+
+				store := storetest.NewFaultyStore(bplus.NewBPlusTreeStorage())
+				b, err := NewBalloon(store, sha256Hasher)
+				require.NoError(t, err)
+				addEvents(t, b, 5)
+
+				store.FailAfter(writes, torn)
+				_, err = b.Add(ctx, event(5))
+				require.Equal(t, storetest.ErrInjectedFault, err, name)
+				store.Heal()
+
+				if reopen {
+					b, err = NewBalloon(store, sha256Hasher)
+				} else {
+					err = b.Recover(ctx)
+				}
+				require.NoError(t, err, name)
+
+				// once the pending record is written, the event is applied
+				// by the recovery
+				if writes > 0 {
+					require.Equal(t, uint64(6), b.Version(), name)
+				} else {
+					require.Equal(t, uint64(5), b.Version(), name)
+				}
+				require.Equal(t, expected, addEvents(t, b, 10), name)
+			}
+		}
+	}
+}
+
+func TestRecoveryWithLostWrites(t *testing.T) {
+
+	log.SetLogger("TestRecoveryWithLostWrites", log.SILENT)
+
+	reference, err := NewBalloon(bplus.NewBPlusTreeStorage(), sha256Hasher)
+	require.NoError(t, err)
+	expected := addEvents(t, reference, 10)
+
+	// the committed record of version 5 survives the crash, but not the
+	// cache nodes it wrote, while those of the earlier versions are there
+	for _, prefix := range []byte{common.HyperCachePrefix, common.HistoryCachePrefix} {
+		store := storetest.NewFaultyStore(bplus.NewBPlusTreeStorage())
+		b, err := NewBalloon(store, sha256Hasher)
+		require.NoError(t, err)
+		addEvents(t, b, 5)
+
+		store.Drop(prefix)
+		_, err = b.Add(ctx, event(5))
+		require.NoError(t, err)
+		store.Heal()
+
+		b, err = NewBalloon(store, sha256Hasher)
+		require.NoErrorf(t, err, "Losing the writes under prefix %d", prefix)
+		require.Equalf(t, uint64(6), b.Version(), "Losing the writes under prefix %d", prefix)
+		require.Equalf(t, expected, addEvents(t, b, 10), "Losing the writes under prefix %d", prefix)
+	}
+}
+
+func TestRecoveryWithMissingEntries(t *testing.T) {
+
+	log.SetLogger("TestRecoveryWithMissingEntries", log.SILENT)
+
+	store := bplus.NewBPlusTreeStorage()
+	b, err := NewBalloon(store, sha256Hasher)
+	require.NoError(t, err)
+	expected := addEvents(t, b, 3)
+
+	leaf := history.NewPosition(2, 0).Bytes()
+	require.NoError(t, store.Mutate(ctx, []common.Mutation{
+		*common.NewDeleteMutation(common.HistoryCachePrefix, leaf),
+		*common.NewDeleteMutation(common.IndexPrefix, expected.EventDigest),
+	}))
+
+	b, err = NewBalloon(store, sha256Hasher)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), b.Version(), "Incorrect version after recovery")
+
+	ok, err := store.Has(ctx, common.HistoryCachePrefix, leaf)
+	require.NoError(t, err)
+	assert.True(t, ok, "The missing history leaf should be replayed")
+	ok, err = store.Has(ctx, common.IndexPrefix, expected.EventDigest)
+	require.NoError(t, err)
+	assert.True(t, ok, "The missing hyper leaf should be replayed")
+}
+
+func TestRecoveryWithDivergedVersion(t *testing.T) {
+
+	log.SetLogger("TestRecoveryWithDivergedVersion", log.SILENT)
+
+	store := bplus.NewBPlusTreeStorage()
+	b, err := NewBalloon(store, sha256Hasher)
+	require.NoError(t, err)
+	commitment := addEvents(t, b, 3)
+
+	// a committed record whose digests cannot be reproduced
+	record := walRecord{walCommitted, commitment.EventDigest, commitment.HistoryDigest, commitment.HyperDigest}
+	require.NoError(t, store.Mutate(ctx, []common.Mutation{
+		*common.NewMutation(common.VersionPrefix, versionKey(2), record.encode()),
+		*common.NewDeleteMutation(common.IndexPrefix, commitment.EventDigest),
+	}))
+
+	_, err = NewBalloon(store, sha256Hasher)
+	assert.Equal(t, ErrDivergedVersion, err)
+}
+
+func TestCorruptedLog(t *testing.T) {
+
+	log.SetLogger("TestCorruptedLog", log.SILENT)
+
+	testCases := [][]byte{
+		{},
+		{0x7, 0x1, 0x1, 0x0, 0x0},
+		{byte(walPending), 0x0, 0x0, 0x0},
+		{byte(walPending), 0x2, 0x1},
+		{byte(walPending), 0x1, 0x1, 0x0, 0x0, 0x0},
+	}
+
+	for i, c := range testCases {
+		store := bplus.NewBPlusTreeStorage()
+		require.NoError(t, store.Mutate(ctx, []common.Mutation{*common.NewMutation(common.VersionPrefix, versionKey(0), c)}))
+		_, err := NewBalloon(store, sha256Hasher)
+		assert.Equalf(t, ErrCorruptedLog, err, "Corrupted record %d should be detected", i)
+	}
+}
+
+func TestLastVersion(t *testing.T) {
+
+	for _, n := range []uint64{0, 1, 2, 3, 7, 8, 9, 100} {
+		b := &Balloon{store: bplus.NewBPlusTreeStorage()}
+		for i := uint64(0); i < n; i++ {
+			require.NoError(t, b.writeRecord(ctx, i, walRecord{state: walPending, eventDigest: common.Digest{0x1}}))
+		}
+		last, ok, err := b.lastVersion(ctx)
+		require.NoError(t, err)
+		require.Equalf(t, n > 0, ok, "Incorrect presence with %d records", n)
+		if n > 0 {
+			require.Equalf(t, n-1, last, "Incorrect last version with %d records", n)
+		}
+	}
+}
+
+func TestAddRecoversAfterFailure(t *testing.T) {
+
+	log.SetLogger("TestAddRecoversAfterFailure", log.SILENT)
+
+	reference, err := NewBalloon(bplus.NewBPlusTreeStorage(), sha256Hasher)
+	require.NoError(t, err)
+	addEvents(t, reference, 3)
+	expected, err := reference.Add(ctx, event(4))
+	require.NoError(t, err)
+
+	store := storetest.NewFaultyStore(bplus.NewBPlusTreeStorage())
+	b, err := NewBalloon(store, sha256Hasher)
+	require.NoError(t, err)
+	addEvents(t, b, 2)
+
+	// the event reaches the log but not the history tree
+	store.FailAfter(2, true)
+	_, err = b.Add(ctx, event(2))
+	require.Equal(t, storetest.ErrInjectedFault, err)
+	store.Heal()
+
+	commitment, err := b.Add(ctx, event(4))
+	require.NoError(t, err)
+	assert.Equal(t, expected, commitment, "The failed event should be applied before the next one")
+}
@@ -0,0 +1,38 @@
+// Package balloontest provides the fixtures shared by the tests of the
+// packages built on top of a balloon.
+package balloontest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/aalda/trees/balloon"
+	"github.com/aalda/trees/common"
+	"github.com/stretchr/testify/require"
+)
+
+// Ctx is the context the fixtures and the tests using them run with.
+var Ctx = context.Background()
+
+// Sha256Hasher is the hasher factory the balloons of the fixtures use.
+func Sha256Hasher() common.Hasher {
+	return common.NewSha256Hasher()
+}
+
+// Event returns the i-th event added by NewBalloon.
+func Event(i uint64) []byte {
+	return []byte(fmt.Sprintf("event %d", i))
+}
+
+// NewBalloon opens a balloon over the store and adds the given number of
+// events to it.
+func NewBalloon(t *testing.T, store common.Store, events uint64) *balloon.Balloon {
+	b, err := balloon.NewBalloon(store, Sha256Hasher)
+	require.NoError(t, err)
+	for i := uint64(0); i < events; i++ {
+		_, err := b.Add(Ctx, Event(i))
+		require.NoError(t, err)
+	}
+	return b
+}
@@ -0,0 +1,177 @@
+package balloon
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aalda/trees/common"
+	"github.com/aalda/trees/history"
+	"github.com/aalda/trees/hyper"
+	"github.com/aalda/trees/storage/bplus"
+	"github.com/aalda/trees/util"
+)
+
+var (
+	ErrVersionNotFound = errors.New("version not found")
+	ErrInvalidRange    = errors.New("start version is greater than end version")
+)
+
+// MembershipProof proves that an event was added with Version, against the
+// hyper digest committed by CurrentVersion.
+type MembershipProof struct {
+	EventDigest    common.Digest
+	Version        uint64
+	CurrentVersion uint64
+	HyperDigest    common.Digest
+	AuditPath      common.AuditPath
+}
+
+// HistoryProof proves that the event added with Index is part of the history
+// committed by Version.
+type HistoryProof struct {
+	Index         uint64
+	Version       uint64
+	EventDigest   common.Digest
+	HistoryDigest common.Digest
+	AuditPath     common.AuditPath
+}
+
+// ConsistencyProof proves that the history committed by End extends the one
+// committed by Start.
+type ConsistencyProof struct {
+	Start       uint64
+	End         uint64
+	StartDigest common.Digest
+	EndDigest   common.Digest
+	AuditPath   common.AuditPath
+}
+
+// The proofs are verified against the digests they carry, so callers must
+// check that those digests match the commitments they trust. Verifying does
+// not need a store: the trees are only used to recompute the digests from the
+// audit paths. A proof whose audit path misses a digest does not verify, as
+// proofs may come from untrusted parties, and neither does a history proof
+// of an index after its version. Verifying fails, rather than reporting an
+// invalid proof, if the context is done before the digests are recomputed.
+
+func (p *MembershipProof) Verify(ctx context.Context, hasher common.Hasher) (bool, error) {
+	tree := hyper.NewHyperTree(hasher, bplus.NewBPlusTreeStorage(), common.NewSimpleCache(0), hyperCacheLevel(hasher))
+	return tree.VerifyMembership(ctx, hyper.NewMembershipProof(p.AuditPath), p.Version, p.EventDigest, p.HyperDigest)
+}
+
+func (p *HistoryProof) Verify(ctx context.Context, hasher common.Hasher) (bool, error) {
+	if p.Index > p.Version {
+		return false, nil
+	}
+	tree := history.NewHistoryTree(hasher, bplus.NewBPlusTreeStorage(), common.NewSimpleCache(0))
+	return tree.VerifyMembership(ctx, history.NewMembershipProof(p.AuditPath), p.Index, p.Version, p.EventDigest, p.HistoryDigest)
+}
+
+func (p *ConsistencyProof) Verify(ctx context.Context, hasher common.Hasher) (bool, error) {
+	tree := history.NewHistoryTree(hasher, bplus.NewBPlusTreeStorage(), common.NewSimpleCache(0))
+	return tree.VerifyIncremental(ctx, history.NewIncrementalProof(p.AuditPath), p.Start, p.End, p.StartDigest, p.EndDigest)
+}
+
+// Commitment returns the digests of the trees once the version was added.
+func (b *Balloon) Commitment(ctx context.Context, version uint64) (*Commitment, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.commitment(ctx, version)
+}
+
+func (b *Balloon) commitment(ctx context.Context, version uint64) (*Commitment, error) {
+	if version >= b.version {
+		return nil, ErrVersionNotFound
+	}
+	record, err := b.readRecord(ctx, version)
+	if err != nil {
+		return nil, err
+	}
+	return record.commitment(version), nil
+}
+
+// Get proves the membership of the event in the hyper tree as of the last
+// version. It returns common.ErrKeyNotFound if the event was never added.
+func (b *Balloon) Get(ctx context.Context, eventDigest common.Digest) (*MembershipProof, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	if b.version == 0 {
+		return nil, common.ErrKeyNotFound
+	}
+	current, err := b.commitment(ctx, b.version-1)
+	if err != nil {
+		return nil, err
+	}
+	value, proof, err := b.hyperTree.Get(ctx, eventDigest)
+	if err != nil {
+		return nil, err
+	}
+	return &MembershipProof{
+		EventDigest:    eventDigest,
+		Version:        util.BytesAsUint64(value),
+		CurrentVersion: current.Version,
+		HyperDigest:    current.HyperDigest,
+		AuditPath:      proof.AuditPath,
+	}, nil
+}
+
+// ProveMembership proves that the event added with the index is part of the
+// history committed by the version.
+func (b *Balloon) ProveMembership(ctx context.Context, index, version uint64) (*HistoryProof, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	if index > version {
+		return nil, ErrInvalidRange
+	}
+	event, err := b.commitment(ctx, index)
+	if err != nil {
+		return nil, err
+	}
+	committed, err := b.commitment(ctx, version)
+	if err != nil {
+		return nil, err
+	}
+	proof, err := b.historyTree.ProveMembership(ctx, index, version)
+	if err != nil {
+		return nil, err
+	}
+	return &HistoryProof{
+		Index:         index,
+		Version:       version,
+		EventDigest:   event.EventDigest,
+		HistoryDigest: committed.HistoryDigest,
+		AuditPath:     proof.AuditPath,
+	}, nil
+}
+
+// ProveConsistency proves that the history committed by end extends the one
+// committed by start.
+func (b *Balloon) ProveConsistency(ctx context.Context, start, end uint64) (*ConsistencyProof, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	if start > end {
+		return nil, ErrInvalidRange
+	}
+	startCommitment, err := b.commitment(ctx, start)
+	if err != nil {
+		return nil, err
+	}
+	endCommitment, err := b.commitment(ctx, end)
+	if err != nil {
+		return nil, err
+	}
+	proof, err := b.historyTree.ProveConsistency(ctx, start, end)
+	if err != nil {
+		return nil, err
+	}
+	return &ConsistencyProof{
+		Start:       start,
+		End:         end,
+		StartDigest: startCommitment.HistoryDigest,
+		EndDigest:   endCommitment.HistoryDigest,
+		AuditPath:   proof.AuditPath,
+	}, nil
+}
@@ -0,0 +1,169 @@
+package balloon
+
+import (
+	"testing"
+
+	"github.com/aalda/trees/common"
+	"github.com/aalda/trees/log"
+	"github.com/aalda/trees/storage/bplus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommitment(t *testing.T) {
+
+	log.SetLogger("TestCommitment", log.SILENT)
+
+	b, err := NewBalloon(bplus.NewBPlusTreeStorage(), sha256Hasher)
+	require.NoError(t, err)
+	_, err = b.Commitment(ctx, 0)
+	assert.Equal(t, ErrVersionNotFound, err, "An empty balloon should have no commitments")
+
+	expected := addEvents(t, b, 10)
+	commitment, err := b.Commitment(ctx, 9)
+	require.NoError(t, err)
+	assert.Equal(t, expected, commitment, "Incorrect commitment")
+
+	_, err = b.Commitment(ctx, 10)
+	assert.Equal(t, ErrVersionNotFound, err, "The next version should not be committed")
+}
+
+func TestRecordedCommitment(t *testing.T) {
+
+	log.SetLogger("TestRecordedCommitment", log.SILENT)
+
+	store := bplus.NewBPlusTreeStorage()
+	b, err := NewBalloon(store, sha256Hasher)
+	require.NoError(t, err)
+	expected := addEvents(t, b, 10)
+
+	// the trees are not needed
+	require.NoError(t, store.Mutate(ctx, []common.Mutation{*common.NewDeleteMutation(common.IndexPrefix, expected.EventDigest)}))
+	commitment, err := RecordedCommitment(ctx, store, 9)
+	require.NoError(t, err)
+	assert.Equal(t, expected, commitment, "Incorrect commitment")
+
+	_, err = RecordedCommitment(ctx, store, 10)
+	assert.Equal(t, ErrVersionNotFound, err, "The next version should not be committed")
+
+	// nor are pending versions
+	require.NoError(t, b.writeRecord(ctx, 10, walRecord{state: walPending, eventDigest: common.Digest{0x1}}))
+	_, err = RecordedCommitment(ctx, store, 10)
+	assert.Equal(t, ErrVersionNotFound, err, "A pending version should not be committed")
+}
+
+func TestGet(t *testing.T) {
+
+	log.SetLogger("TestGet", log.SILENT)
+
+	b, err := NewBalloon(bplus.NewBPlusTreeStorage(), sha256Hasher)
+	require.NoError(t, err)
+	last := addEvents(t, b, 10)
+
+	hasher := common.NewSha256Hasher()
+	for i := uint64(0); i < 10; i++ {
+		proof, err := b.Get(ctx, hasher.Do(event(i)))
+		require.NoError(t, err)
+		assert.Equal(t, i, proof.Version, "Incorrect version")
+		assert.Equal(t, last.Version, proof.CurrentVersion, "Incorrect current version")
+		assert.Equal(t, last.HyperDigest, proof.HyperDigest, "Incorrect hyper digest")
+		verified, err := proof.Verify(ctx, common.NewSha256Hasher())
+		require.NoError(t, err)
+		assert.True(t, verified, "The proof should verify for event %d", i)
+	}
+
+	_, err = b.Get(ctx, hasher.Do([]byte("missing")))
+	assert.Equal(t, common.ErrKeyNotFound, err, "A missing event should not be found")
+}
+
+func TestProveMembership(t *testing.T) {
+
+	log.SetLogger("TestProveMembership", log.SILENT)
+
+	b, err := NewBalloon(bplus.NewBPlusTreeStorage(), sha256Hasher)
+	require.NoError(t, err)
+	addEvents(t, b, 10)
+
+	for version := uint64(0); version < 10; version++ {
+		for index := uint64(0); index <= version; index++ {
+			proof, err := b.ProveMembership(ctx, index, version)
+			require.NoError(t, err)
+			verified, err := proof.Verify(ctx, common.NewSha256Hasher())
+			require.NoError(t, err)
+			assert.True(t, verified, "The proof of %d in %d should verify", index, version)
+		}
+	}
+
+	_, err = b.ProveMembership(ctx, 5, 4)
+	assert.Equal(t, ErrInvalidRange, err, "The index cannot be after the version")
+	_, err = b.ProveMembership(ctx, 5, 10)
+	assert.Equal(t, ErrVersionNotFound, err, "The version should be committed")
+}
+
+func TestProveConsistency(t *testing.T) {
+
+	log.SetLogger("TestProveConsistency", log.SILENT)
+
+	b, err := NewBalloon(bplus.NewBPlusTreeStorage(), sha256Hasher)
+	require.NoError(t, err)
+	addEvents(t, b, 10)
+
+	for end := uint64(0); end < 10; end++ {
+		for start := uint64(0); start <= end; start++ {
+			proof, err := b.ProveConsistency(ctx, start, end)
+			require.NoError(t, err)
+			verified, err := proof.Verify(ctx, common.NewSha256Hasher())
+			require.NoError(t, err)
+			assert.True(t, verified, "The proof from %d to %d should verify", start, end)
+		}
+	}
+
+	_, err = b.ProveConsistency(ctx, 5, 4)
+	assert.Equal(t, ErrInvalidRange, err, "The start cannot be after the end")
+}
+
+func TestVerifyTamperedProofs(t *testing.T) {
+
+	log.SetLogger("TestVerifyTamperedProofs", log.SILENT)
+
+	b, err := NewBalloon(bplus.NewBPlusTreeStorage(), sha256Hasher)
+	require.NoError(t, err)
+	addEvents(t, b, 10)
+	hasher := common.NewSha256Hasher()
+
+	membership, err := b.Get(ctx, hasher.Do(event(3)))
+	require.NoError(t, err)
+	membership.Version = 4
+	verified, err := membership.Verify(ctx, hasher)
+	require.NoError(t, err)
+	assert.False(t, verified, "A proof with the wrong version should not verify")
+
+	history, err := b.ProveMembership(ctx, 3, 9)
+	require.NoError(t, err)
+	history.EventDigest = hasher.Do(event(4))
+	verified, err = history.Verify(ctx, hasher)
+	require.NoError(t, err)
+	assert.False(t, verified, "A proof with the wrong event should not verify")
+
+	// digests copied from honest proofs lead to the root of version 4
+	// without the event of a later index
+	forged := &HistoryProof{Index: 5, Version: 4, EventDigest: hasher.Do([]byte("forged")), AuditPath: common.AuditPath{}}
+	for _, index := range []uint64{3, 4} {
+		honest, err := b.ProveMembership(ctx, index, 4)
+		require.NoError(t, err)
+		forged.HistoryDigest = honest.HistoryDigest
+		for id, digest := range honest.AuditPath {
+			forged.AuditPath[id] = digest
+		}
+	}
+	verified, err = forged.Verify(ctx, hasher)
+	require.NoError(t, err)
+	assert.False(t, verified, "A proof of an index after the version should not verify")
+
+	consistency, err := b.ProveConsistency(ctx, 3, 9)
+	require.NoError(t, err)
+	consistency.AuditPath = common.AuditPath{}
+	verified, err = consistency.Verify(ctx, hasher)
+	require.NoError(t, err)
+	assert.False(t, verified, "A proof without audit path should not verify")
+}
@@ -0,0 +1,157 @@
+package balloon
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+
+	"github.com/aalda/trees/common"
+)
+
+// Every version gets a write-ahead log record under the VersionPrefix. It is
+// written as pending with the event digest before touching the trees and
+// rewritten as committed with the resulting root digests once both trees
+// have been persisted, so that an interrupted add can be replayed.
+
+type walState byte
+
+const (
+	walPending walState = iota
+	walCommitted
+)
+
+type walRecord struct {
+	state         walState
+	eventDigest   common.Digest
+	hyperDigest   common.Digest
+	historyDigest common.Digest
+}
+
+var ErrCorruptedLog = errors.New("corrupted write-ahead log")
+
+// versionKey encodes versions in big endian so that the records are sorted
+// by version in the store.
+func versionKey(version uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, version)
+	return key
+}
+
+// A record is laid out as the state byte followed by the event, hyper and
+// history digests, each one prefixed by its length in a single byte.
+func (r walRecord) encode() []byte {
+	digests := []common.Digest{r.eventDigest, r.hyperDigest, r.historyDigest}
+	b := make([]byte, 1, 4+len(r.eventDigest)+len(r.hyperDigest)+len(r.historyDigest))
+	b[0] = byte(r.state)
+	for _, d := range digests {
+		b = append(b, byte(len(d)))
+		b = append(b, d...)
+	}
+	return b
+}
+
+func decodeWalRecord(b []byte) (*walRecord, error) {
+	if len(b) == 0 || walState(b[0]) > walCommitted {
+		return nil, ErrCorruptedLog
+	}
+	record := &walRecord{state: walState(b[0])}
+	b = b[1:]
+	digests := make([]common.Digest, 3)
+	for i := range digests {
+		if len(b) == 0 || len(b) < 1+int(b[0]) {
+			return nil, ErrCorruptedLog
+		}
+		digests[i] = common.Digest(b[1 : 1+int(b[0])])
+		b = b[1+int(b[0]):]
+	}
+	if len(b) != 0 || len(digests[0]) == 0 {
+		return nil, ErrCorruptedLog
+	}
+	record.eventDigest, record.hyperDigest, record.historyDigest = digests[0], digests[1], digests[2]
+	return record, nil
+}
+
+func (r walRecord) commitment(version uint64) *Commitment {
+	return &Commitment{
+		EventDigest:   r.eventDigest,
+		HyperDigest:   r.hyperDigest,
+		HistoryDigest: r.historyDigest,
+		Version:       version,
+	}
+}
+
+// RecordedCommitment reads the commitment of a version from the write-ahead
+// log of the store without opening a balloon over it, so that it works on
+// stores whose trees are damaged. Versions without a committed record are
+// reported with ErrVersionNotFound.
+func RecordedCommitment(ctx context.Context, store common.Store, version uint64) (*Commitment, error) {
+	pair, err := store.Get(ctx, common.VersionPrefix, versionKey(version))
+	if err == common.ErrKeyNotFound {
+		return nil, ErrVersionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	record, err := decodeWalRecord(pair.Value)
+	if err != nil {
+		return nil, err
+	}
+	if record.state != walCommitted {
+		return nil, ErrVersionNotFound
+	}
+	return record.commitment(version), nil
+}
+
+func (b *Balloon) writeRecord(ctx context.Context, version uint64, record walRecord) error {
+	mutation := common.NewMutation(common.VersionPrefix, versionKey(version), record.encode())
+	return b.store.Mutate(ctx, []common.Mutation{*mutation})
+}
+
+func (b *Balloon) readRecord(ctx context.Context, version uint64) (*walRecord, error) {
+	pair, err := b.store.Get(ctx, common.VersionPrefix, versionKey(version))
+	if err != nil {
+		return nil, err
+	}
+	return decodeWalRecord(pair.Value)
+}
+
+// lastVersion finds the last version with a record. Versions are contiguous,
+// so it only needs a logarithmic number of lookups.
+func (b *Balloon) lastVersion(ctx context.Context) (uint64, bool, error) {
+	has := func(version uint64) (bool, error) {
+		return b.store.Has(ctx, common.VersionPrefix, versionKey(version))
+	}
+
+	ok, err := has(0)
+	if err != nil || !ok {
+		return 0, false, err
+	}
+
+	// look for a version without a record, doubling the distance each time
+	low, high := uint64(0), uint64(1)
+	for {
+		ok, err := has(high)
+		if err != nil {
+			return 0, false, err
+		}
+		if !ok {
+			break
+		}
+		low, high = high, high*2
+	}
+
+	// the last version is in [low, high)
+	for high-low > 1 {
+		mid := low + (high-low)/2
+		ok, err := has(mid)
+		if err != nil {
+			return 0, false, err
+		}
+		if ok {
+			low = mid
+		} else {
+			high = mid
+		}
+	}
+	return low, true, nil
+}
@@ -0,0 +1,77 @@
+package balloon
+
+import (
+	"context"
+)
+
+// watchBufferSize is how many commitments a watcher reads ahead of its
+// consumer.
+const watchBufferSize = 16
+
+// Watcher delivers the commitments of a balloon in version order on C, which
+// is closed once the context of the watch is done or reading a commitment
+// fails. Err tells which one happened after C is closed.
+//
+// The commitments are read from the write-ahead log, so a slow consumer only
+// delays its own watcher: Add never waits for the watchers, and the ones that
+// fall behind catch up from the store instead of buffering the commitments
+// in memory.
+type Watcher struct {
+	C   <-chan *Commitment
+	err error
+}
+
+func (w *Watcher) Err() error {
+	return w.err
+}
+
+// Watch returns a watcher delivering the commitments from fromVersion on,
+// replaying the ones already added before following the new ones. To resume
+// a watch, pass the version following the last commitment received.
+func (b *Balloon) Watch(ctx context.Context, fromVersion uint64) *Watcher {
+	out := make(chan *Commitment, watchBufferSize)
+	w := &Watcher{C: out}
+	go b.watch(ctx, fromVersion, out, w)
+	return w
+}
+
+func (b *Balloon) watch(ctx context.Context, next uint64, out chan<- *Commitment, w *Watcher) {
+	defer close(out)
+	for {
+		// taken before reading the version so that no commitment is missed
+		added := b.addedSignal()
+		for ; next < b.Version(); next++ {
+			commitment, err := b.Commitment(ctx, next)
+			if err != nil {
+				w.err = err
+				return
+			}
+			select {
+			case out <- commitment:
+			case <-ctx.Done():
+				w.err = ctx.Err()
+				return
+			}
+		}
+		select {
+		case <-added:
+		case <-ctx.Done():
+			w.err = ctx.Err()
+			return
+		}
+	}
+}
+
+// notifyAdded wakes up the watchers waiting for a new version.
+func (b *Balloon) notifyAdded() {
+	b.addedLock.Lock()
+	defer b.addedLock.Unlock()
+	close(b.added)
+	b.added = make(chan struct{})
+}
+
+func (b *Balloon) addedSignal() <-chan struct{} {
+	b.addedLock.Lock()
+	defer b.addedLock.Unlock()
+	return b.added
+}
@@ -0,0 +1,117 @@
+package balloon
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aalda/trees/log"
+	"github.com/aalda/trees/storage/bplus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// receive reads the next commitment of the watcher, failing after a while.
+func receive(t *testing.T, w *Watcher) *Commitment {
+	select {
+	case commitment, ok := <-w.C:
+		require.True(t, ok, "The watcher should not be closed: %v", w.Err())
+		return commitment
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "Timed out waiting for a commitment")
+		return nil
+	}
+}
+
+func TestWatch(t *testing.T) {
+
+	log.SetLogger("TestWatch", log.SILENT)
+
+	b, err := NewBalloon(bplus.NewBPlusTreeStorage(), sha256Hasher)
+	require.NoError(t, err)
+	expected := make([]*Commitment, 10)
+	for i := uint64(0); i < 5; i++ {
+		expected[i], err = b.Add(ctx, event(i))
+		require.NoError(t, err)
+	}
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := b.Watch(watchCtx, 2)
+
+	// the missed commitments are replayed
+	for i := uint64(2); i < 5; i++ {
+		assert.Equal(t, expected[i], receive(t, w), "Incorrect replayed commitment %d", i)
+	}
+
+	// and the new ones followed
+	for i := uint64(5); i < 10; i++ {
+		expected[i], err = b.Add(ctx, event(i))
+		require.NoError(t, err)
+		assert.Equal(t, expected[i], receive(t, w), "Incorrect followed commitment %d", i)
+	}
+
+	cancel()
+	for range w.C {
+	}
+	assert.Equal(t, context.Canceled, w.Err(), "The watcher should stop with its context")
+}
+
+func TestWatchSlowConsumer(t *testing.T) {
+
+	log.SetLogger("TestWatchSlowConsumer", log.SILENT)
+
+	b, err := NewBalloon(bplus.NewBPlusTreeStorage(), sha256Hasher)
+	require.NoError(t, err)
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := b.Watch(watchCtx, 0)
+
+	// adding does not wait for the watcher, which keeps at most its buffer
+	// ahead of its consumer
+	const events = 10 * watchBufferSize
+	expected := make([]*Commitment, events)
+	for i := uint64(0); i < events; i++ {
+		expected[i], err = b.Add(ctx, event(i))
+		require.NoError(t, err)
+	}
+	assert.True(t, len(w.C) <= watchBufferSize, "The watcher should not buffer more than %d commitments", watchBufferSize)
+
+	for i := uint64(0); i < events; i++ {
+		assert.Equal(t, expected[i], receive(t, w), "Incorrect commitment %d", i)
+	}
+}
+
+func TestWatchResume(t *testing.T) {
+
+	log.SetLogger("TestWatchResume", log.SILENT)
+
+	store := bplus.NewBPlusTreeStorage()
+	b, err := NewBalloon(store, sha256Hasher)
+	require.NoError(t, err)
+	expected := make([]*Commitment, 10)
+	for i := uint64(0); i < 10; i++ {
+		expected[i], err = b.Add(ctx, event(i))
+		require.NoError(t, err)
+	}
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	w := b.Watch(watchCtx, 0)
+	var last *Commitment
+	for i := 0; i < 4; i++ {
+		last = receive(t, w)
+	}
+	cancel()
+
+	// a reopened balloon replays from the store the versions after the last
+	// one received
+	b, err = NewBalloon(store, sha256Hasher)
+	require.NoError(t, err)
+	watchCtx, cancel = context.WithCancel(ctx)
+	defer cancel()
+	w = b.Watch(watchCtx, last.Version+1)
+	for i := last.Version + 1; i < 10; i++ {
+		assert.Equal(t, expected[i], receive(t, w), "Incorrect resumed commitment %d", i)
+	}
+}
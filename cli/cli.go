@@ -0,0 +1,531 @@
+// Package cli implements the trees command, which keeps a balloon in a Badger
+// or bbolt directory and writes and verifies its proofs in the format of the
+// protocol package.
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/aalda/trees/balloon"
+	"github.com/aalda/trees/common"
+	"github.com/aalda/trees/protocol"
+	"github.com/aalda/trees/rebuild"
+	"github.com/aalda/trees/storage/badger"
+	"github.com/aalda/trees/storage/bolt"
+)
+
+const usage = `Usage: trees <command> [flags] [arguments]
+
+Flags go before the arguments of the command.
+
+Commands:
+  init --dir DIR [--backend badger|bolt] [--hasher sha256|xor]
+        create an empty balloon in DIR
+  add --dir DIR <digest>
+        add an event digest and print the commitment of its version
+  get --dir DIR [--out FILE] <digest>
+        write the membership proof of an event digest as of the last version
+  prove-membership --dir DIR [--out FILE] <index> <version>
+        write the proof that the event added with index is part of version
+  prove-consistency --dir DIR [--out FILE] <start> <end>
+        write the proof that version end extends version start
+  root --dir DIR [--version N]
+        print the commitment of a version, the last one by default
+  verify --root DIGEST <FILE|->
+        verify a proof file, or the standard input, without any store, against
+        the trusted root: the hyper digest for membership proofs and the
+        history digest of the last version for the others.
+  rebuild --dir DIR [--digests FILE] <target>
+        rebuild the trees of the balloon in DIR into the new directory target
+        from the event digests of its index, or of FILE with one digest per
+        line, and print the last commitment. It fails at the end if a version
+        does not match the roots recorded in DIR, or if the digests end before
+        the versions recorded in DIR.
+
+Digests are hexadecimal. The exit code is 0 on success, 1 when the command
+fails or the proof is invalid and 2 on usage errors.
+`
+
+const (
+	configFile = "trees.json"
+	badgerDir  = "store"
+	boltFile   = "store.db"
+)
+
+var (
+	errInvalidProof = errors.New("invalid proof")
+	errRootMismatch = errors.New("the proof does not match the trusted root")
+)
+
+// usageError is reported with the usage and exit code 2.
+type usageError struct {
+	msg string
+}
+
+func (e usageError) Error() string {
+	return e.msg
+}
+
+func usagef(format string, v ...interface{}) error {
+	return usageError{fmt.Sprintf(format, v...)}
+}
+
+type command func(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer) error
+
+var commands = map[string]command{
+	"init":              runInit,
+	"add":               runAdd,
+	"get":               runGet,
+	"prove-membership":  runProveMembership,
+	"prove-consistency": runProveConsistency,
+	"root":              runRoot,
+	"verify":            runVerify,
+	"rebuild":           runRebuild,
+}
+
+// Main runs the command given by the arguments, without the program name,
+// and returns the exit code.
+func Main(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		fmt.Fprint(stdout, usage)
+		return 0
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "trees: unknown command %q\n\n%s", args[0], usage)
+		return 2
+	}
+
+	err := cmd(context.Background(), args[1:], stdin, stdout)
+	switch err.(type) {
+	case nil:
+		return 0
+	case usageError:
+		fmt.Fprintf(stderr, "trees %s: %v\n\n%s", args[0], err, usage)
+		return 2
+	default:
+		fmt.Fprintf(stderr, "trees %s: %v\n", args[0], err)
+		return 1
+	}
+}
+
+// newFlagSet returns a flag set whose errors are reported by Main.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	return fs
+}
+
+func parse(fs *flag.FlagSet, args []string, nargs int) error {
+	if err := fs.Parse(args); err != nil {
+		return usageError{err.Error()}
+	}
+	if fs.NArg() != nargs {
+		return usagef("expected %d arguments, got %d", nargs, fs.NArg())
+	}
+	return nil
+}
+
+func parseUint(name, value string) (uint64, error) {
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, usagef("invalid %s %q", name, value)
+	}
+	return n, nil
+}
+
+// config is kept in the directory by init, so that the other commands open
+// the store with the same backend and hasher.
+type config struct {
+	Backend string `json:"backend"`
+	Hasher  string `json:"hasher"`
+}
+
+func openStore(dir, backend string) (common.Store, error) {
+	switch backend {
+	case "badger":
+		opts := badger.DefaultOptions()
+		opts.GCInterval = 0
+		return badger.NewBadgerStoreWithOptions(filepath.Join(dir, badgerDir), opts)
+	case "bolt":
+		return bolt.NewBoltStore(filepath.Join(dir, boltFile))
+	}
+	return nil, fmt.Errorf("unknown backend %q", backend)
+}
+
+func readConfig(dir string) (*config, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, configFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = fmt.Errorf("%s is not a trees directory, run init first", dir)
+		}
+		return nil, err
+	}
+	var c config
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", configFile, err)
+	}
+	return &c, nil
+}
+
+// writeConfig creates the directory with its configuration, unless it
+// already has one.
+func writeConfig(dir string, c config) error {
+	path := filepath.Join(dir, configFile)
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// openBalloon opens the balloon created by init in the directory. The
+// returned function closes its store.
+func openBalloon(dir string) (*balloon.Balloon, string, func() error, error) {
+	c, err := readConfig(dir)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	hasherF, err := protocol.Hasher(c.Hasher)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	store, err := openStore(dir, c.Backend)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	b, err := balloon.NewBalloon(store, hasherF)
+	if err != nil {
+		store.Close()
+		return nil, "", nil, err
+	}
+	return b, c.Hasher, store.Close, nil
+}
+
+// withBalloon runs f over the balloon in the directory and closes it.
+func withBalloon(dir string, f func(b *balloon.Balloon, hasher string) error) (err error) {
+	b, hasher, closeStore, err := openBalloon(dir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := closeStore(); err == nil {
+			err = closeErr
+		}
+	}()
+	return f(b, hasher)
+}
+
+// output writes to the file, or to stdout when it is empty.
+func output(path string, stdout io.Writer, v interface{}) error {
+	if path == "" {
+		return protocol.Write(stdout, v)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := protocol.Write(f, v); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func writeProof(path string, stdout io.Writer, hasher string, proof interface{}) error {
+	envelope, err := protocol.NewEnvelope(hasher, proof)
+	if err != nil {
+		return err
+	}
+	return output(path, stdout, envelope)
+}
+
+func runInit(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := newFlagSet("init")
+	dir := fs.String("dir", ".", "directory of the balloon")
+	backend := fs.String("backend", "badger", "storage backend, badger or bolt")
+	hasher := fs.String("hasher", "sha256", "hasher of the trees, sha256 or xor")
+	if err := parse(fs, args, 0); err != nil {
+		return err
+	}
+	if *backend != "badger" && *backend != "bolt" {
+		return usagef("unknown backend %q", *backend)
+	}
+	if _, err := protocol.Hasher(*hasher); err != nil {
+		return usageError{err.Error()}
+	}
+
+	if err := writeConfig(*dir, config{*backend, *hasher}); err != nil {
+		return err
+	}
+	return withBalloon(*dir, func(*balloon.Balloon, string) error { return nil })
+}
+
+func runAdd(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := newFlagSet("add")
+	dir := fs.String("dir", ".", "directory of the balloon")
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+	return withBalloon(*dir, func(b *balloon.Balloon, hasher string) error {
+		digest, err := parseDigest(fs.Arg(0), hasher)
+		if err != nil {
+			return err
+		}
+		commitment, err := b.AddDigest(ctx, digest)
+		if err != nil {
+			return err
+		}
+		return protocol.Write(stdout, protocol.NewCommitment(commitment))
+	})
+}
+
+func parseDigest(s, hasher string) (common.Digest, error) {
+	hasherF, err := protocol.Hasher(hasher)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := protocol.ParseDigest(s, hasherF())
+	if err != nil {
+		return nil, usageError{err.Error()}
+	}
+	return digest, nil
+}
+
+func runGet(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := newFlagSet("get")
+	dir := fs.String("dir", ".", "directory of the balloon")
+	out := fs.String("out", "", "file to write the proof to, stdout by default")
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+	return withBalloon(*dir, func(b *balloon.Balloon, hasher string) error {
+		digest, err := parseDigest(fs.Arg(0), hasher)
+		if err != nil {
+			return err
+		}
+		proof, err := b.Get(ctx, digest)
+		if err == common.ErrKeyNotFound {
+			return errors.New("event not found")
+		}
+		if err != nil {
+			return err
+		}
+		return writeProof(*out, stdout, hasher, protocol.NewMembershipProof(proof))
+	})
+}
+
+func runProveMembership(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := newFlagSet("prove-membership")
+	dir := fs.String("dir", ".", "directory of the balloon")
+	out := fs.String("out", "", "file to write the proof to, stdout by default")
+	if err := parse(fs, args, 2); err != nil {
+		return err
+	}
+	index, err := parseUint("index", fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	version, err := parseUint("version", fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	return withBalloon(*dir, func(b *balloon.Balloon, hasher string) error {
+		proof, err := b.ProveMembership(ctx, index, version)
+		if err != nil {
+			return err
+		}
+		return writeProof(*out, stdout, hasher, protocol.NewHistoryProof(proof))
+	})
+}
+
+func runProveConsistency(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := newFlagSet("prove-consistency")
+	dir := fs.String("dir", ".", "directory of the balloon")
+	out := fs.String("out", "", "file to write the proof to, stdout by default")
+	if err := parse(fs, args, 2); err != nil {
+		return err
+	}
+	start, err := parseUint("start", fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	end, err := parseUint("end", fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	return withBalloon(*dir, func(b *balloon.Balloon, hasher string) error {
+		proof, err := b.ProveConsistency(ctx, start, end)
+		if err != nil {
+			return err
+		}
+		return writeProof(*out, stdout, hasher, protocol.NewConsistencyProof(proof))
+	})
+}
+
+func runRoot(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := newFlagSet("root")
+	dir := fs.String("dir", ".", "directory of the balloon")
+	version := fs.String("version", "", "version to print, the last one by default")
+	if err := parse(fs, args, 0); err != nil {
+		return err
+	}
+	var requested uint64
+	if *version != "" {
+		var err error
+		if requested, err = parseUint("version", *version); err != nil {
+			return err
+		}
+	}
+	return withBalloon(*dir, func(b *balloon.Balloon, hasher string) error {
+		v := requested
+		if *version == "" {
+			if b.Version() == 0 {
+				return errors.New("the balloon is empty")
+			}
+			v = b.Version() - 1
+		}
+		commitment, err := b.Commitment(ctx, v)
+		if err != nil {
+			return err
+		}
+		return protocol.Write(stdout, protocol.NewCommitment(commitment))
+	})
+}
+
+func runVerify(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := newFlagSet("verify")
+	root := fs.String("root", "", "trusted digest the proof must be verified against")
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+	// anyone can build a proof that verifies against the digests it carries,
+	// so it only proves something against a root obtained elsewhere
+	if *root == "" {
+		return usagef("the trusted root is required")
+	}
+	trusted, err := hex.DecodeString(*root)
+	if err != nil {
+		return usagef("invalid root %q", *root)
+	}
+
+	in := stdin
+	if path := fs.Arg(0); path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	envelope, err := protocol.ReadEnvelope(in)
+	if err != nil {
+		return fmt.Errorf("invalid proof file: %v", err)
+	}
+
+	if !bytes.Equal(trusted, envelope.Root()) {
+		return errRootMismatch
+	}
+	if proof, ok := envelope.Proof.(*protocol.HistoryProof); ok && proof.Index > proof.Version {
+		return errInvalidProof
+	}
+	ok, err := envelope.Verify(ctx)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errInvalidProof
+	}
+	fmt.Fprintf(stdout, "valid %s proof\n", envelope.Kind)
+	return nil
+}
+
+// runRebuild reads the store in the directory without opening a balloon over
+// it, since its trees may be damaged.
+func runRebuild(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer) (err error) {
+	fs := newFlagSet("rebuild")
+	dir := fs.String("dir", ".", "directory of the balloon")
+	digests := fs.String("digests", "", "file with the event digests, the index of the balloon by default")
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+	c, err := readConfig(*dir)
+	if err != nil {
+		return err
+	}
+	hasherF, err := protocol.Hasher(c.Hasher)
+	if err != nil {
+		return err
+	}
+	store, err := openStore(*dir, c.Backend)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	var source rebuild.Source
+	if *digests != "" {
+		f, err := os.Open(*digests)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		source = rebuild.FromReader(f, hasherF)
+	} else if source, err = rebuild.FromIndex(ctx, store); err != nil {
+		return err
+	}
+
+	target := fs.Arg(0)
+	if err := writeConfig(target, *c); err != nil {
+		return err
+	}
+	targetStore, err := openStore(target, c.Backend)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := targetStore.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	result, err := rebuild.Rebuild(ctx, source, targetStore, hasherF, rebuild.Recorded(store))
+	if err != nil {
+		return err
+	}
+	if result.Last != nil {
+		if err := protocol.Write(stdout, protocol.NewCommitment(result.Last)); err != nil {
+			return err
+		}
+	}
+	if m := result.Mismatch; m != nil && m.Rebuilt == nil {
+		return fmt.Errorf("the digests end before version %d, recorded with hyper digest %x and history digest %x",
+			m.Version, m.Expected.HyperDigest, m.Expected.HistoryDigest)
+	}
+	if m := result.Mismatch; m != nil {
+		return fmt.Errorf("version %d does not match the recorded roots: hyper digest %x, expected %x; history digest %x, expected %x",
+			m.Version, m.Rebuilt.HyperDigest, m.Expected.HyperDigest, m.Rebuilt.HistoryDigest, m.Expected.HistoryDigest)
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package cli
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aalda/trees/log"
+	"github.com/aalda/trees/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// run executes the command and returns its exit code and outputs.
+func run(stdin string, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := Main(args, strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func digest(i int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("event %d", i)))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestEndToEnd(t *testing.T) {
+
+	log.SetLogger("TestEndToEnd", log.SILENT)
+
+	for _, backend := range []string{"badger", "bolt"} {
+		t.Run(backend, func(t *testing.T) {
+			dir := t.TempDir()
+
+			code, _, stderr := run("", "init", "--dir", dir, "--backend", backend)
+			require.Equal(t, 0, code, stderr)
+			code, _, _ = run("", "init", "--dir", dir, "--backend", backend)
+			assert.Equal(t, 1, code, "The directory should not be initialized twice")
+
+			var last protocol.Commitment
+			for i := 0; i < 10; i++ {
+				code, stdout, stderr := run("", "add", "--dir", dir, digest(i))
+				require.Equal(t, 0, code, stderr)
+				require.NoError(t, json.Unmarshal([]byte(stdout), &last))
+				assert.Equal(t, uint64(i), last.Version, "Incorrect version")
+			}
+
+			code, stdout, stderr := run("", "root", "--dir", dir)
+			require.Equal(t, 0, code, stderr)
+			var root protocol.Commitment
+			require.NoError(t, json.Unmarshal([]byte(stdout), &root))
+			assert.Equal(t, last, root, "Incorrect last commitment")
+
+			code, stdout, stderr = run("", "root", "--dir", dir, "--version", "3")
+			require.Equal(t, 0, code, stderr)
+			require.NoError(t, json.Unmarshal([]byte(stdout), &root))
+			assert.Equal(t, uint64(3), root.Version, "Incorrect version")
+
+			proofs := []struct {
+				name string
+				args []string
+				root protocol.Hex
+			}{
+				{"membership.json", []string{"get", "--dir", dir, "--out", filepath.Join(dir, "membership.json"), digest(3)}, last.HyperDigest},
+				{"history.json", []string{"prove-membership", "--dir", dir, "--out", filepath.Join(dir, "history.json"), "3", "9"}, last.HistoryDigest},
+				{"consistency.json", []string{"prove-consistency", "--dir", dir, "--out", filepath.Join(dir, "consistency.json"), "3", "9"}, last.HistoryDigest},
+			}
+			for _, proof := range proofs {
+				code, _, stderr := run("", proof.args...)
+				require.Equal(t, 0, code, stderr)
+
+				path := filepath.Join(dir, proof.name)
+				code, stdout, stderr := run("", "verify", "--root", hex.EncodeToString(proof.root), path)
+				assert.Equal(t, 0, code, "The proof in %s should verify: %s", proof.name, stderr)
+				assert.Contains(t, stdout, "valid", "Incorrect output")
+			}
+
+			code, _, _ = run("", "verify", "--root", hex.EncodeToString(last.HyperDigest), filepath.Join(dir, "consistency.json"))
+			assert.Equal(t, 1, code, "The proof should not match another root")
+
+			code, _, _ = run("", "get", "--dir", dir, digest(10))
+			assert.Equal(t, 1, code, "A missing event should fail")
+		})
+	}
+}
+
+func TestVerifyTamperedProof(t *testing.T) {
+
+	log.SetLogger("TestVerifyTamperedProof", log.SILENT)
+
+	dir := t.TempDir()
+	code, _, stderr := run("", "init", "--dir", dir, "--backend", "bolt")
+	require.Equal(t, 0, code, stderr)
+	for i := 0; i < 5; i++ {
+		code, _, stderr := run("", "add", "--dir", dir, digest(i))
+		require.Equal(t, 0, code, stderr)
+	}
+
+	code, stdout, stderr := run("", "root", "--dir", dir)
+	require.Equal(t, 0, code, stderr)
+	var root protocol.Commitment
+	require.NoError(t, json.Unmarshal([]byte(stdout), &root))
+	trusted := hex.EncodeToString(root.HistoryDigest)
+
+	code, stdout, stderr = run("", "prove-membership", "--dir", dir, "2", "4")
+	require.Equal(t, 0, code, stderr)
+	code, _, stderr = run(stdout, "verify", "--root", trusted, "-")
+	require.Equal(t, 0, code, stderr)
+
+	tampered := strings.Replace(stdout, digest(2), digest(3), 1)
+	require.NotEqual(t, stdout, tampered)
+	code, _, stderr = run(tampered, "verify", "--root", trusted, "-")
+	assert.Equal(t, 1, code, "A tampered proof should not verify")
+	assert.Contains(t, stderr, "invalid proof", "Incorrect error")
+
+	// a proof of an index after the version, made of digests copied from
+	// honest proofs, leads to the root without the event
+	var forged *protocol.Envelope
+	for _, index := range []string{"3", "4"} {
+		code, stdout, stderr := run("", "prove-membership", "--dir", dir, index, "4")
+		require.Equal(t, 0, code, stderr)
+		envelope, err := protocol.ReadEnvelope(strings.NewReader(stdout))
+		require.NoError(t, err)
+		if forged == nil {
+			forged = envelope
+			continue
+		}
+		for id, digest := range envelope.Proof.(*protocol.HistoryProof).AuditPath {
+			forged.Proof.(*protocol.HistoryProof).AuditPath[id] = digest
+		}
+	}
+	forged.Proof.(*protocol.HistoryProof).Index = 5
+	var buf bytes.Buffer
+	require.NoError(t, protocol.Write(&buf, forged))
+	code, _, stderr = run(buf.String(), "verify", "--root", trusted, "-")
+	assert.Equal(t, 1, code, "A proof of an index after the version should not verify")
+	assert.Contains(t, stderr, "invalid proof", "Incorrect error")
+
+	path := filepath.Join(dir, "truncated.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(stdout[:len(stdout)/2]), 0600))
+	code, _, _ = run("", "verify", "--root", trusted, path)
+	assert.Equal(t, 1, code, "A truncated proof should not verify")
+}
+
+func TestRebuild(t *testing.T) {
+
+	log.SetLogger("TestRebuild", log.SILENT)
+
+	dir := t.TempDir()
+	code, _, stderr := run("", "init", "--dir", dir, "--backend", "bolt")
+	require.Equal(t, 0, code, stderr)
+	var last protocol.Commitment
+	for i := 0; i < 10; i++ {
+		code, stdout, stderr := run("", "add", "--dir", dir, digest(i))
+		require.Equal(t, 0, code, stderr)
+		require.NoError(t, json.Unmarshal([]byte(stdout), &last))
+	}
+
+	target := filepath.Join(t.TempDir(), "rebuilt")
+	code, stdout, stderr := run("", "rebuild", "--dir", dir, target)
+	require.Equal(t, 0, code, stderr)
+	var rebuilt protocol.Commitment
+	require.NoError(t, json.Unmarshal([]byte(stdout), &rebuilt))
+	assert.Equal(t, last, rebuilt, "Incorrect rebuilt commitment")
+
+	code, _, _ = run("", "rebuild", "--dir", dir, target)
+	assert.Equal(t, 1, code, "The target should be a new directory")
+
+	code, stdout, stderr = run("", "root", "--dir", target)
+	require.Equal(t, 0, code, stderr)
+	require.NoError(t, json.Unmarshal([]byte(stdout), &rebuilt))
+	assert.Equal(t, last, rebuilt, "The rebuilt balloon should serve the last commitment")
+
+	var lines []string
+	for i := 0; i < 10; i++ {
+		lines = append(lines, digest(i))
+	}
+	lines[4] = digest(100)
+	digests := filepath.Join(dir, "digests.txt")
+	require.NoError(t, ioutil.WriteFile(digests, []byte(strings.Join(lines, "\n")), 0600))
+	code, _, stderr = run("", "rebuild", "--dir", dir, "--digests", digests, filepath.Join(t.TempDir(), "forged"))
+	assert.Equal(t, 1, code, "A forged digest should not match")
+	assert.Contains(t, stderr, "version 4 does not match", "Incorrect error")
+
+	require.NoError(t, ioutil.WriteFile(digests, []byte(strings.Join(lines[:4], "\n")), 0600))
+	code, _, stderr = run("", "rebuild", "--dir", dir, "--digests", digests, filepath.Join(t.TempDir(), "truncated"))
+	assert.Equal(t, 1, code, "Truncated digests should not match")
+	assert.Contains(t, stderr, "end before version 4", "Incorrect error")
+}
+
+func TestUsage(t *testing.T) {
+
+	testCases := [][]string{
+		{},
+		{"unknown"},
+		{"init", "--backend", "leveldb"},
+		{"init", "--hasher", "md5"},
+		{"add", "--dir", "."},
+		{"prove-membership", "--dir", ".", "one", "2"},
+		{"root", "--dir", ".", "--version", "-1"},
+		{"verify", "--root", "zz", "-"},
+		{"verify", "-"},
+		{"rebuild", "--dir", "."},
+	}
+
+	for i, args := range testCases {
+		code, _, _ := run("", args...)
+		assert.Equal(t, 2, code, "Incorrect exit code in test case %d", i)
+	}
+
+	dir := t.TempDir()
+	code, _, _ := run("", "init", "--dir", dir, "--hasher", "xor", "--backend", "bolt")
+	require.Equal(t, 0, code)
+	code, _, _ = run("", "add", "--dir", dir, digest(0))
+	assert.Equal(t, 2, code, "A digest of another hasher should be rejected")
+	code, _, _ = run("", "add", "--dir", dir, "0a")
+	assert.Equal(t, 0, code, "A digest of the hasher should be accepted")
+}
@@ -0,0 +1,415 @@
+// Package client calls the HTTP API of the api package without trusting the
+// server: every proof is verified locally and every commitment is checked to
+// extend the last one the client trusted, its head.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aalda/trees/balloon"
+	"github.com/aalda/trees/common"
+	"github.com/aalda/trees/protocol"
+)
+
+var (
+	// ErrVerificationFailed is returned when a response does not verify
+	// against the trusted head, which is then left as it was.
+	ErrVerificationFailed = errors.New("verification failed")
+	// ErrStaleProof is returned for membership proofs against a version
+	// older than the trusted head, whose hyper digest cannot be checked.
+	ErrStaleProof = errors.New("the proof is older than the trusted head")
+)
+
+// Error is a failure reported by the server.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("server error %d: %s", e.StatusCode, e.Message)
+}
+
+// Client is safe for concurrent use. The hasher is the name of the hasher of
+// the server in the protocol package.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	hasher     string
+	hasherF    func() common.Hasher
+
+	lock sync.Mutex
+	head *balloon.Commitment
+}
+
+// New returns a client for the API served at the base URL. A nil HTTP client
+// uses http.DefaultClient.
+func New(baseURL string, httpClient *http.Client, hasher string) (*Client, error) {
+	hasherF, err := protocol.Hasher(hasher)
+	if err != nil {
+		return nil, err
+	}
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: httpClient,
+		hasher:     hasher,
+		hasherF:    hasherF,
+	}, nil
+}
+
+// SetHead makes the client trust the commitment, usually kept from a previous
+// session or obtained out of band. Without a head, the client trusts the
+// first commitment it gets.
+func (c *Client) SetHead(head *balloon.Commitment) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.head = head
+}
+
+// Head returns the last trusted commitment, or nil.
+func (c *Client) Head() *balloon.Commitment {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.head
+}
+
+// Add adds the event and checks that the returned commitment extends the
+// head and holds the event at its version, before making it the new head.
+func (c *Client) Add(ctx context.Context, event []byte) (*balloon.Commitment, error) {
+	return c.add(ctx, protocol.AddRequest{Event: event}, c.hasherF().Do(event))
+}
+
+// AddDigest is Add for an event already hashed with the hasher of the client.
+func (c *Client) AddDigest(ctx context.Context, eventDigest common.Digest) (*balloon.Commitment, error) {
+	return c.add(ctx, protocol.AddRequest{Digest: protocol.Hex(eventDigest)}, eventDigest)
+}
+
+func (c *Client) add(ctx context.Context, request protocol.AddRequest, eventDigest common.Digest) (*balloon.Commitment, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	var response protocol.Commitment
+	if err := c.do(ctx, http.MethodPost, "/events", bytes.NewReader(body), &response); err != nil {
+		return nil, err
+	}
+	commitment := response.Decode()
+	if !bytes.Equal(commitment.EventDigest, eventDigest) {
+		return nil, fmt.Errorf("%w: the commitment is for another event", ErrVerificationFailed)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	// the event must be in the commitment before it can become the head
+	proof, err := c.proveMembership(ctx, commitment.Version, commitment.Version, eventDigest)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(proof.HistoryDigest, commitment.HistoryDigest) {
+		return nil, fmt.Errorf("%w: the commitment does not hold the event", ErrVerificationFailed)
+	}
+	if err := c.trust(ctx, commitment); err != nil {
+		return nil, err
+	}
+	return commitment, nil
+}
+
+// UpdateHead fetches the last commitment and makes it the new head once it
+// is proven to extend the current one.
+func (c *Client) UpdateHead(ctx context.Context) (*balloon.Commitment, error) {
+	var response protocol.Commitment
+	if err := c.do(ctx, http.MethodGet, "/root", nil, &response); err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	commitment := response.Decode()
+	if err := c.trust(ctx, commitment); err != nil {
+		return nil, err
+	}
+	return c.head, nil
+}
+
+// Commitment returns the commitment of the version, whose history digest is
+// verified against the head.
+func (c *Client) Commitment(ctx context.Context, version uint64) (*balloon.Commitment, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.commitment(ctx, version)
+}
+
+// Get returns the membership proof of the event digest once verified. The
+// proof must be against the head or a later version, which becomes the head.
+//
+// Only the history digest of a commitment is proven to extend the head: the
+// hyper digest of a later version is taken as the server reports it, as
+// nothing binds it to the trusted history. A server may then make the client
+// adopt a forged hyper digest along with a genuine history.
+func (c *Client) Get(ctx context.Context, eventDigest common.Digest) (*balloon.MembershipProof, error) {
+	var envelope protocol.Envelope
+	path := "/events/" + hex.EncodeToString(eventDigest) + "/proof"
+	if err := c.do(ctx, http.MethodGet, path, nil, &envelope); err != nil {
+		var serverErr *Error
+		if errors.As(err, &serverErr) && serverErr.StatusCode == http.StatusNotFound {
+			return nil, common.ErrKeyNotFound
+		}
+		return nil, err
+	}
+	encoded, ok := envelope.Proof.(*protocol.MembershipProof)
+	if err := c.checkEnvelope(&envelope, ok); err != nil {
+		return nil, err
+	}
+	proof := encoded.Decode()
+	if !bytes.Equal(proof.EventDigest, eventDigest) {
+		return nil, fmt.Errorf("%w: the proof is for another event", ErrVerificationFailed)
+	}
+
+	verified, err := proof.Verify(ctx, c.hasherF())
+	if err != nil {
+		return nil, err
+	}
+	if !verified {
+		return nil, fmt.Errorf("%w: invalid membership proof", ErrVerificationFailed)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.head != nil && proof.CurrentVersion < c.head.Version {
+		return nil, ErrStaleProof
+	}
+	committed, err := c.fetchCommitment(ctx, proof.CurrentVersion)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(proof.HyperDigest, committed.HyperDigest) {
+		return nil, fmt.Errorf("%w: the proof is not against the committed hyper digest", ErrVerificationFailed)
+	}
+	if err := c.trust(ctx, committed); err != nil {
+		return nil, err
+	}
+	return proof, nil
+}
+
+// ProveMembership returns the proof that the event added with the index is
+// part of the version, once verified against the head.
+func (c *Client) ProveMembership(ctx context.Context, index, version uint64) (*balloon.HistoryProof, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	proof, err := c.proveMembership(ctx, index, version, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkHistoryDigest(ctx, version, proof.HistoryDigest); err != nil {
+		return nil, err
+	}
+	return proof, nil
+}
+
+// proveMembership fetches and verifies a membership proof, checking its event
+// digest too when it is given. The history digest it carries is left to be
+// checked by the caller.
+func (c *Client) proveMembership(ctx context.Context, index, version uint64, eventDigest common.Digest) (*balloon.HistoryProof, error) {
+	if index > version {
+		return nil, balloon.ErrInvalidRange
+	}
+	var envelope protocol.Envelope
+	path := fmt.Sprintf("/history/%d/proof?version=%d", index, version)
+	if err := c.do(ctx, http.MethodGet, path, nil, &envelope); err != nil {
+		return nil, err
+	}
+	encoded, ok := envelope.Proof.(*protocol.HistoryProof)
+	if err := c.checkEnvelope(&envelope, ok); err != nil {
+		return nil, err
+	}
+	proof := encoded.Decode()
+	if proof.Index != index || proof.Version != version {
+		return nil, fmt.Errorf("%w: the proof is for other versions", ErrVerificationFailed)
+	}
+	if eventDigest != nil && !bytes.Equal(proof.EventDigest, eventDigest) {
+		return nil, fmt.Errorf("%w: the proof is for another event", ErrVerificationFailed)
+	}
+	verified, err := proof.Verify(ctx, c.hasherF())
+	if err != nil {
+		return nil, err
+	}
+	if !verified {
+		return nil, fmt.Errorf("%w: invalid membership proof", ErrVerificationFailed)
+	}
+	return proof, nil
+}
+
+// ProveConsistency returns the proof that the version end extends the
+// version start, once verified against the head.
+func (c *Client) ProveConsistency(ctx context.Context, start, end uint64) (*balloon.ConsistencyProof, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	proof, err := c.proveConsistency(ctx, start, end)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkHistoryDigest(ctx, start, proof.StartDigest); err != nil {
+		return nil, err
+	}
+	if err := c.checkHistoryDigest(ctx, end, proof.EndDigest); err != nil {
+		return nil, err
+	}
+	return proof, nil
+}
+
+// proveConsistency fetches and verifies a consistency proof, leaving the
+// digests it carries to be checked by the caller.
+func (c *Client) proveConsistency(ctx context.Context, start, end uint64) (*balloon.ConsistencyProof, error) {
+	var envelope protocol.Envelope
+	path := fmt.Sprintf("/consistency?start=%d&end=%d", start, end)
+	if err := c.do(ctx, http.MethodGet, path, nil, &envelope); err != nil {
+		return nil, err
+	}
+	encoded, ok := envelope.Proof.(*protocol.ConsistencyProof)
+	if err := c.checkEnvelope(&envelope, ok); err != nil {
+		return nil, err
+	}
+	proof := encoded.Decode()
+	if proof.Start != start || proof.End != end {
+		return nil, fmt.Errorf("%w: the proof is for other versions", ErrVerificationFailed)
+	}
+	verified, err := proof.Verify(ctx, c.hasherF())
+	if err != nil {
+		return nil, err
+	}
+	if !verified {
+		return nil, fmt.Errorf("%w: invalid consistency proof", ErrVerificationFailed)
+	}
+	return proof, nil
+}
+
+// trust makes the commitment the head if it extends the current one. Older
+// commitments must be consistent with the head, which is kept.
+func (c *Client) trust(ctx context.Context, commitment *balloon.Commitment) error {
+	if c.head == nil {
+		c.head = commitment
+		return nil
+	}
+	if commitment.Version <= c.head.Version {
+		return c.checkHistoryDigest(ctx, commitment.Version, commitment.HistoryDigest)
+	}
+	proof, err := c.proveConsistency(ctx, c.head.Version, commitment.Version)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(proof.StartDigest, c.head.HistoryDigest) || !bytes.Equal(proof.EndDigest, commitment.HistoryDigest) {
+		return fmt.Errorf("%w: the commitment of version %d does not extend the head", ErrVerificationFailed, commitment.Version)
+	}
+	c.head = commitment
+	return nil
+}
+
+// checkHistoryDigest checks that the digest is the one committed by the
+// version, advancing the head if the version is newer.
+func (c *Client) checkHistoryDigest(ctx context.Context, version uint64, digest common.Digest) error {
+	if c.head == nil || version > c.head.Version {
+		committed, err := c.fetchCommitment(ctx, version)
+		if err != nil {
+			return err
+		}
+		if err := c.trust(ctx, committed); err != nil {
+			return err
+		}
+	}
+	if version == c.head.Version {
+		if !bytes.Equal(digest, c.head.HistoryDigest) {
+			return fmt.Errorf("%w: the history digest of version %d does not match the head", ErrVerificationFailed, version)
+		}
+		return nil
+	}
+	proof, err := c.proveConsistency(ctx, version, c.head.Version)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(proof.StartDigest, digest) || !bytes.Equal(proof.EndDigest, c.head.HistoryDigest) {
+		return fmt.Errorf("%w: the history digest of version %d is not consistent with the head", ErrVerificationFailed, version)
+	}
+	return nil
+}
+
+func (c *Client) commitment(ctx context.Context, version uint64) (*balloon.Commitment, error) {
+	committed, err := c.fetchCommitment(ctx, version)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.trust(ctx, committed); err != nil {
+		return nil, err
+	}
+	return committed, nil
+}
+
+func (c *Client) fetchCommitment(ctx context.Context, version uint64) (*balloon.Commitment, error) {
+	var response protocol.Commitment
+	if err := c.do(ctx, http.MethodGet, "/root?version="+strconv.FormatUint(version, 10), nil, &response); err != nil {
+		return nil, err
+	}
+	if response.Version != version {
+		return nil, fmt.Errorf("%w: the commitment is for version %d instead of %d", ErrVerificationFailed, response.Version, version)
+	}
+	return response.Decode(), nil
+}
+
+func (c *Client) checkEnvelope(envelope *protocol.Envelope, expectedKind bool) error {
+	if !expectedKind {
+		return fmt.Errorf("%w: unexpected %s proof", ErrVerificationFailed, envelope.Kind)
+	}
+	if envelope.Hasher != c.hasher {
+		return fmt.Errorf("%w: the proof is for the %s hasher", ErrVerificationFailed, envelope.Hasher)
+	}
+	return nil
+}
+
+// do sends the request and decodes the response into v. The failures
+// reported with the errors of the balloon are turned back into them.
+func (c *Client) do(ctx context.Context, method, path string, body io.Reader, v interface{}) error {
+	request, err := http.NewRequest(method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(ctx)
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= http.StatusBadRequest {
+		var failure protocol.Error
+		data, _ := ioutil.ReadAll(response.Body)
+		if json.Unmarshal(data, &failure) != nil || failure.Error == "" {
+			failure.Error = strings.TrimSpace(string(data))
+		}
+		switch failure.Error {
+		case balloon.ErrVersionNotFound.Error():
+			return balloon.ErrVersionNotFound
+		case balloon.ErrInvalidRange.Error():
+			return balloon.ErrInvalidRange
+		}
+		return &Error{response.StatusCode, failure.Error}
+	}
+	if err := json.NewDecoder(response.Body).Decode(v); err != nil {
+		return fmt.Errorf("invalid response from %s: %v", path, err)
+	}
+	return nil
+}
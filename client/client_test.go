@@ -0,0 +1,277 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aalda/trees/api"
+	"github.com/aalda/trees/balloon"
+	"github.com/aalda/trees/balloon/balloontest"
+	"github.com/aalda/trees/common"
+	"github.com/aalda/trees/log"
+	"github.com/aalda/trees/storage/bplus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tamper rewrites the JSON responses of the handler whose path starts with
+// the prefix.
+func tamper(handler http.Handler, prefix string, rewrite func(response map[string]interface{})) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, r)
+		body := recorder.Body.Bytes()
+		if strings.HasPrefix(r.URL.Path, prefix) && recorder.Code < http.StatusBadRequest {
+			var response map[string]interface{}
+			if err := json.Unmarshal(body, &response); err == nil {
+				rewrite(response)
+				body, _ = json.Marshal(response)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(recorder.Code)
+		w.Write(body)
+	})
+}
+
+func newServer(t *testing.T, b *balloon.Balloon, wrap func(http.Handler) http.Handler) *httptest.Server {
+	handler, err := api.NewHandler(b, "sha256")
+	require.NoError(t, err)
+	var h http.Handler = handler
+	if wrap != nil {
+		h = wrap(handler)
+	}
+	server := httptest.NewServer(h)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newClient(t *testing.T, server *httptest.Server) *Client {
+	c, err := New(server.URL, server.Client(), "sha256")
+	require.NoError(t, err)
+	return c
+}
+
+func TestHonestServer(t *testing.T) {
+
+	log.SetLogger("TestHonestServer", log.SILENT)
+
+	server := newServer(t, balloontest.NewBalloon(t, bplus.NewBPlusTreeStorage(), 0), nil)
+	c := newClient(t, server)
+
+	for i := uint64(0); i < 10; i++ {
+		commitment, err := c.Add(balloontest.Ctx, balloontest.Event(i))
+		require.NoError(t, err)
+		assert.Equal(t, i, commitment.Version, "Incorrect version")
+		assert.Equal(t, commitment, c.Head(), "The commitment should be the new head")
+	}
+
+	for i := uint64(0); i < 10; i++ {
+		proof, err := c.Get(balloontest.Ctx, balloontest.Sha256Hasher().Do(balloontest.Event(i)))
+		require.NoError(t, err)
+		assert.Equal(t, i, proof.Version, "Incorrect version")
+
+		history, err := c.ProveMembership(balloontest.Ctx, i, 9)
+		require.NoError(t, err)
+		assert.Equal(t, common.Digest(balloontest.Sha256Hasher().Do(balloontest.Event(i))), history.EventDigest, "Incorrect event digest")
+
+		_, err = c.ProveConsistency(balloontest.Ctx, i, 9)
+		require.NoError(t, err)
+	}
+
+	_, err := c.Get(balloontest.Ctx, balloontest.Sha256Hasher().Do(balloontest.Event(10)))
+	assert.Equal(t, common.ErrKeyNotFound, err, "A missing event should not be found")
+	_, err = c.Commitment(balloontest.Ctx, 10)
+	assert.Equal(t, balloon.ErrVersionNotFound, err, "The version should be committed")
+	_, err = c.ProveMembership(balloontest.Ctx, 5, 4)
+	assert.Equal(t, balloon.ErrInvalidRange, err, "The index cannot be after the version")
+}
+
+func TestUpdateHead(t *testing.T) {
+
+	log.SetLogger("TestUpdateHead", log.SILENT)
+
+	b := balloontest.NewBalloon(t, bplus.NewBPlusTreeStorage(), 5)
+	c := newClient(t, newServer(t, b, nil))
+
+	head, err := c.UpdateHead(balloontest.Ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4), head.Version, "Incorrect head")
+
+	for i := uint64(5); i < 10; i++ {
+		_, err := b.Add(balloontest.Ctx, balloontest.Event(i))
+		require.NoError(t, err)
+	}
+	head, err = c.UpdateHead(balloontest.Ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(9), head.Version, "The head should move forward")
+
+	old, err := c.Commitment(balloontest.Ctx, 3)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), old.Version, "Incorrect commitment")
+	assert.Equal(t, head, c.Head(), "Older commitments should not replace the head")
+
+	// a membership proof against a version older than the head cannot be
+	// checked
+	c.SetHead(&balloon.Commitment{Version: 10})
+	_, err = c.Get(balloontest.Ctx, balloontest.Sha256Hasher().Do(balloontest.Event(1)))
+	assert.Equal(t, ErrStaleProof, err, "Incorrect error")
+}
+
+func TestTamperingServers(t *testing.T) {
+
+	log.SetLogger("TestTamperingServers", log.SILENT)
+
+	flip := func(value interface{}) string {
+		digest := []byte(value.(string))
+		if digest[0] == '0' {
+			digest[0] = '1'
+		} else {
+			digest[0] = '0'
+		}
+		return string(digest)
+	}
+	tamperProof := func(key string) func(map[string]interface{}) {
+		return func(response map[string]interface{}) {
+			proof := response["proof"].(map[string]interface{})
+			if key == "auditPath" {
+				for pos, digest := range proof[key].(map[string]interface{}) {
+					proof[key].(map[string]interface{})[pos] = flip(digest)
+					break
+				}
+				return
+			}
+			proof[key] = flip(proof[key])
+		}
+	}
+
+	testCases := []struct {
+		name    string
+		prefix  string
+		rewrite func(map[string]interface{})
+		call    func(c *Client) error
+	}{
+		{"membership audit path", "/events/", tamperProof("auditPath"), func(c *Client) error {
+			_, err := c.Get(balloontest.Ctx, balloontest.Sha256Hasher().Do(balloontest.Event(3)))
+			return err
+		}},
+		{"membership hyper digest", "/events/", tamperProof("hyperDigest"), func(c *Client) error {
+			_, err := c.Get(balloontest.Ctx, balloontest.Sha256Hasher().Do(balloontest.Event(3)))
+			return err
+		}},
+		{"membership version", "/events/", func(response map[string]interface{}) {
+			response["proof"].(map[string]interface{})["version"] = 4
+		}, func(c *Client) error {
+			_, err := c.Get(balloontest.Ctx, balloontest.Sha256Hasher().Do(balloontest.Event(3)))
+			return err
+		}},
+		{"history event digest", "/history/", tamperProof("eventDigest"), func(c *Client) error {
+			_, err := c.ProveMembership(balloontest.Ctx, 3, 9)
+			return err
+		}},
+		{"history audit path", "/history/", tamperProof("auditPath"), func(c *Client) error {
+			_, err := c.ProveMembership(balloontest.Ctx, 3, 9)
+			return err
+		}},
+		{"consistency audit path", "/consistency", tamperProof("auditPath"), func(c *Client) error {
+			_, err := c.UpdateHead(balloontest.Ctx)
+			return err
+		}},
+		{"root history digest", "/root", func(response map[string]interface{}) {
+			response["historyDigest"] = flip(response["historyDigest"])
+		}, func(c *Client) error {
+			_, err := c.UpdateHead(balloontest.Ctx)
+			return err
+		}},
+		{"added event", "/events", func(response map[string]interface{}) {
+			response["eventDigest"] = flip(response["eventDigest"])
+		}, func(c *Client) error {
+			_, err := c.Add(balloontest.Ctx, balloontest.Event(10))
+			return err
+		}},
+		{"added event history", "/history/", tamperProof("auditPath"), func(c *Client) error {
+			_, err := c.Add(balloontest.Ctx, balloontest.Event(10))
+			return err
+		}},
+		{"root hyper digest", "/root", func(response map[string]interface{}) {
+			response["hyperDigest"] = flip(response["hyperDigest"])
+		}, func(c *Client) error {
+			_, err := c.Get(balloontest.Ctx, balloontest.Sha256Hasher().Do(balloontest.Event(3)))
+			return err
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := balloontest.NewBalloon(t, bplus.NewBPlusTreeStorage(), 10)
+			honest, err := b.Commitment(balloontest.Ctx, 4)
+			require.NoError(t, err)
+
+			server := newServer(t, b, func(h http.Handler) http.Handler {
+				return tamper(h, tc.prefix, tc.rewrite)
+			})
+			c := newClient(t, server)
+			c.SetHead(honest)
+
+			err = tc.call(c)
+			assert.True(t, errors.Is(err, ErrVerificationFailed), "The tampered response should be rejected: %v", err)
+			assert.Equal(t, honest, c.Head(), "The head should not move")
+		})
+	}
+}
+
+func TestForkedServer(t *testing.T) {
+
+	log.SetLogger("TestForkedServer", log.SILENT)
+
+	c := newClient(t, newServer(t, balloontest.NewBalloon(t, bplus.NewBPlusTreeStorage(), 5), nil))
+	head, err := c.UpdateHead(balloontest.Ctx)
+	require.NoError(t, err)
+
+	// a server with another history of the same length and beyond
+	forked := balloontest.NewBalloon(t, bplus.NewBPlusTreeStorage(), 0)
+	for i := uint64(0); i < 10; i++ {
+		_, err := forked.Add(balloontest.Ctx, []byte(fmt.Sprintf("forked %d", i)))
+		require.NoError(t, err)
+	}
+	c.baseURL = newServer(t, forked, nil).URL
+
+	_, err = c.UpdateHead(balloontest.Ctx)
+	assert.True(t, errors.Is(err, ErrVerificationFailed), "The forked history should be rejected: %v", err)
+	_, err = c.Commitment(balloontest.Ctx, 2)
+	assert.True(t, errors.Is(err, ErrVerificationFailed), "The forked commitment should be rejected: %v", err)
+	assert.Equal(t, head, c.Head(), "The head should not move")
+}
+
+func TestInvalidResponses(t *testing.T) {
+
+	log.SetLogger("TestInvalidResponses", log.SILENT)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/root" {
+			w.Write([]byte("not json"))
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("upstream unavailable"))
+	}))
+	defer server.Close()
+	c := newClient(t, server)
+
+	_, err := c.UpdateHead(balloontest.Ctx)
+	assert.Error(t, err, "An invalid response should fail")
+
+	_, err = c.ProveConsistency(balloontest.Ctx, 0, 1)
+	var serverErr *Error
+	require.True(t, errors.As(err, &serverErr), "The failure should be reported: %v", err)
+	assert.Equal(t, http.StatusBadGateway, serverErr.StatusCode, "Incorrect status")
+	assert.Equal(t, "upstream unavailable", serverErr.Message, "Incorrect message")
+
+	_, err = New(server.URL, nil, "md5")
+	assert.Error(t, err, "An unknown hasher should be rejected")
+}
@@ -0,0 +1,194 @@
+package common
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// ARCCache is a ModifiableCache implementing the Adaptive Replacement Cache
+// algorithm. It splits its capacity between the digests seen once recently
+// and the ones seen more than once, and adapts the split using the keys it
+// has recently evicted from each side. It is safe for concurrent use.
+type ARCCache struct {
+	lock     sync.Mutex
+	capacity int
+	// target size for recent
+	p               int
+	recent          *arcList
+	frequent        *arcList
+	recentEvicted   *arcList
+	frequentEvicted *arcList
+	metrics         CacheMetrics
+}
+
+func NewARCCache(capacity int) *ARCCache {
+	if capacity <= 0 {
+		panic("cache capacity must be positive")
+	}
+	return &ARCCache{
+		capacity:        capacity,
+		recent:          newArcList(),
+		frequent:        newArcList(),
+		recentEvicted:   newArcList(),
+		frequentEvicted: newArcList(),
+		metrics:         noopCacheMetrics{},
+	}
+}
+
+func (c *ARCCache) SetMetrics(metrics CacheMetrics) {
+	c.metrics = metrics
+}
+
+func (c *ARCCache) Get(ctx context.Context, pos Position) (Digest, bool, error) {
+	var key [keySize]byte
+	copy(key[:], pos.Bytes())
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if digest, ok := c.recent.remove(key); ok {
+		c.frequent.pushFront(key, digest)
+		c.metrics.Hit()
+		return digest, true, nil
+	}
+	if digest, ok := c.frequent.get(key); ok {
+		c.metrics.Hit()
+		return digest, true, nil
+	}
+	c.metrics.Miss()
+	return nil, false, nil
+}
+
+func (c *ARCCache) Put(pos Position, value Digest) {
+	var key [keySize]byte
+	copy(key[:], pos.Bytes())
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.recent.remove(key); ok {
+		c.frequent.pushFront(key, value)
+		return
+	}
+	if c.frequent.contains(key) {
+		c.frequent.pushFront(key, value)
+		return
+	}
+
+	// a recently evicted key tells which side should have been larger
+	if c.recentEvicted.contains(key) {
+		c.p += adaptDelta(c.frequentEvicted.len(), c.recentEvicted.len())
+		if c.p > c.capacity {
+			c.p = c.capacity
+		}
+		c.makeRoom(false)
+		c.recentEvicted.remove(key)
+		c.frequent.pushFront(key, value)
+		return
+	}
+	if c.frequentEvicted.contains(key) {
+		c.p -= adaptDelta(c.recentEvicted.len(), c.frequentEvicted.len())
+		if c.p < 0 {
+			c.p = 0
+		}
+		c.makeRoom(true)
+		c.frequentEvicted.remove(key)
+		c.frequent.pushFront(key, value)
+		return
+	}
+
+	c.makeRoom(false)
+	if c.recentEvicted.len() > c.capacity-c.p {
+		c.recentEvicted.removeOldest()
+	}
+	if c.frequentEvicted.len() > c.p {
+		c.frequentEvicted.removeOldest()
+	}
+	c.recent.pushFront(key, value)
+}
+
+// makeRoom evicts a digest if the cache is full, from the side that is over
+// its target size.
+func (c *ARCCache) makeRoom(inFrequentEvicted bool) {
+	if c.recent.len()+c.frequent.len() < c.capacity {
+		return
+	}
+	recentLen := c.recent.len()
+	if recentLen > 0 && (recentLen > c.p || (recentLen == c.p && inFrequentEvicted) || c.frequent.len() == 0) {
+		key, _ := c.recent.removeOldest()
+		c.recentEvicted.pushFront(key, nil)
+		return
+	}
+	key, _ := c.frequent.removeOldest()
+	c.frequentEvicted.pushFront(key, nil)
+}
+
+// adaptDelta grows the adjustment of the target size with the ratio between
+// both evicted lists.
+func adaptDelta(other, hit int) int {
+	if other > hit {
+		return other / hit
+	}
+	return 1
+}
+
+func (c *ARCCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.recent.len() + c.frequent.len()
+}
+
+// arcList keeps the keys in recency order, the most recent first.
+type arcList struct {
+	order *list.List
+	items map[[keySize]byte]*list.Element
+}
+
+func newArcList() *arcList {
+	return &arcList{list.New(), make(map[[keySize]byte]*list.Element)}
+}
+
+func (l *arcList) len() int {
+	return l.order.Len()
+}
+
+func (l *arcList) contains(key [keySize]byte) bool {
+	_, ok := l.items[key]
+	return ok
+}
+
+func (l *arcList) get(key [keySize]byte) (Digest, bool) {
+	e, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(e)
+	return e.Value.(*cacheEntry).digest, true
+}
+
+func (l *arcList) pushFront(key [keySize]byte, digest Digest) {
+	if e, ok := l.items[key]; ok {
+		e.Value.(*cacheEntry).digest = digest
+		l.order.MoveToFront(e)
+		return
+	}
+	l.items[key] = l.order.PushFront(&cacheEntry{key, digest})
+}
+
+func (l *arcList) remove(key [keySize]byte) (Digest, bool) {
+	e, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.Remove(e)
+	delete(l.items, key)
+	return e.Value.(*cacheEntry).digest, true
+}
+
+func (l *arcList) removeOldest() ([keySize]byte, Digest) {
+	e := l.order.Back()
+	entry := e.Value.(*cacheEntry)
+	l.order.Remove(e)
+	delete(l.items, entry.key)
+	return entry.key, entry.digest
+}
@@ -1,21 +1,31 @@
 package common
 
-import "github.com/aalda/trees/log"
+import (
+	"context"
+	"errors"
+
+	"github.com/aalda/trees/log"
+)
+
+// ErrIncompleteAuditPath is returned by the pruners verifying a proof whose
+// audit path misses a digest they need.
+var ErrIncompleteAuditPath = errors.New("the audit path misses a digest")
 
 type AuditPath map[string]Digest
 
-func (p AuditPath) Get(pos Position) (Digest, bool) {
+func (p AuditPath) Get(ctx context.Context, pos Position) (Digest, bool, error) {
 	digest, ok := p[pos.StringId()]
-	return digest, ok
+	return digest, ok, nil
 }
 
 type AuditPathVisitor struct {
 	decorated *ComputeHashVisitor
 	auditPath AuditPath
+	logger    *log.Logger
 }
 
-func NewAuditPathVisitor(decorated *ComputeHashVisitor) *AuditPathVisitor {
-	return &AuditPathVisitor{decorated, make(AuditPath)}
+func NewAuditPathVisitor(decorated *ComputeHashVisitor, logger *log.Logger) *AuditPathVisitor {
+	return &AuditPathVisitor{decorated, make(AuditPath), logger}
 }
 
 func (v AuditPathVisitor) Result() AuditPath {
@@ -49,7 +59,7 @@ func (v *AuditPathVisitor) VisitCached(pos Position, cachedDigest Digest) interf
 
 func (v *AuditPathVisitor) VisitCacheable(pos Position, result interface{}) interface{} {
 	digest := v.decorated.VisitCacheable(pos, result)
-	log.Debugf("Adding cacheable to path in position: %v", pos)
+	v.logger.Debug("Adding cacheable to path", log.Stringer("position", pos))
 	v.auditPath[pos.StringId()] = digest.(Digest)
 	return digest
 }
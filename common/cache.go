@@ -1,7 +1,12 @@
 package common
 
+import "context"
+
+// Cache reads the digests of the tree nodes. A digest that is not cached is
+// reported as missing, while a read that failed returns the error, so that
+// callers never take a failed read for an empty subtree.
 type Cache interface {
-	Get(pos Position) (Digest, bool)
+	Get(ctx context.Context, pos Position) (Digest, bool, error)
 }
 
 type ModifiableCache interface {
@@ -9,41 +14,76 @@ type ModifiableCache interface {
 	Cache
 }
 
+// CacheMetrics receives the outcome of every read done on a cache layer.
+type CacheMetrics interface {
+	Hit()
+	Miss()
+	// Fallback counts the reads answered with a default hash.
+	Fallback()
+	// StoreError counts the reads that failed in the underlying store.
+	StoreError()
+}
+
+type noopCacheMetrics struct{}
+
+func (noopCacheMetrics) Hit()        {}
+func (noopCacheMetrics) Miss()       {}
+func (noopCacheMetrics) Fallback()   {}
+func (noopCacheMetrics) StoreError() {}
+
 type PassThroughCache struct {
-	prefix byte
-	store  Store
+	prefix  byte
+	store   Store
+	metrics CacheMetrics
 }
 
 func NewPassThroughCache(prefix byte, store Store) *PassThroughCache {
-	return &PassThroughCache{prefix, store}
+	return &PassThroughCache{prefix, store, noopCacheMetrics{}}
 }
 
-func (c PassThroughCache) Get(pos Position) (Digest, bool) {
-	pair, err := c.store.Get(c.prefix, pos.Bytes())
-	if err != nil {
-		return nil, false
-	}
-	if len(pair.Key) > 0 { // TODO FIX THIS
-		return pair.Value, true
+func (c *PassThroughCache) SetMetrics(metrics CacheMetrics) {
+	c.metrics = metrics
+}
+
+func (c PassThroughCache) Get(ctx context.Context, pos Position) (Digest, bool, error) {
+	pair, err := c.store.Get(ctx, c.prefix, pos.Bytes())
+	switch err {
+	case nil:
+		c.metrics.Hit()
+		return pair.Value, true, nil
+	case ErrKeyNotFound:
+		c.metrics.Miss()
+		return nil, false, nil
 	}
-	return nil, false
+	c.metrics.StoreError()
+	return nil, false, err
 }
 
 const keySize = 34
 
 type SimpleCache struct {
-	cached map[[keySize]byte]Digest
+	cached  map[[keySize]byte]Digest
+	metrics CacheMetrics
 }
 
 func NewSimpleCache(size uint64) *SimpleCache {
-	return &SimpleCache{make(map[[keySize]byte]Digest, size)}
+	return &SimpleCache{make(map[[keySize]byte]Digest, size), noopCacheMetrics{}}
+}
+
+func (c *SimpleCache) SetMetrics(metrics CacheMetrics) {
+	c.metrics = metrics
 }
 
-func (c SimpleCache) Get(pos Position) (Digest, bool) {
+func (c SimpleCache) Get(ctx context.Context, pos Position) (Digest, bool, error) {
 	var key [keySize]byte
 	copy(key[:], pos.Bytes())
 	digest, ok := c.cached[key]
-	return digest, ok
+	if ok {
+		c.metrics.Hit()
+	} else {
+		c.metrics.Miss()
+	}
+	return digest, ok, nil
 }
 
 func (c *SimpleCache) Put(pos Position, value Digest) {
@@ -52,35 +92,58 @@ func (c *SimpleCache) Put(pos Position, value Digest) {
 	c.cached[key] = value
 }
 
+// TwoLevelCache keeps the digests read from the decorated cache in a first
+// level cache. When the first level is bounded, the evicted digests are read
+// again from the decorated one.
 type TwoLevelCache struct {
+	first     ModifiableCache
 	decorated Cache
-	cached    map[[keySize]byte]Digest
+	metrics   CacheMetrics
 }
 
 func NewTwoLevelCache(size uint64, decorated Cache) *TwoLevelCache {
+	return NewTwoLevelCacheWithFirstLevel(NewSimpleCache(size), decorated)
+}
+
+func NewTwoLevelCacheWithFirstLevel(first ModifiableCache, decorated Cache) *TwoLevelCache {
 	return &TwoLevelCache{
+		first:     first,
 		decorated: decorated,
-		cached:    make(map[[keySize]byte]Digest, size),
+		metrics:   noopCacheMetrics{},
 	}
 }
 
-func (c TwoLevelCache) Get(pos Position) (Digest, bool) {
-	var key [keySize]byte
-	copy(key[:], pos.Bytes())
+// SetMetrics counts the reads served by the first level as hits and the ones
+// going to the decorated cache as misses.
+func (c *TwoLevelCache) SetMetrics(metrics CacheMetrics) {
+	c.metrics = metrics
+}
 
-	digest, ok := c.cached[key]
-	if !ok {
-		digest, ok = c.decorated.Get(pos)
-		if ok {
-			c.cached[key] = digest
-		}
+func (c TwoLevelCache) Get(ctx context.Context, pos Position) (Digest, bool, error) {
+	digest, ok, err := c.first.Get(ctx, pos)
+	if err != nil {
+		return nil, false, err
+	}
+	if ok {
+		c.metrics.Hit()
+		return digest, true, nil
 	}
-	return digest, ok
+	c.metrics.Miss()
+	digest, ok, err = c.decorated.Get(ctx, pos)
+	if ok {
+		c.first.Put(pos, digest)
+	}
+	return digest, ok, err
+}
+
+func (c *TwoLevelCache) Put(pos Position, value Digest) {
+	c.first.Put(pos, value)
 }
 
 type FallbackCache struct {
 	decorated     Cache
 	defaultHashes []Digest
+	metrics       CacheMetrics
 }
 
 func NewFallbackCache(id []byte, height uint16, hasher Hasher, decorated Cache) *FallbackCache {
@@ -92,13 +155,25 @@ func NewFallbackCache(id []byte, height uint16, hasher Hasher, decorated Cache)
 	return &FallbackCache{
 		decorated:     decorated,
 		defaultHashes: hashes,
+		metrics:       noopCacheMetrics{},
 	}
 }
 
-func (c FallbackCache) Get(pos Position) (Digest, bool) {
-	digest, ok := c.decorated.Get(pos)
+func (c *FallbackCache) SetMetrics(metrics CacheMetrics) {
+	c.metrics = metrics
+}
+
+// Get falls back to the default hash only for the digests the decorated cache
+// does not hold, not for the reads that failed.
+func (c FallbackCache) Get(ctx context.Context, pos Position) (Digest, bool, error) {
+	digest, ok, err := c.decorated.Get(ctx, pos)
+	if err != nil {
+		return nil, false, err
+	}
 	if ok {
-		return digest, ok
+		c.metrics.Hit()
+		return digest, ok, nil
 	}
-	return c.defaultHashes[pos.Height()], true
+	c.metrics.Fallback()
+	return c.defaultHashes[pos.Height()], true, nil
 }
@@ -0,0 +1,187 @@
+package common
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var ctx = context.Background()
+
+type fakePosition struct {
+	index  uint64
+	height uint16
+}
+
+func pos(index uint64) Position {
+	return fakePosition{index, 0}
+}
+
+func (p fakePosition) Index() []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, p.index)
+	return b
+}
+func (p fakePosition) Height() uint16        { return p.height }
+func (p fakePosition) Bytes() []byte         { return append(p.Index(), byte(p.height>>8), byte(p.height)) }
+func (p fakePosition) String() string        { return fmt.Sprintf("Pos(%d, %d)", p.index, p.height) }
+func (p fakePosition) StringId() string      { return fmt.Sprintf("%d|%d", p.index, p.height) }
+func (p fakePosition) IndexAsUint64() uint64 { return p.index }
+
+type boundedCache interface {
+	ModifiableCache
+	Len() int
+	SetMetrics(metrics CacheMetrics)
+}
+
+type countingMetrics struct {
+	hits, misses uint64
+}
+
+func (m *countingMetrics) Hit()        { atomic.AddUint64(&m.hits, 1) }
+func (m *countingMetrics) Miss()       { atomic.AddUint64(&m.misses, 1) }
+func (m *countingMetrics) Fallback()   {}
+func (m *countingMetrics) StoreError() {}
+
+func testBoundedCache(t *testing.T, newCache func(capacity int) boundedCache) {
+	cache := newCache(10)
+	metrics := new(countingMetrics)
+	cache.SetMetrics(metrics)
+
+	for i := uint64(0); i < 100; i++ {
+		cache.Put(pos(i), Digest{byte(i)})
+		require.True(t, cache.Len() <= 10, "The cache should never hold more digests than its capacity")
+	}
+	require.Equal(t, 10, cache.Len())
+
+	// the last ones are still there
+	for i := uint64(90); i < 100; i++ {
+		digest, ok, _ := cache.Get(ctx, pos(i))
+		require.Truef(t, ok, "Position %d should be cached", i)
+		require.Equal(t, Digest{byte(i)}, digest)
+	}
+	_, ok, _ := cache.Get(ctx, pos(0))
+	require.False(t, ok, "Position 0 should have been evicted")
+
+	cache.Put(pos(95), Digest{0xff})
+	digest, _, _ := cache.Get(ctx, pos(95))
+	require.Equal(t, Digest{0xff}, digest, "Put should overwrite the digest")
+
+	assert.Equal(t, &countingMetrics{hits: 11, misses: 1}, metrics)
+}
+
+func TestLRUCache(t *testing.T) {
+	testBoundedCache(t, func(capacity int) boundedCache { return NewLRUCache(capacity) })
+
+	cache := NewLRUCache(3)
+	for i := uint64(0); i < 3; i++ {
+		cache.Put(pos(i), Digest{byte(i)})
+	}
+	cache.Get(ctx, pos(0))
+	cache.Put(pos(3), Digest{0x3})
+	_, ok, _ := cache.Get(ctx, pos(0))
+	assert.True(t, ok, "A recently read position should not be evicted")
+	_, ok, _ = cache.Get(ctx, pos(1))
+	assert.False(t, ok, "The least recently used position should be evicted")
+}
+
+func TestARCCache(t *testing.T) {
+	testBoundedCache(t, func(capacity int) boundedCache { return NewARCCache(capacity) })
+
+	// frequently read positions survive a scan bigger than the cache
+	cache := NewARCCache(10)
+	for i := uint64(0); i < 5; i++ {
+		cache.Put(pos(i), Digest{byte(i)})
+		cache.Get(ctx, pos(i))
+	}
+	for i := uint64(100); i < 200; i++ {
+		cache.Put(pos(i), Digest{byte(i)})
+	}
+	for i := uint64(0); i < 5; i++ {
+		_, ok, _ := cache.Get(ctx, pos(i))
+		assert.Truef(t, ok, "Frequently read position %d should survive a scan", i)
+	}
+	assert.Equal(t, 10, cache.Len())
+}
+
+func TestARCCacheAdapts(t *testing.T) {
+	cache := NewARCCache(4)
+	// alternate a working set bigger than the cache between both lists
+	for round := 0; round < 10; round++ {
+		for i := uint64(0); i < 6; i++ {
+			if _, ok, _ := cache.Get(ctx, pos(i)); !ok {
+				cache.Put(pos(i), Digest{byte(i)})
+			}
+			require.True(t, cache.Len() <= 4)
+		}
+	}
+	assert.True(t, cache.recentEvicted.len()+cache.frequentEvicted.len() <= 2*4, "The evicted keys should be bounded")
+}
+
+func testConcurrentCache(t *testing.T, cache boundedCache) {
+	metrics := new(countingMetrics)
+	cache.SetMetrics(metrics)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := uint64(0); i < 1000; i++ {
+				p := pos(i % 50)
+				if _, ok, _ := cache.Get(ctx, p); !ok {
+					cache.Put(p, Digest{byte(i % 50)})
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	assert.Equal(t, uint64(8*1000), metrics.hits+metrics.misses, "Every read should be counted")
+	assert.True(t, cache.Len() <= 20)
+}
+
+func TestConcurrentCaches(t *testing.T) {
+	testConcurrentCache(t, NewLRUCache(20))
+	testConcurrentCache(t, NewARCCache(20))
+}
+
+type countingCache struct {
+	SimpleCache
+	reads int
+}
+
+func (c *countingCache) Get(ctx context.Context, pos Position) (Digest, bool, error) {
+	c.reads++
+	return c.SimpleCache.Get(ctx, pos)
+}
+
+func TestTwoLevelCacheWithBoundedFirstLevel(t *testing.T) {
+	second := &countingCache{SimpleCache: *NewSimpleCache(0)}
+	for i := uint64(0); i < 10; i++ {
+		second.Put(pos(i), Digest{byte(i)})
+	}
+
+	cache := NewTwoLevelCacheWithFirstLevel(NewLRUCache(2), second)
+	for i := uint64(0); i < 10; i++ {
+		digest, ok, _ := cache.Get(ctx, pos(i))
+		require.True(t, ok)
+		require.Equal(t, Digest{byte(i)}, digest)
+	}
+	require.Equal(t, 10, second.reads)
+
+	// the last two are served by the first level
+	cache.Get(ctx, pos(9))
+	cache.Get(ctx, pos(8))
+	require.Equal(t, 10, second.reads, "Cached positions should not reach the second level")
+
+	// evicted ones fall through to the second level
+	digest, ok, _ := cache.Get(ctx, pos(0))
+	require.True(t, ok)
+	require.Equal(t, Digest{0x0}, digest)
+	require.Equal(t, 11, second.reads, "Evicted positions should be read from the second level")
+}
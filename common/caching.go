@@ -10,12 +10,14 @@ type CachedElement struct {
 type CachingVisitor struct {
 	decorated PostOrderVisitor
 	elements  []CachedElement
+	logger    *log.Logger
 }
 
-func NewCachingVisitor(decorated PostOrderVisitor) *CachingVisitor {
+func NewCachingVisitor(decorated PostOrderVisitor, logger *log.Logger) *CachingVisitor {
 	return &CachingVisitor{
 		decorated: decorated,
 		elements:  make([]CachedElement, 0),
+		logger:    logger,
 	}
 }
 
@@ -49,7 +51,7 @@ func (v *CachingVisitor) VisitCached(pos Position, cachedDigest Digest) interfac
 }
 
 func (v *CachingVisitor) VisitCacheable(pos Position, result interface{}) interface{} {
-	log.Debugf("Caching digest with position: %v", pos)
+	v.logger.Debug("Caching digest", log.Stringer("position", pos))
 	element := &CachedElement{pos, result.(Digest)}
 	v.elements = append(v.elements, *element)
 	return result
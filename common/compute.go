@@ -13,39 +13,40 @@ func NewCommitment(version uint64, digest Digest) *Commitment {
 
 type ComputeHashVisitor struct {
 	hasher Hasher
+	logger *log.Logger
 }
 
-func NewComputeHashVisitor(hasher Hasher) *ComputeHashVisitor {
-	return &ComputeHashVisitor{hasher}
+func NewComputeHashVisitor(hasher Hasher, logger *log.Logger) *ComputeHashVisitor {
+	return &ComputeHashVisitor{hasher, logger}
 }
 
 func (v *ComputeHashVisitor) VisitRoot(pos Position, leftResult, rightResult interface{}) interface{} {
-	log.Debugf("Computing root hash in position: %v", pos)
+	v.logger.Debug("Computing root hash", log.Stringer("position", pos))
 	return v.interiorHash(pos.Bytes(), leftResult.(Digest), rightResult.(Digest))
 }
 
 func (v *ComputeHashVisitor) VisitNode(pos Position, leftResult, rightResult interface{}) interface{} {
-	log.Debugf("Computing node hash in position: %v", pos)
+	v.logger.Debug("Computing node hash", log.Stringer("position", pos))
 	return v.interiorHash(pos.Bytes(), leftResult.(Digest), rightResult.(Digest))
 }
 
 func (v *ComputeHashVisitor) VisitPartialNode(pos Position, leftResult interface{}) interface{} {
-	log.Debugf("Computing partial node hash in position: %v", pos)
+	v.logger.Debug("Computing partial node hash", log.Stringer("position", pos))
 	return v.leafHash(pos.Bytes(), leftResult.(Digest))
 }
 
 func (v *ComputeHashVisitor) VisitLeaf(pos Position, value []byte) interface{} {
-	log.Debugf("Computing leaf hash in position: %v", pos)
+	v.logger.Debug("Computing leaf hash", log.Stringer("position", pos))
 	return v.leafHash(pos.Bytes(), value)
 }
 
 func (v *ComputeHashVisitor) VisitCached(pos Position, cachedDigest Digest) interface{} {
-	log.Debugf("Getting cached hash in position: %v", pos)
+	v.logger.Debug("Getting cached hash", log.Stringer("position", pos))
 	return cachedDigest
 }
 
 func (v *ComputeHashVisitor) VisitCacheable(pos Position, result interface{}) interface{} {
-	log.Debugf("Getting cacheable value in position: %v", pos)
+	v.logger.Debug("Getting cacheable value", log.Stringer("position", pos))
 	return result
 }
 
@@ -0,0 +1,47 @@
+package common
+
+// CountingVisitor counts the nodes visited in a pruned tree, by-passing every
+// visit to the decorated visitor.
+type CountingVisitor struct {
+	decorated PostOrderVisitor
+	count     int
+}
+
+func NewCountingVisitor(decorated PostOrderVisitor) *CountingVisitor {
+	return &CountingVisitor{decorated: decorated}
+}
+
+func (v *CountingVisitor) Result() int {
+	return v.count
+}
+
+func (v *CountingVisitor) VisitRoot(pos Position, leftResult, rightResult interface{}) interface{} {
+	v.count++
+	return v.decorated.VisitRoot(pos, leftResult, rightResult)
+}
+
+func (v *CountingVisitor) VisitNode(pos Position, leftResult, rightResult interface{}) interface{} {
+	v.count++
+	return v.decorated.VisitNode(pos, leftResult, rightResult)
+}
+
+func (v *CountingVisitor) VisitPartialNode(pos Position, leftResult interface{}) interface{} {
+	v.count++
+	return v.decorated.VisitPartialNode(pos, leftResult)
+}
+
+func (v *CountingVisitor) VisitLeaf(pos Position, value []byte) interface{} {
+	v.count++
+	return v.decorated.VisitLeaf(pos, value)
+}
+
+func (v *CountingVisitor) VisitCached(pos Position, cachedDigest Digest) interface{} {
+	v.count++
+	return v.decorated.VisitCached(pos, cachedDigest)
+}
+
+// VisitCacheable does not count, as the cacheable wraps a node that has
+// already been counted.
+func (v *CountingVisitor) VisitCacheable(pos Position, result interface{}) interface{} {
+	return v.decorated.VisitCacheable(pos, result)
+}
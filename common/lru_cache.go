@@ -0,0 +1,80 @@
+package common
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// LRUCache is a ModifiableCache holding up to a fixed number of digests,
+// evicting the least recently used one when it is full. It is safe for
+// concurrent use.
+type LRUCache struct {
+	lock     sync.Mutex
+	capacity int
+	items    map[[keySize]byte]*list.Element
+	order    *list.List
+	metrics  CacheMetrics
+}
+
+type cacheEntry struct {
+	key    [keySize]byte
+	digest Digest
+}
+
+func NewLRUCache(capacity int) *LRUCache {
+	if capacity <= 0 {
+		panic("cache capacity must be positive")
+	}
+	return &LRUCache{
+		capacity: capacity,
+		items:    make(map[[keySize]byte]*list.Element, capacity),
+		order:    list.New(),
+		metrics:  noopCacheMetrics{},
+	}
+}
+
+func (c *LRUCache) SetMetrics(metrics CacheMetrics) {
+	c.metrics = metrics
+}
+
+func (c *LRUCache) Get(ctx context.Context, pos Position) (Digest, bool, error) {
+	var key [keySize]byte
+	copy(key[:], pos.Bytes())
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		c.metrics.Miss()
+		return nil, false, nil
+	}
+	c.metrics.Hit()
+	c.order.MoveToFront(e)
+	return e.Value.(*cacheEntry).digest, true, nil
+}
+
+func (c *LRUCache) Put(pos Position, value Digest) {
+	var key [keySize]byte
+	copy(key[:], pos.Bytes())
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.items[key]; ok {
+		e.Value.(*cacheEntry).digest = value
+		c.order.MoveToFront(e)
+		return
+	}
+	if c.order.Len() == c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).key)
+	}
+	c.items[key] = c.order.PushFront(&cacheEntry{key, value})
+}
+
+func (c *LRUCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,21 @@
+package common
+
+import "time"
+
+// TreeMetrics receives the measurements of every tree operation, identified
+// by its name.
+type TreeMetrics interface {
+	ObserveLatency(operation string, latency time.Duration)
+	// ObserveNodesVisited reports the size of the pruned tree, including the
+	// subtrees hashed while pruning.
+	ObserveNodesVisited(operation string, nodes int)
+	ObserveMutations(operation string, mutations int)
+	ObserveAuditPathSize(operation string, size int)
+}
+
+type NoopTreeMetrics struct{}
+
+func (NoopTreeMetrics) ObserveLatency(operation string, latency time.Duration) {}
+func (NoopTreeMetrics) ObserveNodesVisited(operation string, nodes int)        {}
+func (NoopTreeMetrics) ObserveMutations(operation string, mutations int)       {}
+func (NoopTreeMetrics) ObserveAuditPathSize(operation string, size int)        {}
@@ -2,6 +2,8 @@ package common
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"sort"
 )
 
@@ -12,13 +14,25 @@ const (
 	HistoryCachePrefix = byte(0x3)
 )
 
+type MutationOp byte
+
+const (
+	SetOp MutationOp = iota
+	DeleteOp
+)
+
 type Mutation struct {
+	Op         MutationOp
 	Prefix     byte
 	Key, Value []byte
 }
 
 func NewMutation(prefix byte, key, value []byte) *Mutation {
-	return &Mutation{prefix, key, value}
+	return &Mutation{SetOp, prefix, key, value}
+}
+
+func NewDeleteMutation(prefix byte, key []byte) *Mutation {
+	return &Mutation{DeleteOp, prefix, key, nil}
 }
 
 type KVPair struct {
@@ -45,6 +59,16 @@ func (r KVRange) InsertSorted(p KVPair) KVRange {
 	return r
 }
 
+func (r KVRange) Remove(key []byte) KVRange {
+	index := sort.Search(len(r), func(i int) bool {
+		return bytes.Compare(r[i].Key, key) >= 0
+	})
+	if index < len(r) && bytes.Equal(r[index].Key, key) {
+		return append(r[:index], r[index+1:]...)
+	}
+	return r
+}
+
 func (r KVRange) Split(key []byte) (left, right KVRange) {
 	// the smallest index i where r[i] >= index
 	index := sort.Search(len(r), func(i int) bool {
@@ -64,9 +88,45 @@ func (r KVRange) Get(key []byte) KVPair {
 	}
 }
 
+var ErrKeyNotFound = errors.New("key not found")
+
+// KVIterator streams key-value pairs in ascending key order. It must be
+// closed once it is no longer used.
+type KVIterator interface {
+	// Next advances the iterator and reports whether there is a pair to read.
+	Next() bool
+	// Pair returns the current pair. The key does not include the prefix.
+	Pair() KVPair
+	// Err returns the first error found while iterating, if any.
+	Err() error
+	Close() error
+}
+
+// CollectRange reads all the pairs left in the iterator and closes it.
+func CollectRange(it KVIterator) (KVRange, error) {
+	defer it.Close()
+	result := NewKVRange()
+	for it.Next() {
+		result = append(result, it.Pair())
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Store methods fail with the context error once the context is done.
+// Iterators check it before every step, stop and report it through Err.
 type Store interface {
-	Mutate(mutations []Mutation) error
-	GetRange(prefix byte, start, end []byte) (KVRange, error)
-	Get(prefix byte, key []byte) (*KVPair, error)
+	Mutate(ctx context.Context, mutations []Mutation) error
+	// GetRange returns the same pairs as Iterate, all at once.
+	GetRange(ctx context.Context, prefix byte, start, end []byte) (KVRange, error)
+	// Get returns ErrKeyNotFound if there is no value stored for the key.
+	Get(ctx context.Context, prefix byte, key []byte) (*KVPair, error)
+	GetAll(ctx context.Context, prefix byte) KVIterator
+	// Iterate streams the pairs under the prefix whose keys are between start
+	// and end, both inclusive. A nil end iterates up to the last key.
+	Iterate(ctx context.Context, prefix byte, start, end []byte) KVIterator
+	Has(ctx context.Context, prefix byte, key []byte) (bool, error)
 	Close() error
 }
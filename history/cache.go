@@ -50,6 +50,29 @@ func (r DoubleTargetedCacheResolver) ShouldCache(pos common.Position) bool {
 	return r.end >= pos.IndexAsUint64()+pow(2, pos.Height())-1
 }
 
+// MembershipVerifyCacheResolver takes from the audit path every complete
+// subtree without the event, as the membership proofs hold them.
+type MembershipVerifyCacheResolver struct {
+	index, version uint64
+}
+
+func NewMembershipVerifyCacheResolver(index, version uint64) *MembershipVerifyCacheResolver {
+	return &MembershipVerifyCacheResolver{index, version}
+}
+
+func (r MembershipVerifyCacheResolver) ShouldBeInCache(pos common.Position) bool {
+	lastDescendantIndex := pos.IndexAsUint64() + pow(2, pos.Height()) - 1
+	return !contains(pos, r.index) && lastDescendantIndex <= r.version
+}
+
+func (r MembershipVerifyCacheResolver) ShouldCache(pos common.Position) bool {
+	return r.version >= pos.IndexAsUint64()+pow(2, pos.Height())-1
+}
+
+func contains(pos common.Position, version uint64) bool {
+	return pos.IndexAsUint64() <= version && version <= pos.IndexAsUint64()+pow(2, pos.Height())-1
+}
+
 type IncrementalCacheResolver struct {
 	start, end uint64
 }
@@ -75,16 +98,21 @@ func (r IncrementalCacheResolver) ShouldCache(pos common.Position) bool {
 	return r.end >= pos.IndexAsUint64()+pow(2, pos.Height())-1
 }
 
+// IncrementalVerifyCacheResolver takes from the audit path the digests the
+// IncrementalCacheResolver put in it. The complete subtrees ending at the
+// last version may come either as a single digest, as ProveConsistency
+// builds them, or split into their leaves.
 type IncrementalVerifyCacheResolver struct {
 	start, end uint64
+	auditPath  common.AuditPath
 }
 
-func NewIncrementalVerifyCacheResolver(start, end uint64) *IncrementalVerifyCacheResolver {
-	return &IncrementalVerifyCacheResolver{start, end}
+func NewIncrementalVerifyCacheResolver(start, end uint64, auditPath common.AuditPath) *IncrementalVerifyCacheResolver {
+	return &IncrementalVerifyCacheResolver{start, end, auditPath}
 }
 
 func (r IncrementalVerifyCacheResolver) ShouldBeInCache(pos common.Position) bool {
-	if pos.Height() == 0 { // changes this
+	if pos.Height() == 0 {
 		return true
 	}
 	threshold := pos.IndexAsUint64() + pow(2, pos.Height()) - 1
@@ -93,7 +121,11 @@ func (r IncrementalVerifyCacheResolver) ShouldBeInCache(pos common.Position) boo
 	}
 
 	lastDescendantIndex := pos.IndexAsUint64() + pow(2, pos.Height()) - 1
-	return pos.IndexAsUint64() > r.start && lastDescendantIndex < r.end // changes this
+	if pos.IndexAsUint64() > r.start && lastDescendantIndex == r.end {
+		_, ok := r.auditPath[pos.StringId()]
+		return ok
+	}
+	return pos.IndexAsUint64() > r.start && lastDescendantIndex < r.end
 }
 
 func (r IncrementalVerifyCacheResolver) ShouldCache(pos common.Position) bool {
@@ -1,17 +1,57 @@
 package history
 
 import (
+	"context"
+	"errors"
+	"fmt"
+
 	"github.com/aalda/trees/common"
 )
 
+// ErrMissingDigest is returned when the cache lacks a digest it should hold,
+// which happens when the store lost some of its entries.
+var ErrMissingDigest = errors.New("a digest that should be cached is missing")
+
+// PruningContext holds what the pruners share. Its context is the one given
+// to Prune.
 type PruningContext struct {
+	ctx           context.Context
 	navigator     common.TreeNavigator
 	cacheResolver CacheResolver
 	cache         common.Cache
+	err           error
+}
+
+// interrupted reports whether the operation has been cancelled or has failed,
+// in which case the pruners stop descending. The pruned tree is then
+// incomplete and must be discarded.
+func (c PruningContext) interrupted() bool {
+	return c.err != nil || c.ctx.Err() != nil
+}
+
+// fail keeps the first error found while pruning, which is returned by Prune.
+func (c *PruningContext) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// cached reads the digest of a complete subtree from the cache, failing the
+// pruning if it cannot be read.
+func (c *PruningContext) cached(pos common.Position) common.Digest {
+	digest, ok, err := c.cache.Get(c.ctx, pos)
+	if err != nil {
+		c.fail(err)
+		return nil
+	}
+	if !ok {
+		c.fail(fmt.Errorf("%w: %s", ErrMissingDigest, pos.StringId()))
+	}
+	return digest
 }
 
 type Pruner interface {
-	Prune() common.Visitable
+	Prune(ctx context.Context) (common.Visitable, error)
 }
 
 type InsertPruner struct {
@@ -19,21 +59,22 @@ type InsertPruner struct {
 	PruningContext
 }
 
-func NewInsertPruner(eventDigest common.Digest, context PruningContext) *InsertPruner {
-	return &InsertPruner{eventDigest, context}
+func NewInsertPruner(eventDigest common.Digest, pruning PruningContext) *InsertPruner {
+	return &InsertPruner{eventDigest, pruning}
 }
 
-func (p *InsertPruner) Prune() common.Visitable {
-	return p.traverse(p.navigator.Root(), p.eventDigest)
+func (p *InsertPruner) Prune(ctx context.Context) (common.Visitable, error) {
+	p.ctx = ctx
+	pruned := p.traverse(p.navigator.Root(), p.eventDigest)
+	return pruned, p.err
 }
 
 func (p *InsertPruner) traverse(pos common.Position, eventDigest common.Digest) common.Visitable {
+	if p.interrupted() {
+		return common.NewCached(pos, nil)
+	}
 	if p.cacheResolver.ShouldBeInCache(pos) {
-		digest, ok := p.cache.Get(pos)
-		if !ok {
-			panic("this digest should be in cache")
-		}
-		return common.NewCached(pos, digest)
+		return common.NewCached(pos, p.cached(pos))
 	}
 	if p.navigator.IsLeaf(pos) {
 		leaf := common.NewLeaf(pos, eventDigest)
@@ -65,21 +106,22 @@ type SearchPruner struct {
 	PruningContext
 }
 
-func NewSearchPruner(context PruningContext) *SearchPruner {
-	return &SearchPruner{context}
+func NewSearchPruner(pruning PruningContext) *SearchPruner {
+	return &SearchPruner{pruning}
 }
 
-func (p *SearchPruner) Prune() common.Visitable {
-	return p.traverse(p.navigator.Root())
+func (p *SearchPruner) Prune(ctx context.Context) (common.Visitable, error) {
+	p.ctx = ctx
+	pruned := p.traverse(p.navigator.Root())
+	return pruned, p.err
 }
 
 func (p *SearchPruner) traverse(pos common.Position) common.Visitable {
+	if p.interrupted() {
+		return common.NewCached(pos, nil)
+	}
 	if p.cacheResolver.ShouldBeInCache(pos) {
-		digest, ok := p.cache.Get(pos)
-		if !ok {
-			panic("this digest should be in cache")
-		}
-		return common.NewCacheable(pos, common.NewCached(pos, digest))
+		return common.NewCacheable(pos, common.NewCached(pos, p.cached(pos)))
 	}
 	if p.navigator.IsLeaf(pos) {
 		return common.NewLeaf(pos, nil)
@@ -102,19 +144,26 @@ type VerifyPruner struct {
 	PruningContext
 }
 
-func NewVerifyPruner(eventDigest common.Digest, context PruningContext) *VerifyPruner {
-	return &VerifyPruner{eventDigest, context}
+func NewVerifyPruner(eventDigest common.Digest, pruning PruningContext) *VerifyPruner {
+	return &VerifyPruner{eventDigest, pruning}
 }
 
-func (p *VerifyPruner) Prune() common.Visitable {
-	return p.traverse(p.navigator.Root(), p.eventDigest)
+func (p *VerifyPruner) Prune(ctx context.Context) (common.Visitable, error) {
+	p.ctx = ctx
+	pruned := p.traverse(p.navigator.Root(), p.eventDigest)
+	return pruned, p.err
 }
 
 func (p *VerifyPruner) traverse(pos common.Position, eventDigest common.Digest) common.Visitable {
+	if p.interrupted() {
+		return common.NewCached(pos, nil)
+	}
 	if p.cacheResolver.ShouldBeInCache(pos) {
-		digest, ok := p.cache.Get(pos)
-		if !ok {
-			panic("this digest should be in cache")
+		digest, ok, err := p.cache.Get(p.ctx, pos)
+		if err != nil {
+			p.fail(err)
+		} else if !ok {
+			p.fail(common.ErrIncompleteAuditPath)
 		}
 		return common.NewCached(pos, digest)
 	}
@@ -2,24 +2,83 @@ package history
 
 import (
 	"bytes"
-	"fmt"
+	"context"
 	"math"
 	"sync"
+	"time"
 
 	"github.com/aalda/trees/common"
 	"github.com/aalda/trees/log"
+	"github.com/aalda/trees/trace"
 )
 
 type HistoryTree struct {
-	lock   sync.RWMutex
-	frozen common.Store
-	cache  common.Cache
-	hasher common.Hasher
+	lock    sync.RWMutex
+	frozen  common.Store
+	cache   common.Cache
+	hasher  common.Hasher
+	metrics common.TreeMetrics
+	logger  *log.Logger
 }
 
 func NewHistoryTree(hasher common.Hasher, frozen common.Store, cache common.Cache) *HistoryTree {
 	var lock sync.RWMutex
-	return &HistoryTree{lock, frozen, cache, hasher}
+	return &HistoryTree{lock, frozen, cache, hasher, common.NoopTreeMetrics{}, log.Default().Named("history")}
+}
+
+func (t *HistoryTree) SetMetrics(metrics common.TreeMetrics) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.metrics = metrics
+}
+
+func (t *HistoryTree) SetLogger(logger *log.Logger) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.logger = logger
+}
+
+func (t *HistoryTree) observeLatency(operation string, start time.Time) {
+	t.metrics.ObserveLatency(operation, time.Since(start))
+}
+
+// prune fails if the pruner does or the context is done by the end of the
+// traversal, as the pruned tree may be incomplete.
+func (t *HistoryTree) prune(ctx context.Context, pruner Pruner) (common.Visitable, error) {
+	ctx, span := trace.Start(ctx, "history.Prune")
+	defer span.End()
+	pruned, err := pruner.Prune(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return pruned, nil
+}
+
+func (t *HistoryTree) visit(ctx context.Context, pruned common.Visitable, visitor common.PostOrderVisitor) interface{} {
+	_, span := trace.Start(ctx, "history.Visit")
+	defer span.End()
+	return pruned.PostOrder(visitor)
+}
+
+func (t *HistoryTree) mutate(ctx context.Context, mutations []common.Mutation) error {
+	ctx, span := trace.Start(ctx, "history.Mutate")
+	defer span.End()
+	span.SetAttribute("mutations", len(mutations))
+	return t.frozen.Mutate(ctx, mutations)
+}
+
+// debugPruned prints the pruned tree only if it is going to be logged, as
+// printing it visits the whole tree.
+func (t *HistoryTree) debugPruned(msg string, pruned common.Visitable, version uint64) {
+	if !t.logger.Enabled(log.DebugLevel) {
+		return
+	}
+	print := common.NewPrintVisitor(t.getDepth(version))
+	pruned.PreOrder(print)
+	t.logger.Debug(msg, log.String("tree", print.Result()))
 }
 
 func (t *HistoryTree) newRootPosition(version uint64) *HistoryPosition {
@@ -30,43 +89,55 @@ func (t *HistoryTree) getDepth(version uint64) uint16 {
 	return uint16(uint64(math.Ceil(math.Log2(float64(version + 1)))))
 }
 
-func (t *HistoryTree) Add(eventDigest common.Digest, version uint64) *common.Commitment {
+func (t *HistoryTree) Add(ctx context.Context, eventDigest common.Digest, version uint64) (*common.Commitment, error) {
 	t.lock.Lock()
 	defer t.lock.Unlock()
 
-	log.Debugf("Adding event %b with version %d\n", eventDigest, version)
+	defer t.observeLatency("add", time.Now())
+	ctx, span := trace.Start(ctx, "history.Add")
+	defer span.End()
+
+	t.logger.Debug("Adding event", log.Hex("event", eventDigest), log.Uint64("version", version))
 
 	// visitors
-	computeHash := common.NewComputeHashVisitor(t.hasher)
-	caching := common.NewCachingVisitor(computeHash)
+	computeHash := common.NewComputeHashVisitor(t.hasher, t.logger)
+	caching := common.NewCachingVisitor(computeHash, t.logger)
 
 	// build pruning context
-	context := PruningContext{
+	pruning := PruningContext{
 		navigator:     NewHistoryTreeNavigator(version),
 		cacheResolver: NewSingleTargetedCacheResolver(version),
 		cache:         t.cache,
 	}
 
 	// traverse from root and generate a visitable pruned tree
-	pruned := NewInsertPruner(eventDigest, context).Prune()
+	pruned, err := t.prune(ctx, NewInsertPruner(eventDigest, pruning))
+	if err != nil {
+		return nil, err
+	}
 
 	// print := common.NewPrintVisitor(t.getDepth(version))
 	// pruned.PreOrder(print)
-	// log.Debugf("Pruned tree: %s", print.Result())
+	// t.logger.Debug("Pruned tree", log.String("tree", print.Result()))
 
 	// visit the pruned tree
-	rh := pruned.PostOrder(caching).(common.Digest)
+	counting := common.NewCountingVisitor(caching)
+	rh := t.visit(ctx, pruned, counting).(common.Digest)
+	t.metrics.ObserveNodesVisited("add", counting.Result())
 
 	// persist mutations
 	cachedElements := caching.Result()
-	mutations := make([]common.Mutation, len(cachedElements))
+	mutations := make([]common.Mutation, 0, len(cachedElements))
 	for _, e := range cachedElements {
 		mutation := common.NewMutation(common.HistoryCachePrefix, e.Pos.Bytes(), e.Digest)
 		mutations = append(mutations, *mutation)
 	}
-	t.frozen.Mutate(mutations)
+	if err := t.mutate(ctx, mutations); err != nil {
+		return nil, err
+	}
+	t.metrics.ObserveMutations("add", len(mutations))
 
-	return common.NewCommitment(version, rh)
+	return common.NewCommitment(version, rh), nil
 }
 
 type MembershipProof struct {
@@ -77,14 +148,17 @@ func NewMembershipProof(path common.AuditPath) *MembershipProof {
 	return &MembershipProof{path}
 }
 
-func (t *HistoryTree) ProveMembership(index, version uint64) *MembershipProof {
+func (t *HistoryTree) ProveMembership(ctx context.Context, index, version uint64) (*MembershipProof, error) {
 	t.lock.Lock()
 	defer t.lock.Unlock()
-	log.Debugf("Proving membership for index %d with version %d", index, version)
+	defer t.observeLatency("prove_membership", time.Now())
+	ctx, span := trace.Start(ctx, "history.ProveMembership")
+	defer span.End()
+	t.logger.Debug("Proving membership", log.Uint64("index", index), log.Uint64("version", version))
 
 	// visitors
-	computeHash := common.NewComputeHashVisitor(t.hasher)
-	calcAuditPath := common.NewAuditPathVisitor(computeHash)
+	computeHash := common.NewComputeHashVisitor(t.hasher, t.logger)
+	calcAuditPath := common.NewAuditPathVisitor(computeHash, t.logger)
 
 	// build pruning context
 	var resolver CacheResolver
@@ -94,50 +168,76 @@ func (t *HistoryTree) ProveMembership(index, version uint64) *MembershipProof {
 	case false:
 		resolver = NewDoubleTargetedCacheResolver(index, version)
 	}
-	context := PruningContext{
+	pruning := PruningContext{
 		navigator:     NewHistoryTreeNavigator(version),
 		cacheResolver: resolver,
 		cache:         t.cache,
 	}
 
 	// traverse from root and generate a visitable pruned tree
-	pruned := NewSearchPruner(context).Prune()
+	pruned, err := t.prune(ctx, NewSearchPruner(pruning))
+	if err != nil {
+		return nil, err
+	}
 
-	print := common.NewPrintVisitor(t.getDepth(version))
-	pruned.PreOrder(print)
-	log.Debugf("Pruned tree: %s", print.Result())
+	t.debugPruned("Pruned tree", pruned, version)
 
 	// visit the pruned tree
-	pruned.PostOrder(calcAuditPath)
+	counting := common.NewCountingVisitor(calcAuditPath)
+	t.visit(ctx, pruned, counting)
+	t.metrics.ObserveNodesVisited("prove_membership", counting.Result())
+	t.metrics.ObserveAuditPathSize("prove_membership", len(calcAuditPath.Result()))
 
-	return NewMembershipProof(calcAuditPath.Result())
+	return NewMembershipProof(calcAuditPath.Result()), nil
 }
 
-func (t *HistoryTree) VerifyMembership(proof *MembershipProof, version uint64, eventDigest, expectedDigest common.Digest) bool {
+// VerifyMembership checks that the event added with the index is part of the
+// history committed by the version, as proven by ProveMembership. It fails
+// if the context is done before the digest is recomputed.
+//
+// The index tells which complete subtrees the audit path holds. Without it
+// the event was taken to be the last one of the version, so the membership
+// of any older event could not be verified. A proof of an index after the
+// version never verifies, as its audit path alone leads to the root.
+func (t *HistoryTree) VerifyMembership(ctx context.Context, proof *MembershipProof, index, version uint64, eventDigest, expectedDigest common.Digest) (bool, error) {
 	t.lock.Lock()
 	defer t.lock.Unlock()
-	log.Debugf("Verifying membership for version %d", version)
+	defer t.observeLatency("verify_membership", time.Now())
+	ctx, span := trace.Start(ctx, "history.VerifyMembership")
+	defer span.End()
+	t.logger.Debug("Verifying membership", log.Uint64("index", index), log.Uint64("version", version))
+
+	if index > version {
+		return false, nil
+	}
 
 	// visitors
-	computeHash := common.NewComputeHashVisitor(t.hasher)
+	computeHash := common.NewComputeHashVisitor(t.hasher, t.logger)
 
 	// build pruning context
-	context := PruningContext{
+	pruning := PruningContext{
 		navigator:     NewHistoryTreeNavigator(version),
-		cacheResolver: NewSingleTargetedCacheResolver(version),
+		cacheResolver: NewMembershipVerifyCacheResolver(index, version),
 		cache:         proof.AuditPath,
 	}
 
 	// traverse from root and generate a visitable pruned tree
-	pruned := NewVerifyPruner(eventDigest, context).Prune()
+	pruned, err := t.prune(ctx, NewVerifyPruner(eventDigest, pruning))
+	if err == common.ErrIncompleteAuditPath {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
 
-	print := common.NewPrintVisitor(t.getDepth(version))
-	pruned.PreOrder(print)
-	log.Debugf("Pruned tree: %s", print.Result())
+	t.debugPruned("Pruned tree", pruned, version)
 
 	// visit the pruned tree
-	recomputed := pruned.PostOrder(computeHash).(common.Digest)
-	return bytes.Equal(recomputed, expectedDigest)
+	counting := common.NewCountingVisitor(computeHash)
+	recomputed := t.visit(ctx, pruned, counting).(common.Digest)
+	t.metrics.ObserveNodesVisited("verify_membership", counting.Result())
+	t.metrics.ObserveAuditPathSize("verify_membership", len(proof.AuditPath))
+	return bytes.Equal(recomputed, expectedDigest), nil
 }
 
 type IncrementalProof struct {
@@ -148,69 +248,95 @@ func NewIncrementalProof(path common.AuditPath) *IncrementalProof {
 	return &IncrementalProof{path}
 }
 
-func (t *HistoryTree) ProveConsistency(start, end uint64) *IncrementalProof {
+func (t *HistoryTree) ProveConsistency(ctx context.Context, start, end uint64) (*IncrementalProof, error) {
 	t.lock.Lock()
 	defer t.lock.Unlock()
-	log.Debugf("Proving consistency between versions %d and %d", start, end)
+	defer t.observeLatency("prove_consistency", time.Now())
+	ctx, span := trace.Start(ctx, "history.ProveConsistency")
+	defer span.End()
+	t.logger.Debug("Proving consistency", log.Uint64("start", start), log.Uint64("end", end))
 
 	// visitors
-	computeHash := common.NewComputeHashVisitor(t.hasher)
-	calcAuditPath := common.NewAuditPathVisitor(computeHash)
+	computeHash := common.NewComputeHashVisitor(t.hasher, t.logger)
+	calcAuditPath := common.NewAuditPathVisitor(computeHash, t.logger)
 
 	// build pruning context
-	context := PruningContext{
+	pruning := PruningContext{
 		navigator:     NewHistoryTreeNavigator(end),
 		cacheResolver: NewIncrementalCacheResolver(start, end),
 		cache:         t.cache,
 	}
 
 	// traverse from root and generate a visitable pruned tree
-	pruned := NewSearchPruner(context).Prune()
+	pruned, err := t.prune(ctx, NewSearchPruner(pruning))
+	if err != nil {
+		return nil, err
+	}
 
-	print := common.NewPrintVisitor(t.getDepth(end))
-	pruned.PreOrder(print)
-	log.Debugf("Pruned tree: %s", print.Result())
+	t.debugPruned("Pruned tree", pruned, end)
 
 	// visit the pruned tree
-	pruned.PostOrder(calcAuditPath)
-	return NewIncrementalProof(calcAuditPath.Result())
+	counting := common.NewCountingVisitor(calcAuditPath)
+	t.visit(ctx, pruned, counting)
+	t.metrics.ObserveNodesVisited("prove_consistency", counting.Result())
+	t.metrics.ObserveAuditPathSize("prove_consistency", len(calcAuditPath.Result()))
+	return NewIncrementalProof(calcAuditPath.Result()), nil
 }
 
-func (t *HistoryTree) VerifyIncremental(proof *IncrementalProof, start, end uint64, startDigest, endDigest common.Digest) bool {
+// VerifyIncremental checks that the history committed by end extends the one
+// committed by start, as proven by ProveConsistency. The complete subtrees
+// ending at end are looked up in the audit path, where ProveConsistency puts
+// them as a single digest, so that proofs between versions that are not
+// consecutive verify too.
+func (t *HistoryTree) VerifyIncremental(ctx context.Context, proof *IncrementalProof, start, end uint64, startDigest, endDigest common.Digest) (bool, error) {
 
 	t.lock.Lock()
 	defer t.lock.Unlock()
-	log.Debugf("Verifying incremental between versions %d and %d", start, end)
+	defer t.observeLatency("verify_incremental", time.Now())
+	ctx, span := trace.Start(ctx, "history.VerifyIncremental")
+	defer span.End()
+	t.logger.Debug("Verifying incremental", log.Uint64("start", start), log.Uint64("end", end))
 
 	// visitors
-	computeHash := common.NewComputeHashVisitor(t.hasher)
+	computeHash := common.NewComputeHashVisitor(t.hasher, t.logger)
 
 	// build pruning context
 	startContext := PruningContext{
 		navigator:     NewHistoryTreeNavigator(start),
-		cacheResolver: NewIncrementalVerifyCacheResolver(start, end),
+		cacheResolver: NewIncrementalVerifyCacheResolver(start, end, proof.AuditPath),
 		cache:         proof.AuditPath,
 	}
 	endContext := PruningContext{
 		navigator:     NewHistoryTreeNavigator(end),
-		cacheResolver: NewIncrementalVerifyCacheResolver(start, end),
+		cacheResolver: NewIncrementalVerifyCacheResolver(start, end, proof.AuditPath),
 		cache:         proof.AuditPath,
 	}
 
 	// traverse from root and generate a visitable pruned tree
-	startPruned := NewVerifyPruner(startDigest, startContext).Prune()
-	endPruned := NewVerifyPruner(endDigest, endContext).Prune()
+	startPruned, err := t.prune(ctx, NewVerifyPruner(startDigest, startContext))
+	if err == common.ErrIncompleteAuditPath {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	endPruned, err := t.prune(ctx, NewVerifyPruner(endDigest, endContext))
+	if err == common.ErrIncompleteAuditPath {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
 
-	print := common.NewPrintVisitor(t.getDepth(end))
-	startPruned.PreOrder(print)
-	log.Debugf("Start pruned tree: %s", print.Result())
-	print = common.NewPrintVisitor(t.getDepth(end))
-	endPruned.PreOrder(print)
-	log.Debugf("End pruned tree: %s", print.Result())
+	t.debugPruned("Start pruned tree", startPruned, end)
+	t.debugPruned("End pruned tree", endPruned, end)
 
 	// visit the pruned trees
-	startRecomputed := startPruned.PostOrder(computeHash).(common.Digest)
-	endRecomputed := endPruned.PostOrder(computeHash).(common.Digest)
-	fmt.Println(startRecomputed, endRecomputed)
-	return bytes.Equal(startRecomputed, startDigest) && bytes.Equal(endRecomputed, endDigest)
+	counting := common.NewCountingVisitor(computeHash)
+	startRecomputed := t.visit(ctx, startPruned, counting).(common.Digest)
+	endRecomputed := t.visit(ctx, endPruned, counting).(common.Digest)
+	t.metrics.ObserveNodesVisited("verify_incremental", counting.Result())
+	t.metrics.ObserveAuditPathSize("verify_incremental", len(proof.AuditPath))
+	t.logger.Debug("Recomputed digests", log.Hex("start", startRecomputed), log.Hex("end", endRecomputed))
+	return bytes.Equal(startRecomputed, startDigest) && bytes.Equal(endRecomputed, endDigest), nil
 }
@@ -1,6 +1,8 @@
 package history
 
 import (
+	"context"
+	"errors"
 	"testing"
 
 	"github.com/aalda/trees/common"
@@ -13,6 +15,8 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+var ctx = context.Background()
+
 func TestAdd(t *testing.T) {
 
 	log.SetLogger("TestAdd", log.DEBUG)
@@ -39,12 +43,45 @@ func TestAdd(t *testing.T) {
 
 	for i, c := range testCases {
 		index := uint64(i)
-		commitment := tree.Add(c.eventDigest, index)
+		commitment, err := tree.Add(ctx, c.eventDigest, index)
+		require.NoError(t, err)
 		require.Equalf(t, c.expectedRootHash, commitment.Digest, "Incorrect root hash for index %d", i)
 	}
 
 }
 
+// recordingStore keeps the mutations written through it.
+type recordingStore struct {
+	common.Store
+	mutations []common.Mutation
+}
+
+func (s *recordingStore) Mutate(ctx context.Context, mutations []common.Mutation) error {
+	s.mutations = append(s.mutations, mutations...)
+	return s.Store.Mutate(ctx, mutations)
+}
+
+func TestAddOnlyWritesCachedNodes(t *testing.T) {
+
+	log.SetLogger("TestAddOnlyWritesCachedNodes", log.SILENT)
+
+	store := &recordingStore{Store: bplus.NewBPlusTreeStorage()}
+	tree := NewHistoryTree(new(common.XorHasher), store, common.NewPassThroughCache(common.HistoryCachePrefix, store))
+	for i := uint64(0); i < 10; i++ {
+		_, err := tree.Add(ctx, common.Digest{byte(i)}, i)
+		require.NoError(t, err)
+	}
+
+	require.NotEmpty(t, store.mutations)
+	for _, m := range store.mutations {
+		require.Equal(t, common.HistoryCachePrefix, m.Prefix, "Only cached nodes must be written")
+		require.NotEmpty(t, m.Key, "Mutations must have a key")
+	}
+	all, err := common.CollectRange(store.GetAll(ctx, common.VersionPrefix))
+	require.NoError(t, err)
+	require.Empty(t, all, "Nothing must be written under other prefixes")
+}
+
 func TestProveMembership(t *testing.T) {
 
 	log.SetLogger("TestProveMembership", log.DEBUG)
@@ -101,8 +138,10 @@ func TestProveMembership(t *testing.T) {
 
 	for i, c := range testCases {
 		index := uint64(i)
-		tree.Add(c.eventDigest, index)
-		pf := tree.ProveMembership(index, index)
+		_, err := tree.Add(ctx, c.eventDigest, index)
+		require.NoError(t, err)
+		pf, err := tree.ProveMembership(ctx, index, index)
+		require.NoError(t, err)
 		require.Equalf(t, c.auditPath, pf.AuditPath, "Incorrect audit path for index %d", i)
 	}
 }
@@ -118,11 +157,13 @@ func TestProveMembershipNonConsecutive(t *testing.T) {
 	// add nine events
 	for i := uint64(0); i < 9; i++ {
 		eventDigest := util.Uint64AsBytes(i)
-		tree.Add(eventDigest, i)
+		_, err := tree.Add(ctx, eventDigest, i)
+		require.NoError(t, err)
 	}
 
 	// query for membership with event 0 and version 8
-	proof := tree.ProveMembership(0, 8)
+	proof, err := tree.ProveMembership(ctx, 0, 8)
+	require.NoError(t, err)
 	expectedAuditPath := common.AuditPath{"1|0": common.Digest{0x1}, "2|1": common.Digest{0x1}, "4|2": common.Digest{0x0}, "8|0": common.Digest{0x8}}
 	assert.Equal(t, expectedAuditPath, proof.AuditPath, "Invalid audit path")
 }
@@ -195,7 +236,8 @@ func TestVerify(t *testing.T) {
 	for i, c := range testCases {
 		index := uint64(i)
 		proof := NewMembershipProof(c.auditPath)
-		correct := tree.VerifyMembership(proof, index, c.eventDigest, c.expectedDigest)
+		correct, err := tree.VerifyMembership(ctx, proof, index, index, c.eventDigest, c.expectedDigest)
+		require.NoError(t, err)
 		require.Truef(t, correct, "Event with index %d should be a member", index)
 	}
 
@@ -257,9 +299,11 @@ func TestProveConsistency(t *testing.T) {
 
 	for i, c := range testCases {
 		index := uint64(i)
-		tree.Add(c.eventDigest, index)
+		_, err := tree.Add(ctx, c.eventDigest, index)
+		require.NoError(t, err)
 
-		proof := tree.ProveConsistency(uint64(max(0, i-1)), index)
+		proof, err := tree.ProveConsistency(ctx, uint64(max(0, i-1)), index)
+		require.NoError(t, err)
 		require.Equal(t, c.auditPath, proof.AuditPath, "Invalid audit path in test case: %d", i)
 	}
 
@@ -276,11 +320,13 @@ func TestProveConsistencyNonConsecutive(t *testing.T) {
 	// add nine events
 	for i := uint64(0); i < 9; i++ {
 		eventDigest := util.Uint64AsBytes(i)
-		tree.Add(common.Digest(eventDigest), i)
+		_, err := tree.Add(ctx, common.Digest(eventDigest), i)
+		require.NoError(t, err)
 	}
 
 	// query for consistency with event 2 and version 8
-	proof := tree.ProveConsistency(uint64(2), uint64(8))
+	proof, err := tree.ProveConsistency(ctx, uint64(2), uint64(8))
+	require.NoError(t, err)
 	expectedAuditPath := common.AuditPath{
 		"0|1": common.Digest{0x1}, "2|0": common.Digest{0x2}, "3|0": common.Digest{0x3},
 		"4|2": common.Digest{0x0}, "8|0": common.Digest{0x8},
@@ -299,11 +345,13 @@ func TestProveConsistencySameVersions(t *testing.T) {
 	// add nine events
 	for i := uint64(0); i < 9; i++ {
 		eventDigest := util.Uint64AsBytes(i)
-		tree.Add(common.Digest(eventDigest), i)
+		_, err := tree.Add(ctx, common.Digest(eventDigest), i)
+		require.NoError(t, err)
 	}
 
 	// query for consistency with event 8 and version 8
-	proof := tree.ProveConsistency(uint64(8), uint64(8))
+	proof, err := tree.ProveConsistency(ctx, uint64(8), uint64(8))
+	require.NoError(t, err)
 	expectedAuditPath := common.AuditPath{"0|3": common.Digest{0x0}, "8|0": common.Digest{0x8}}
 	require.Equal(t, expectedAuditPath, proof.AuditPath, "Invalid audit path")
 }
@@ -358,7 +406,36 @@ func TestVerifyIncremental(t *testing.T) {
 
 	for _, c := range testCases {
 		proof := NewIncrementalProof(c.auditPath)
-		require.Truef(t, tree.VerifyIncremental(proof, c.start, c.end, c.startDigest, c.endDigest), "Events between %d and %d should be consistent", c.start, c.end)
+		verified, err := tree.VerifyIncremental(ctx, proof, c.start, c.end, c.startDigest, c.endDigest)
+		require.NoError(t, err)
+		require.Truef(t, verified, "Events between %d and %d should be consistent", c.start, c.end)
+	}
+}
+
+func TestAddAndVerifyBolt(t *testing.T) {
+
+	log.SetLogger("TestAddAndVerifyBolt", log.SILENT)
+
+	store, closeF := openBoltStore("/var/tmp/history_tree_test_bolt.db")
+	defer closeF()
+
+	cache := common.NewPassThroughCache(common.HistoryCachePrefix, store)
+	tree := NewHistoryTree(common.NewSha256Hasher(), store, cache)
+
+	commitments := make([]*common.Commitment, 0)
+	for i := uint64(0); i < 10; i++ {
+		commitment, err := tree.Add(ctx, util.Uint64AsBytes(i), i)
+		require.NoError(t, err)
+		commitments = append(commitments, commitment)
+	}
+
+	for i, c := range commitments {
+		index := uint64(i)
+		proof, err := tree.ProveMembership(ctx, index, index)
+		require.NoError(t, err)
+		correct, err := tree.VerifyMembership(ctx, proof, index, index, util.Uint64AsBytes(index), c.Digest)
+		require.NoError(t, err)
+		require.Truef(t, correct, "Event with index %d should be a member", index)
 	}
 }
 
@@ -372,6 +449,212 @@ func BenchmarkAdd(b *testing.B) {
 	b.ResetTimer()
 	for i := uint64(0); i < uint64(b.N); i++ {
 		key := rand.Bytes(64)
-		tree.Add(key, i)
+		tree.Add(ctx, key, i)
+	}
+}
+
+func BenchmarkAddBolt(b *testing.B) {
+	store, closeF := openBoltStore("/var/tmp/history_tree_test_bolt.db")
+	defer closeF()
+
+	cache := common.NewPassThroughCache(common.HistoryCachePrefix, store)
+	tree := NewHistoryTree(common.NewSha256Hasher(), store, cache)
+	b.ResetTimer()
+	for i := uint64(0); i < uint64(b.N); i++ {
+		key := rand.Bytes(64)
+		tree.Add(ctx, key, i)
+	}
+}
+
+func BenchmarkAddPebble(b *testing.B) {
+	store, closeF := openPebbleStore("/var/tmp/history_tree_test_pebble.db")
+	defer closeF()
+
+	cache := common.NewPassThroughCache(common.HistoryCachePrefix, store)
+	tree := NewHistoryTree(common.NewSha256Hasher(), store, cache)
+	b.ResetTimer()
+	for i := uint64(0); i < uint64(b.N); i++ {
+		key := rand.Bytes(64)
+		tree.Add(ctx, key, i)
+	}
+}
+
+func TestCancellation(t *testing.T) {
+
+	log.SetLogger("TestCancellation", log.DEBUG)
+
+	store := bplus.NewBPlusTreeStorage()
+	cache := common.NewPassThroughCache(common.HistoryCachePrefix, store)
+	tree := NewHistoryTree(new(common.XorHasher), store, cache)
+
+	for i := uint64(0); i < 4; i++ {
+		_, err := tree.Add(ctx, util.Uint64AsBytes(i), i)
+		require.NoError(t, err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err := tree.Add(cancelled, util.Uint64AsBytes(4), 4)
+	require.Equal(t, context.Canceled, err)
+	_, err = tree.ProveMembership(cancelled, 0, 3)
+	require.Equal(t, context.Canceled, err)
+	_, err = tree.ProveConsistency(cancelled, 1, 3)
+	require.Equal(t, context.Canceled, err)
+
+	commitment, err := tree.Add(ctx, util.Uint64AsBytes(4), 4)
+	require.NoError(t, err)
+	proof, err := tree.ProveMembership(ctx, 4, 4)
+	require.NoError(t, err)
+	verified, err := tree.VerifyMembership(ctx, proof, 4, 4, util.Uint64AsBytes(4), commitment.Digest)
+	require.NoError(t, err)
+	require.True(t, verified)
+	_, err = tree.VerifyMembership(cancelled, proof, 4, 4, util.Uint64AsBytes(4), commitment.Digest)
+	require.Equal(t, context.Canceled, err, "A cancelled verification should fail instead of reporting an invalid proof")
+}
+
+// cancellingStore cancels the operation reading through it, as a client
+// going away while its request is being served.
+type cancellingStore struct {
+	common.Store
+	cancel context.CancelFunc
+}
+
+func (s cancellingStore) Get(ctx context.Context, prefix byte, key []byte) (*common.KVPair, error) {
+	s.cancel()
+	return s.Store.Get(ctx, prefix, key)
+}
+
+func TestCacheReadFailures(t *testing.T) {
+
+	log.SetLogger("TestCacheReadFailures", log.SILENT)
+
+	store := bplus.NewBPlusTreeStorage()
+	tree := NewHistoryTree(new(common.XorHasher), store, common.NewPassThroughCache(common.HistoryCachePrefix, store))
+	for i := uint64(0); i < 8; i++ {
+		_, err := tree.Add(ctx, util.Uint64AsBytes(i), i)
+		require.NoError(t, err)
+	}
+
+	// cancelled between the check of the context and the read of the cache
+	cancelled, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cancelling := cancellingStore{store, cancel}
+	tree = NewHistoryTree(new(common.XorHasher), cancelling, common.NewPassThroughCache(common.HistoryCachePrefix, cancelling))
+	_, err := tree.ProveMembership(cancelled, 7, 7)
+	require.Equal(t, context.Canceled, err, "A cancelled read should fail the proof")
+
+	// a store that lost the cached digests
+	cached, err := common.CollectRange(store.GetAll(ctx, common.HistoryCachePrefix))
+	require.NoError(t, err)
+	for _, pair := range cached {
+		require.NoError(t, store.Mutate(ctx, []common.Mutation{*common.NewDeleteMutation(common.HistoryCachePrefix, pair.Key)}))
+	}
+	tree = NewHistoryTree(new(common.XorHasher), store, common.NewPassThroughCache(common.HistoryCachePrefix, store))
+	_, err = tree.ProveMembership(ctx, 7, 7)
+	require.True(t, errors.Is(err, ErrMissingDigest), "A missing digest should fail the proof: %v", err)
+	_, err = tree.Add(ctx, util.Uint64AsBytes(8), 8)
+	require.True(t, errors.Is(err, ErrMissingDigest), "A missing digest should fail the addition: %v", err)
+}
+
+func TestVerifyIncompleteAuditPath(t *testing.T) {
+
+	log.SetLogger("TestVerifyIncompleteAuditPath", log.SILENT)
+
+	store := bplus.NewBPlusTreeStorage()
+	tree := NewHistoryTree(common.NewSha256Hasher(), store, common.NewPassThroughCache(common.HistoryCachePrefix, store))
+	digests := make([]common.Digest, 4)
+	for i := uint64(0); i < 4; i++ {
+		commitment, err := tree.Add(ctx, util.Uint64AsBytes(i), i)
+		require.NoError(t, err)
+		digests[i] = commitment.Digest
+	}
+
+	verified, err := tree.VerifyMembership(ctx, NewMembershipProof(common.AuditPath{}), 1, 3, util.Uint64AsBytes(1), digests[3])
+	require.NoError(t, err)
+	assert.False(t, verified, "A membership proof without audit path should not verify")
+
+	verified, err = tree.VerifyIncremental(ctx, NewIncrementalProof(common.AuditPath{}), 1, 3, digests[1], digests[3])
+	require.NoError(t, err)
+	assert.False(t, verified, "A consistency proof without audit path should not verify")
+}
+
+func TestVerifyNonConsecutive(t *testing.T) {
+
+	log.SetLogger("TestVerifyNonConsecutive", log.DEBUG)
+
+	store := bplus.NewBPlusTreeStorage()
+	cache := common.NewPassThroughCache(common.HistoryCachePrefix, store)
+	tree := NewHistoryTree(common.NewSha256Hasher(), store, cache)
+
+	var last *common.Commitment
+	for i := uint64(0); i < 10; i++ {
+		commitment, err := tree.Add(ctx, util.Uint64AsBytes(i), i)
+		require.NoError(t, err)
+		last = commitment
+	}
+
+	for index := uint64(0); index < 10; index++ {
+		proof, err := tree.ProveMembership(ctx, index, 9)
+		require.NoError(t, err)
+		correct, err := tree.VerifyMembership(ctx, proof, index, 9, util.Uint64AsBytes(index), last.Digest)
+		require.NoError(t, err)
+		require.Truef(t, correct, "Event with index %d should be a member of version 9", index)
+		wrong, err := tree.VerifyMembership(ctx, proof, index, 9, util.Uint64AsBytes(index+1), last.Digest)
+		require.NoError(t, err)
+		require.Falsef(t, wrong, "Event with index %d should not verify with another digest", index)
+	}
+}
+
+func TestVerifyIncrementalNonConsecutive(t *testing.T) {
+
+	log.SetLogger("TestVerifyIncrementalNonConsecutive", log.DEBUG)
+
+	store := bplus.NewBPlusTreeStorage()
+	cache := common.NewPassThroughCache(common.HistoryCachePrefix, store)
+	tree := NewHistoryTree(common.NewSha256Hasher(), store, cache)
+
+	digests := make([]common.Digest, 10)
+	for i := uint64(0); i < 10; i++ {
+		commitment, err := tree.Add(ctx, util.Uint64AsBytes(i), i)
+		require.NoError(t, err)
+		digests[i] = commitment.Digest
+	}
+
+	for end := uint64(0); end < 10; end++ {
+		for start := uint64(0); start <= end; start++ {
+			proof, err := tree.ProveConsistency(ctx, start, end)
+			require.NoError(t, err)
+			correct, err := tree.VerifyIncremental(ctx, proof, start, end, digests[start], digests[end])
+			require.NoError(t, err)
+			require.Truef(t, correct, "Events between %d and %d should be consistent", start, end)
+		}
+	}
+}
+
+func TestVerifyIndexAfterVersion(t *testing.T) {
+
+	log.SetLogger("TestVerifyIndexAfterVersion", log.SILENT)
+
+	store := bplus.NewBPlusTreeStorage()
+	tree := NewHistoryTree(common.NewSha256Hasher(), store, common.NewPassThroughCache(common.HistoryCachePrefix, store))
+	var last *common.Commitment
+	for i := uint64(0); i < 5; i++ {
+		commitment, err := tree.Add(ctx, util.Uint64AsBytes(i), i)
+		require.NoError(t, err)
+		last = commitment
+	}
+
+	// a proof of a later index made of digests copied from honest proofs,
+	// which leads to the root without the event
+	forged := common.AuditPath{}
+	for _, index := range []uint64{3, 4} {
+		proof, err := tree.ProveMembership(ctx, index, 4)
+		require.NoError(t, err)
+		for id, digest := range proof.AuditPath {
+			forged[id] = digest
+		}
 	}
+	verified, err := tree.VerifyMembership(ctx, NewMembershipProof(forged), 5, 4, []byte("forged"), last.Digest)
+	require.NoError(t, err)
+	assert.False(t, verified, "An index after the version should not verify")
 }
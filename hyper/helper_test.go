@@ -0,0 +1,50 @@
+package hyper
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/aalda/trees/storage/badger"
+	"github.com/aalda/trees/storage/bolt"
+	"github.com/aalda/trees/storage/pebble"
+)
+
+func openBadgerStore(path string) (*badger.BadgerStore, func()) {
+	store, err := badger.NewBadgerStore(path)
+	if err != nil {
+		panic(fmt.Sprintf("Unable to open badger store: %s", err))
+	}
+	return store, func() {
+		store.Close()
+		deleteFile(path)
+	}
+}
+
+func openBoltStore(path string) (*bolt.BoltStore, func()) {
+	store, err := bolt.NewBoltStore(path)
+	if err != nil {
+		panic(fmt.Sprintf("Unable to open bolt store: %s", err))
+	}
+	return store, func() {
+		store.Close()
+		deleteFile(path)
+	}
+}
+
+func openPebbleStore(path string) (*pebble.PebbleStore, func()) {
+	store, err := pebble.NewPebbleStore(path)
+	if err != nil {
+		panic(fmt.Sprintf("Unable to open pebble store: %s", err))
+	}
+	return store, func() {
+		store.Close()
+		deleteFile(path)
+	}
+}
+
+func deleteFile(path string) {
+	err := os.RemoveAll(path)
+	if err != nil {
+		fmt.Printf("Unable to remove db file %s", err)
+	}
+}
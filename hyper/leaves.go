@@ -0,0 +1,90 @@
+package hyper
+
+import (
+	"bytes"
+
+	"github.com/aalda/trees/common"
+)
+
+// leafCursor merges the leaves stored under a subtree with the pending ones,
+// yielding them in key order. A pending leaf overwrites the stored one with
+// the same key, and the removed key, if any, is skipped.
+type leafCursor struct {
+	stored    common.KVIterator
+	hasStored bool
+	pending   common.KVRange
+	removed   []byte
+	err       error
+}
+
+func newLeafCursor(stored common.KVIterator, pending common.KVRange, removed []byte) *leafCursor {
+	c := &leafCursor{stored: stored, pending: pending, removed: removed}
+	c.advanceStored()
+	return c
+}
+
+func (c *leafCursor) advanceStored() {
+	for c.hasStored = c.stored.Next(); c.hasStored; c.hasStored = c.stored.Next() {
+		if c.removed == nil || !bytes.Equal(c.stored.Pair().Key, c.removed) {
+			return
+		}
+	}
+	c.err = c.stored.Err()
+}
+
+// Err returns the error that stopped the stored leaves, if any. The leaves
+// yielded until then are incomplete, so the subtree must not be used.
+func (c *leafCursor) Err() error {
+	return c.err
+}
+
+// Peek returns the next leaf without consuming it.
+func (c *leafCursor) Peek() (common.KVPair, bool) {
+	switch {
+	case !c.hasStored && len(c.pending) == 0:
+		return common.KVPair{}, false
+	case !c.hasStored:
+		return c.pending[0], true
+	case len(c.pending) == 0:
+		return c.stored.Pair(), true
+	}
+	if bytes.Compare(c.pending[0].Key, c.stored.Pair().Key) <= 0 {
+		return c.pending[0], true
+	}
+	return c.stored.Pair(), true
+}
+
+// Pop consumes the next leaf.
+func (c *leafCursor) Pop() common.KVPair {
+	if !c.hasStored {
+		next := c.pending[0]
+		c.pending = c.pending[1:]
+		return next
+	}
+	stored := c.stored.Pair()
+	if len(c.pending) == 0 {
+		c.advanceStored()
+		return stored
+	}
+	switch cmp := bytes.Compare(c.pending[0].Key, stored.Key); {
+	case cmp < 0:
+		next := c.pending[0]
+		c.pending = c.pending[1:]
+		return next
+	case cmp == 0:
+		next := c.pending[0]
+		c.pending = c.pending[1:]
+		c.advanceStored()
+		return next
+	default:
+		c.advanceStored()
+		return stored
+	}
+}
+
+// HasUntil tells whether there is any leaf left with a key lower than or
+// equal to the given one.
+func (c *leafCursor) HasUntil(key []byte) bool {
+	next, ok := c.Peek()
+	return ok && bytes.Compare(next.Key, key) <= 0
+}
@@ -1,19 +1,106 @@
 package hyper
 
 import (
+	"context"
+
 	"github.com/aalda/trees/common"
+	"github.com/aalda/trees/log"
+	"github.com/aalda/trees/trace"
 )
 
+// PruningContext holds what the pruners share. Its context is the one given
+// to Prune.
 type PruningContext struct {
+	ctx           context.Context
 	navigator     common.TreeNavigator
 	cacheResolver CacheResolver
 	cache         common.Cache
 	store         common.Store
+	hasher        common.Hasher
 	defaultHashes []common.Digest
+	logger        *log.Logger
+	err           error
+	collapsed     int
+}
+
+// interrupted reports whether the operation has been cancelled or has failed
+// reading the store, in which case the pruners stop descending. The pruned
+// tree is then incomplete and must be discarded.
+func (c PruningContext) interrupted() bool {
+	return c.err != nil || c.ctx.Err() != nil
+}
+
+// fail keeps the first error found while pruning, which is returned by Prune.
+func (c *PruningContext) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// cached reads the digest of the node from the cache, or the default hash of
+// an empty subtree when the cache does not hold it. A failed read fails the
+// pruning, as taking it for an empty subtree would change the root.
+func (c *PruningContext) cached(pos common.Position) common.Digest {
+	digest, ok, err := c.cache.Get(c.ctx, pos)
+	if err != nil {
+		c.fail(err)
+		return nil
+	}
+	if !ok {
+		return c.defaultHashes[pos.Height()]
+	}
+	return digest
+}
+
+// fromAuditPath reads the digest of the node from the audit path of the
+// proof being verified, failing if it is not there.
+func (c *PruningContext) fromAuditPath(pos common.Position) common.Digest {
+	digest, ok, err := c.cache.Get(c.ctx, pos)
+	if err != nil {
+		c.fail(err)
+	} else if !ok {
+		c.fail(common.ErrIncompleteAuditPath)
+	}
+	return digest
+}
+
+// collapse replaces a subtree without cacheable nodes by its digest, so that
+// the pruned tree holds one node per level while streaming the leaves under
+// the cache level instead of all of them. The nodes hashed here are counted
+// in Collapsed, as they never reach the visitors of the pruned tree.
+func (c *PruningContext) collapse(pos common.Position, subtree common.Visitable) common.Visitable {
+	if _, ok := subtree.(*common.Cached); ok {
+		return subtree
+	}
+	counting := common.NewCountingVisitor(common.NewComputeHashVisitor(c.hasher, c.logger))
+	digest := subtree.PostOrder(counting).(common.Digest)
+	// the subtree root is visited again as the cached node replacing it
+	c.collapsed += counting.Result() - 1
+	return common.NewCached(pos, digest)
+}
+
+// Collapsed returns the number of nodes hashed while pruning, which are not
+// part of the pruned tree.
+func (c PruningContext) Collapsed() int {
+	return c.collapsed
+}
+
+// leavesUnder streams the stored leaves of the subtree rooted at the given
+// position merged with the pending ones.
+func (c PruningContext) leavesUnder(pos common.Position, pending common.KVRange, removed []byte) (*leafCursor, func() error) {
+	first := c.navigator.DescendToFirst(pos)
+	last := c.navigator.DescendToLast(pos)
+	ctx, span := trace.Start(c.ctx, "hyper.RangeQuery")
+	it := c.store.Iterate(ctx, common.IndexPrefix, first.Index(), last.Index())
+	return newLeafCursor(it, pending, removed), func() error {
+		defer span.End()
+		return it.Close()
+	}
 }
 
 type Pruner interface {
-	Prune() common.Visitable
+	Prune(ctx context.Context) (common.Visitable, error)
+	Collapsed() int
 }
 
 type InsertPruner struct {
@@ -22,37 +109,32 @@ type InsertPruner struct {
 	PruningContext
 }
 
-func NewInsertPruner(key, value []byte, context PruningContext) *InsertPruner {
-	return &InsertPruner{key, value, context}
+func NewInsertPruner(key, value []byte, pruning PruningContext) *InsertPruner {
+	return &InsertPruner{key, value, pruning}
 }
 
-func (p *InsertPruner) Prune() common.Visitable {
+func (p *InsertPruner) Prune(ctx context.Context) (common.Visitable, error) {
+	p.ctx = ctx
 	leaves := common.KVRange{common.NewKVPair(p.key, p.value)}
-	return p.traverse(p.navigator.Root(), leaves)
+	pruned := p.traverse(p.navigator.Root(), leaves)
+	return pruned, p.err
 }
 
 func (p *InsertPruner) traverse(pos common.Position, leaves common.KVRange) common.Visitable {
+	if p.interrupted() {
+		return common.NewCached(pos, nil)
+	}
 	if p.cacheResolver.ShouldBeInCache(pos) {
-		digest, ok := p.cache.Get(pos)
-		if !ok {
-			return common.NewCached(pos, p.defaultHashes[pos.Height()])
-		}
-		return common.NewCached(pos, digest)
+		return common.NewCached(pos, p.cached(pos))
 	}
 
-	// if we are over the cache level, we need to do a range query to get the leaves
+	// if we are over the cache level, we need to stream the leaves below
 	if !p.cacheResolver.ShouldCache(pos) {
-		first := p.navigator.DescendToFirst(pos)
-		last := p.navigator.DescendToLast(pos)
-		kvRange, _ := p.store.GetRange(common.IndexPrefix, first.Index(), last.Index())
-
-		// replace leaves with new slice and append the previous to the new one
-		for _, l := range leaves {
-			kvRange = kvRange.InsertSorted(l)
-		}
-		leaves = kvRange
-
-		return p.traverseWithoutCache(pos, leaves)
+		cursor, closeF := p.leavesUnder(pos, leaves, nil)
+		pruned := p.traverseWithoutCache(pos, cursor)
+		p.fail(cursor.Err())
+		p.fail(closeF())
+		return pruned
 	}
 
 	rightPos := p.navigator.GoToRight(pos)
@@ -65,24 +147,87 @@ func (p *InsertPruner) traverse(pos common.Position, leaves common.KVRange) comm
 	return common.NewCacheable(pos, common.NewNode(pos, left, right))
 }
 
-func (p *InsertPruner) traverseWithoutCache(pos common.Position, leaves common.KVRange) common.Visitable {
-	if p.navigator.IsLeaf(pos) && len(leaves) == 1 {
-		return common.NewLeaf(pos, leaves[0].Value)
+func (p *InsertPruner) traverseWithoutCache(pos common.Position, leaves *leafCursor) common.Visitable {
+	if p.interrupted() {
+		return common.NewCached(pos, nil)
 	}
-	if !p.navigator.IsRoot(pos) && len(leaves) == 0 {
+	last := p.navigator.DescendToLast(pos)
+	if !p.navigator.IsRoot(pos) && !leaves.HasUntil(last.Index()) {
 		return common.NewCached(pos, p.defaultHashes[pos.Height()])
 	}
-	if len(leaves) > 1 && p.navigator.IsLeaf(pos) {
-		panic("this should never happen (unsorted LeavesSlice or broken split?)")
+	if p.navigator.IsLeaf(pos) {
+		return common.NewLeaf(pos, leaves.Pop().Value)
 	}
 
 	// we do a post-order traversal
+	leftPos := p.navigator.GoToLeft(pos)
+	rightPos := p.navigator.GoToRight(pos)
+	left := p.collapse(leftPos, p.traverseWithoutCache(leftPos, leaves))
+	right := p.collapse(rightPos, p.traverseWithoutCache(rightPos, leaves))
+	if p.navigator.IsRoot(pos) {
+		return common.NewRoot(pos, left, right)
+	}
+	return common.NewNode(pos, left, right)
+}
 
-	// split leaves
+type RemovePruner struct {
+	key common.Digest
+	PruningContext
+}
+
+func NewRemovePruner(key []byte, pruning PruningContext) *RemovePruner {
+	return &RemovePruner{key, pruning}
+}
+
+func (p *RemovePruner) Prune(ctx context.Context) (common.Visitable, error) {
+	p.ctx = ctx
+	pruned := p.traverse(p.navigator.Root())
+	return pruned, p.err
+}
+
+func (p *RemovePruner) traverse(pos common.Position) common.Visitable {
+	if p.interrupted() {
+		return common.NewCached(pos, nil)
+	}
+	if p.cacheResolver.ShouldBeInCache(pos) {
+		return common.NewCached(pos, p.cached(pos))
+	}
+
+	// if we are over the cache level, we need to stream the leaves below
+	// skipping the removed one so its position falls back to the default hash
+	if !p.cacheResolver.ShouldCache(pos) {
+		cursor, closeF := p.leavesUnder(pos, nil, p.key)
+		pruned := p.traverseWithoutCache(pos, cursor)
+		p.fail(cursor.Err())
+		p.fail(closeF())
+		return pruned
+	}
+
+	left := p.traverse(p.navigator.GoToLeft(pos))
+	right := p.traverse(p.navigator.GoToRight(pos))
+	if p.navigator.IsRoot(pos) {
+		return common.NewRoot(pos, left, right)
+	}
+	return common.NewCacheable(pos, common.NewNode(pos, left, right))
+}
+
+func (p *RemovePruner) traverseWithoutCache(pos common.Position, leaves *leafCursor) common.Visitable {
+	if p.interrupted() {
+		return common.NewCached(pos, nil)
+	}
+	last := p.navigator.DescendToLast(pos)
+	if !p.navigator.IsRoot(pos) && !leaves.HasUntil(last.Index()) {
+		return common.NewCached(pos, p.defaultHashes[pos.Height()])
+	}
+	if p.navigator.IsLeaf(pos) {
+		return common.NewLeaf(pos, leaves.Pop().Value)
+	}
+
+	// we do a post-order traversal
+	leftPos := p.navigator.GoToLeft(pos)
 	rightPos := p.navigator.GoToRight(pos)
-	leftSlice, rightSlice := leaves.Split(rightPos.Index())
-	left := p.traverseWithoutCache(p.navigator.GoToLeft(pos), leftSlice)
-	right := p.traverseWithoutCache(rightPos, rightSlice)
+	left := p.collapse(leftPos, p.traverseWithoutCache(leftPos, leaves))
+	right := p.collapse(rightPos, p.traverseWithoutCache(rightPos, leaves))
 	if p.navigator.IsRoot(pos) {
 		return common.NewRoot(pos, left, right)
 	}
@@ -94,105 +239,96 @@ type SearchPruner struct {
 	PruningContext
 }
 
-func NewSearchPruner(key []byte, context PruningContext) *SearchPruner {
-	return &SearchPruner{key, context}
+func NewSearchPruner(key []byte, pruning PruningContext) *SearchPruner {
+	return &SearchPruner{key, pruning}
 }
 
-func (p *SearchPruner) Prune() common.Visitable {
-	return p.traverseCache(p.navigator.Root(), common.NewKVRange())
+func (p *SearchPruner) Prune(ctx context.Context) (common.Visitable, error) {
+	p.ctx = ctx
+	pruned := p.traverseCache(p.navigator.Root())
+	return pruned, p.err
 }
 
-func (p *SearchPruner) traverseCache(pos common.Position, leaves common.KVRange) common.Visitable {
+func (p *SearchPruner) traverseCache(pos common.Position) common.Visitable {
+	if p.interrupted() {
+		return common.NewCached(pos, nil)
+	}
 	if p.cacheResolver.ShouldBeInCache(pos) {
-		digest, ok := p.cache.Get(pos)
-		if !ok {
-			cached := common.NewCached(pos, p.defaultHashes[pos.Height()])
-			return common.NewCacheable(pos, cached)
-		}
-		return common.NewCacheable(pos, common.NewCached(pos, digest))
+		return common.NewCacheable(pos, common.NewCached(pos, p.cached(pos)))
 	}
 
-	// if we are over the cache level, we need to do a range query to get the leaves
+	// if we are over the cache level, we need to stream the leaves below
 	if !p.cacheResolver.ShouldCache(pos) {
-		first := p.navigator.DescendToFirst(pos)
-		last := p.navigator.DescendToLast(pos)
-		kvRange, _ := p.store.GetRange(common.IndexPrefix, first.Index(), last.Index())
-
-		// replace leaves with new slice and append the previous to the new one
-		for _, l := range leaves {
-			kvRange = kvRange.InsertSorted(l)
-		}
-		leaves = kvRange
-		return p.traverse(pos, leaves)
+		cursor, closeF := p.leavesUnder(pos, nil, nil)
+		pruned := p.traverse(pos, cursor)
+		p.fail(cursor.Err())
+		p.fail(closeF())
+		return pruned
 	}
 
-	rightPos := p.navigator.GoToRight(pos)
-	leftSlice, rightSlice := leaves.Split(rightPos.Index())
-	left := p.traverseCache(p.navigator.GoToLeft(pos), leftSlice)
-	right := p.traverseCache(rightPos, rightSlice)
+	left := p.traverseCache(p.navigator.GoToLeft(pos))
+	right := p.traverseCache(p.navigator.GoToRight(pos))
 	if p.navigator.IsRoot(pos) {
 		return common.NewRoot(pos, left, right)
 	}
 	return common.NewNode(pos, left, right)
 }
 
-func (p *SearchPruner) traverse(pos common.Position, leaves common.KVRange) common.Visitable {
-	if p.navigator.IsLeaf(pos) && len(leaves) == 1 {
-		leaf := common.NewLeaf(pos, leaves[0].Value)
-		if !p.cacheResolver.IsOnPath(pos) {
-			return common.NewCacheable(pos, leaf)
-		}
-		return leaf
+func (p *SearchPruner) traverse(pos common.Position, leaves *leafCursor) common.Visitable {
+	if p.interrupted() {
+		return common.NewCached(pos, nil)
 	}
-	if !p.navigator.IsRoot(pos) && len(leaves) == 0 {
+	last := p.navigator.DescendToLast(pos)
+	if !p.navigator.IsRoot(pos) && !leaves.HasUntil(last.Index()) {
 		cached := common.NewCached(pos, p.defaultHashes[pos.Height()])
 		return common.NewCacheable(pos, cached)
 	}
-	if len(leaves) > 1 && p.navigator.IsLeaf(pos) {
-		panic("this should never happen (unsorted LeavesSlice or broken split?)")
+	if p.navigator.IsLeaf(pos) {
+		leaf := common.NewLeaf(pos, leaves.Pop().Value)
+		if !p.cacheResolver.IsOnPath(pos) {
+			return common.NewCacheable(pos, leaf)
+		}
+		return leaf
 	}
 
 	// we do a post-order traversal
-
-	// split leaves
+	leftPos := p.navigator.GoToLeft(pos)
 	rightPos := p.navigator.GoToRight(pos)
-	leftSlice, rightSlice := leaves.Split(rightPos.Index())
 
 	if !p.cacheResolver.IsOnPath(pos) {
-		left := p.traverseWithoutCaching(p.navigator.GoToLeft(pos), leftSlice)
-		right := p.traverseWithoutCaching(rightPos, rightSlice)
+		left := p.collapse(leftPos, p.traverseWithoutCaching(leftPos, leaves))
+		right := p.collapse(rightPos, p.traverseWithoutCaching(rightPos, leaves))
 		if p.navigator.IsRoot(pos) {
 			return common.NewRoot(pos, left, right)
 		}
 		return common.NewCacheable(pos, common.NewNode(pos, left, right))
 	}
 
-	left := p.traverse(p.navigator.GoToLeft(pos), leftSlice)
-	right := p.traverse(rightPos, rightSlice)
+	left := p.traverse(leftPos, leaves)
+	right := p.traverse(rightPos, leaves)
 	if p.navigator.IsRoot(pos) {
 		return common.NewRoot(pos, left, right)
 	}
 	return common.NewNode(pos, left, right)
 }
 
-func (p *SearchPruner) traverseWithoutCaching(pos common.Position, leaves common.KVRange) common.Visitable {
-	if p.navigator.IsLeaf(pos) && len(leaves) == 1 {
-		return common.NewLeaf(pos, leaves[0].Value)
+func (p *SearchPruner) traverseWithoutCaching(pos common.Position, leaves *leafCursor) common.Visitable {
+	if p.interrupted() {
+		return common.NewCached(pos, nil)
 	}
-	if !p.navigator.IsRoot(pos) && len(leaves) == 0 {
+	last := p.navigator.DescendToLast(pos)
+	if !p.navigator.IsRoot(pos) && !leaves.HasUntil(last.Index()) {
 		return common.NewCached(pos, p.defaultHashes[pos.Height()])
 	}
-	if len(leaves) > 1 && p.navigator.IsLeaf(pos) {
-		panic("this should never happen (unsorted LeavesSlice or broken split?)")
+	if p.navigator.IsLeaf(pos) {
+		return common.NewLeaf(pos, leaves.Pop().Value)
 	}
 
 	// we do a post-order traversal
-
-	// split leaves
+	leftPos := p.navigator.GoToLeft(pos)
 	rightPos := p.navigator.GoToRight(pos)
-	leftSlice, rightSlice := leaves.Split(rightPos.Index())
-	left := p.traverseWithoutCaching(p.navigator.GoToLeft(pos), leftSlice)
-	right := p.traverseWithoutCaching(rightPos, rightSlice)
+	left := p.collapse(leftPos, p.traverseWithoutCaching(leftPos, leaves))
+	right := p.collapse(rightPos, p.traverseWithoutCaching(rightPos, leaves))
 	if p.navigator.IsRoot(pos) {
 		return common.NewRoot(pos, left, right)
 	}
@@ -205,25 +341,26 @@ type VerifyPruner struct {
 	PruningContext
 }
 
-func NewVerifyPruner(key, value []byte, context PruningContext) *VerifyPruner {
-	return &VerifyPruner{key, value, context}
+func NewVerifyPruner(key, value []byte, pruning PruningContext) *VerifyPruner {
+	return &VerifyPruner{key, value, pruning}
 }
 
-func (p *VerifyPruner) Prune() common.Visitable {
+func (p *VerifyPruner) Prune(ctx context.Context) (common.Visitable, error) {
+	p.ctx = ctx
 	leaves := common.KVRange{common.NewKVPair(p.key, p.value)}
-	return p.traverse(p.navigator.Root(), leaves)
+	pruned := p.traverse(p.navigator.Root(), leaves)
+	return pruned, p.err
 }
 
 func (p *VerifyPruner) traverse(pos common.Position, leaves common.KVRange) common.Visitable {
+	if p.interrupted() {
+		return common.NewCached(pos, nil)
+	}
 	if p.navigator.IsLeaf(pos) && len(leaves) == 1 {
 		return common.NewLeaf(pos, leaves[0].Value)
 	}
 	if !p.navigator.IsRoot(pos) && len(leaves) == 0 {
-		digest, ok := p.cache.Get(pos)
-		if !ok {
-			panic("this should never happen (wrong audit path)")
-		}
-		return common.NewCached(pos, digest)
+		return common.NewCached(pos, p.fromAuditPath(pos))
 	}
 	if len(leaves) > 1 && p.navigator.IsLeaf(pos) {
 		panic("this should never happen (unsorted LeavesSlice or broken split?)")
@@ -241,3 +378,46 @@ func (p *VerifyPruner) traverse(pos common.Position, leaves common.KVRange) comm
 	}
 	return common.NewNode(pos, left, right)
 }
+
+type VerifyAbsencePruner struct {
+	key common.Digest
+	PruningContext
+}
+
+func NewVerifyAbsencePruner(key []byte, pruning PruningContext) *VerifyAbsencePruner {
+	return &VerifyAbsencePruner{key, pruning}
+}
+
+func (p *VerifyAbsencePruner) Prune(ctx context.Context) (common.Visitable, error) {
+	p.ctx = ctx
+	pruned := p.traverse(p.navigator.Root())
+	return pruned, p.err
+}
+
+func (p *VerifyAbsencePruner) traverse(pos common.Position) common.Visitable {
+	if p.interrupted() {
+		return common.NewCached(pos, nil)
+	}
+	if !p.navigator.IsRoot(pos) && !p.cacheResolver.IsOnPath(pos) {
+		return common.NewCached(pos, p.fromAuditPath(pos))
+	}
+
+	// the first empty subtree on the path must hash to the default
+	// value, whatever digest the audit path says it has
+	_, ok, err := p.cache.Get(p.ctx, pos)
+	if err != nil {
+		p.fail(err)
+		return common.NewCached(pos, nil)
+	}
+	if (ok && !p.navigator.IsRoot(pos)) || p.navigator.IsLeaf(pos) {
+		return common.NewCached(pos, p.defaultHashes[pos.Height()])
+	}
+
+	// we do a post-order traversal
+	left := p.traverse(p.navigator.GoToLeft(pos))
+	right := p.traverse(p.navigator.GoToRight(pos))
+	if p.navigator.IsRoot(pos) {
+		return common.NewRoot(pos, left, right)
+	}
+	return common.NewNode(pos, left, right)
+}
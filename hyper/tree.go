@@ -2,10 +2,16 @@ package hyper
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"sync"
+	"time"
 
 	"github.com/aalda/trees/common"
 	"github.com/aalda/trees/log"
+	"github.com/aalda/trees/trace"
 	"github.com/aalda/trees/util"
 )
 
@@ -16,6 +22,8 @@ type HyperTree struct {
 	hasher        common.Hasher
 	cacheLevel    uint16
 	defaultHashes []common.Digest
+	metrics       common.TreeMetrics
+	logger        *log.Logger
 }
 
 func NewHyperTree(hasher common.Hasher, store common.Store, cache common.ModifiableCache, cacheLevel uint16) *HyperTree {
@@ -27,6 +35,8 @@ func NewHyperTree(hasher common.Hasher, store common.Store, cache common.Modifia
 		hasher:        hasher,
 		cacheLevel:    cacheLevel,
 		defaultHashes: make([]common.Digest, hasher.Len()),
+		metrics:       common.NoopTreeMetrics{},
+		logger:        log.Default().Named("hyper"),
 	}
 
 	tree.defaultHashes[0] = tree.hasher.Do([]byte{0x0}, []byte{0x0})
@@ -36,57 +46,304 @@ func NewHyperTree(hasher common.Hasher, store common.Store, cache common.Modifia
 	return tree
 }
 
+func (t *HyperTree) SetMetrics(metrics common.TreeMetrics) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.metrics = metrics
+}
+
+func (t *HyperTree) SetLogger(logger *log.Logger) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.logger = logger
+}
+
+func (t *HyperTree) observeLatency(operation string, start time.Time) {
+	t.metrics.ObserveLatency(operation, time.Since(start))
+}
+
+// prune runs the pruner under its own span, which the range queries done
+// while pruning are children of. It fails if the pruner
+// could not read the leaves or the context is done by the end of the
+// traversal, as the pruned tree may be incomplete.
+func (t *HyperTree) prune(ctx context.Context, pruner Pruner) (common.Visitable, error) {
+	ctx, span := trace.Start(ctx, "hyper.Prune")
+	defer span.End()
+	pruned, err := pruner.Prune(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return pruned, nil
+}
+
+func (t *HyperTree) visit(ctx context.Context, pruned common.Visitable, visitor common.PostOrderVisitor) interface{} {
+	_, span := trace.Start(ctx, "hyper.Visit")
+	defer span.End()
+	return pruned.PostOrder(visitor)
+}
+
+func (t *HyperTree) mutate(ctx context.Context, mutations []common.Mutation) error {
+	ctx, span := trace.Start(ctx, "hyper.Mutate")
+	defer span.End()
+	span.SetAttribute("mutations", len(mutations))
+	return t.store.Mutate(ctx, mutations)
+}
+
+// debugPruned prints the pruned tree only if it is going to be logged, as
+// printing it visits the whole tree.
+func (t *HyperTree) debugPruned(pruned common.Visitable) {
+	if !t.logger.Enabled(log.DebugLevel) {
+		return
+	}
+	print := common.NewPrintVisitor(t.hasher.Len())
+	pruned.PreOrder(print)
+	t.logger.Debug("Pruned tree", log.String("tree", print.Result()))
+}
+
 func newRootPosition(numBits uint16) common.Position {
 	index := make([]byte, numBits/8)
 	return NewPosition(index, numBits)
 }
 
-func (t *HyperTree) Add(eventDigest common.Digest, version uint64) *common.Commitment {
+func (t *HyperTree) Add(ctx context.Context, eventDigest common.Digest, version uint64) (*common.Commitment, error) {
 	t.lock.Lock()
 	defer t.lock.Unlock()
 
-	log.Debugf("Adding event %b with version %d\n", eventDigest, version)
+	defer t.observeLatency("add", time.Now())
+	ctx, span := trace.Start(ctx, "hyper.Add")
+	defer span.End()
+
+	t.logger.Debug("Adding event", log.Hex("event", eventDigest), log.Uint64("version", version))
 
 	// visitors
-	computeHash := common.NewComputeHashVisitor(t.hasher)
-	caching := common.NewCachingVisitor(computeHash)
+	computeHash := common.NewComputeHashVisitor(t.hasher, t.logger)
+	caching := common.NewCachingVisitor(computeHash, t.logger)
 
 	// build pruning context
 	versionAsBytes := util.Uint64AsBytes(version)
-	context := PruningContext{
+	pruning := PruningContext{
 		navigator:     NewHyperTreeNavigator(t.hasher.Len()),
 		cacheResolver: NewSingleTargetedCacheResolver(t.hasher.Len(), t.cacheLevel, eventDigest),
 		cache:         t.cache,
 		store:         t.store,
+		hasher:        t.hasher,
 		defaultHashes: t.defaultHashes,
+		logger:        t.logger,
 	}
 
 	// traverse from root and generate a visitable pruned tree
-	pruned := NewInsertPruner(eventDigest, versionAsBytes, context).Prune()
+	pruner := NewInsertPruner(eventDigest, versionAsBytes, pruning)
+	pruned, err := t.prune(ctx, pruner)
+	if err != nil {
+		return nil, err
+	}
 
 	// print := common.NewPrintVisitor(t.hasher.Len())
 	// pruned.PreOrder(print)
-	// log.Debugf("Pruned tree: %s", print.Result())
+	// t.logger.Debug("Pruned tree", log.String("tree", print.Result()))
 
 	// visit the pruned tree
-	rh := pruned.PostOrder(caching).(common.Digest)
+	counting := common.NewCountingVisitor(caching)
+	rh := t.visit(ctx, pruned, counting).(common.Digest)
+	t.metrics.ObserveNodesVisited("add", counting.Result()+pruner.Collapsed())
 
 	// persist mutations
 	cachedElements := caching.Result()
-	mutations := make([]common.Mutation, len(cachedElements))
-	for i, e := range cachedElements {
-		mutations[i] = *common.NewMutation(common.HyperCachePrefix, e.Pos.Bytes(), e.Digest)
-		// update cache
-		t.cache.Put(e.Pos, e.Digest)
+	mutations := make([]common.Mutation, 0, len(cachedElements)+1)
+	for _, e := range cachedElements {
+		mutations = append(mutations, *common.NewMutation(common.HyperCachePrefix, e.Pos.Bytes(), e.Digest))
 	}
 	// create a mutation for the new leaf
 	leafMutation := common.NewMutation(common.IndexPrefix, eventDigest, versionAsBytes)
 	mutations = append(mutations, *leafMutation)
-	t.store.Mutate(mutations) // TODO the mutations should be returned and persited at the balloon level
+	if err := t.mutate(ctx, mutations); err != nil {
+		return nil, err
+	}
+	t.metrics.ObserveMutations("add", len(mutations))
+
+	// update cache only once the mutations are persisted, so that it never
+	// gets ahead of the store
+	for _, e := range cachedElements {
+		t.cache.Put(e.Pos, e.Digest)
+	}
+
+	t.logger.Debug("Mutations persisted", log.Int("mutations", len(mutations)))
+
+	return common.NewCommitment(version, rh), nil
+}
+
+func (t *HyperTree) Remove(ctx context.Context, eventDigest common.Digest) (common.Digest, *MembershipProof, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	defer t.observeLatency("remove", time.Now())
+	ctx, span := trace.Start(ctx, "hyper.Remove")
+	defer span.End()
+
+	t.logger.Debug("Removing event", log.Hex("event", eventDigest))
+
+	// visitors
+	computeHash := common.NewComputeHashVisitor(t.hasher, t.logger)
+	caching := common.NewCachingVisitor(computeHash, t.logger)
+
+	// build pruning context
+	pruning := PruningContext{
+		navigator:     NewHyperTreeNavigator(t.hasher.Len()),
+		cacheResolver: NewSingleTargetedCacheResolver(t.hasher.Len(), t.cacheLevel, eventDigest),
+		cache:         t.cache,
+		store:         t.store,
+		hasher:        t.hasher,
+		defaultHashes: t.defaultHashes,
+		logger:        t.logger,
+	}
+
+	// traverse from root and generate a visitable pruned tree
+	pruner := NewRemovePruner(eventDigest, pruning)
+	pruned, err := t.prune(ctx, pruner)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// visit the pruned tree
+	counting := common.NewCountingVisitor(caching)
+	rh := t.visit(ctx, pruned, counting).(common.Digest)
+	t.metrics.ObserveNodesVisited("remove", counting.Result()+pruner.Collapsed())
+
+	// persist mutations, dropping cached nodes that are back to their default hash
+	cachedElements := caching.Result()
+	mutations := make([]common.Mutation, 0, len(cachedElements)+1)
+	for _, e := range cachedElements {
+		if bytes.Equal(e.Digest, t.defaultHashes[e.Pos.Height()]) {
+			mutations = append(mutations, *common.NewDeleteMutation(common.HyperCachePrefix, e.Pos.Bytes()))
+		} else {
+			mutations = append(mutations, *common.NewMutation(common.HyperCachePrefix, e.Pos.Bytes(), e.Digest))
+		}
+	}
+	// create a mutation to delete the leaf
+	leafMutation := common.NewDeleteMutation(common.IndexPrefix, eventDigest)
+	mutations = append(mutations, *leafMutation)
+	if err := t.mutate(ctx, mutations); err != nil {
+		return nil, nil, err
+	}
+	t.metrics.ObserveMutations("remove", len(mutations))
+
+	// update cache
+	for _, e := range cachedElements {
+		t.cache.Put(e.Pos, e.Digest)
+	}
+
+	t.logger.Debug("Mutations persisted", log.Int("mutations", len(mutations)))
+
+	// generate the proof of absence from the updated tree. The event is
+	// already removed if this fails, so the new root is returned anyway
+	calcAuditPath := common.NewAuditPathVisitor(common.NewComputeHashVisitor(t.hasher, t.logger), t.logger)
+	pruned, err = t.prune(ctx, NewSearchPruner(eventDigest, pruning))
+	if err != nil {
+		return rh, nil, err
+	}
+	t.visit(ctx, pruned, calcAuditPath)
+	t.metrics.ObserveAuditPathSize("remove", len(calcAuditPath.Result()))
+
+	return rh, NewMembershipProof(calcAuditPath.Result()), nil
+}
+
+var ErrInconsistentCache = errors.New("inconsistent hyper cache entry")
+
+const loadCacheLogStep = 100000
+
+// LoadCache fills the cache with the nodes persisted under the
+// HyperCachePrefix. It must be called before adding events to a tree
+// reopened over an existing store, as the pruners take the nodes missing
+// from the cache as empty subtrees.
+func (t *HyperTree) LoadCache(ctx context.Context) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.logger.Info("Loading cache")
+
+	it := t.store.GetAll(ctx, common.HyperCachePrefix)
+	defer it.Close()
+
+	loaded := 0
+	for it.Next() {
+		pair := it.Pair()
+		pos, err := t.decodeCachedPosition(pair.Key)
+		if err != nil {
+			return err
+		}
+		if len(pair.Value) != len(t.defaultHashes[0]) {
+			return fmt.Errorf("%w: digest of %s has %d bytes instead of %d", ErrInconsistentCache, pos, len(pair.Value), len(t.defaultHashes[0]))
+		}
+		t.cache.Put(pos, pair.Value)
+		loaded++
+		if loaded%loadCacheLogStep == 0 {
+			t.logger.Info("Loading cache", log.Int("loaded", loaded))
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
 
-	log.Debugf("Mutations: %v", mutations)
+	t.logger.Info("Cache loaded", log.Int("loaded", loaded))
+	return nil
+}
+
+// decodeCachedPosition parses a key written by HyperPosition.Bytes, checking
+// that it is a position the tree would have cached.
+func (t *HyperTree) decodeCachedPosition(key []byte) (*HyperPosition, error) {
+	numBits := t.hasher.Len()
+	indexLen := int(numBits / 8)
+	if len(key) != len(NewPosition(nil, 0).Bytes()) {
+		return nil, fmt.Errorf("%w: key %x has %d bytes", ErrInconsistentCache, key, len(key))
+	}
+	for _, b := range key[indexLen+2:] {
+		if b != 0x0 {
+			return nil, fmt.Errorf("%w: key %x is not padded with zeros", ErrInconsistentCache, key)
+		}
+	}
+
+	index := key[:indexLen]
+	height := binary.LittleEndian.Uint16(key[indexLen : indexLen+2])
+	pos := NewPosition(index, height)
+	if height <= t.cacheLevel || height >= numBits {
+		return nil, fmt.Errorf("%w: %s is out of the cached levels", ErrInconsistentCache, pos)
+	}
+	// the index of a node has all the bits under its height unset
+	for bit := numBits - height; bit < numBits; bit++ {
+		if bitIsSet(index, bit) {
+			return nil, fmt.Errorf("%w: %s is not aligned to its height", ErrInconsistentCache, pos)
+		}
+	}
+	return pos, nil
+}
 
-	return common.NewCommitment(version, rh)
+// StoredRoot computes the root of the tree from the children of the root
+// persisted under the HyperCachePrefix, bypassing the in-memory cache. It
+// tells whether the nodes written by the last Add reached the store, as
+// they are the only ones the root depends on. The children of the root are
+// always cached, as the cache level is below them.
+func (t *HyperTree) StoredRoot(ctx context.Context) (common.Digest, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	navigator := NewHyperTreeNavigator(t.hasher.Len())
+	root := navigator.Root()
+	children := make([]common.Digest, 0, 2)
+	for _, pos := range []common.Position{navigator.GoToLeft(root), navigator.GoToRight(root)} {
+		pair, err := t.store.Get(ctx, common.HyperCachePrefix, pos.Bytes())
+		switch {
+		case err == common.ErrKeyNotFound:
+			children = append(children, t.defaultHashes[pos.Height()])
+		case err != nil:
+			return nil, err
+		default:
+			children = append(children, pair.Value)
+		}
+	}
+	return common.NewComputeHashVisitor(t.hasher, t.logger).VisitRoot(root, children[0], children[1]).(common.Digest), nil
 }
 
 type MembershipProof struct {
@@ -97,70 +354,137 @@ func NewMembershipProof(path common.AuditPath) *MembershipProof {
 	return &MembershipProof{path}
 }
 
-func (t *HyperTree) Get(eventDigest common.Digest) (value []byte, proof *MembershipProof, err error) {
+func (t *HyperTree) Get(ctx context.Context, eventDigest common.Digest) (value []byte, proof *MembershipProof, err error) {
 	t.lock.Lock()
 	defer t.lock.Unlock()
 
-	log.Debugf("Getting version for event %b\n", eventDigest)
+	defer t.observeLatency("get", time.Now())
+	ctx, span := trace.Start(ctx, "hyper.Get")
+	defer span.End()
 
-	pair, err := t.store.Get(common.IndexPrefix, eventDigest) // TODO check existence
+	t.logger.Debug("Getting version", log.Hex("event", eventDigest))
+
+	pair, err := t.store.Get(ctx, common.IndexPrefix, eventDigest)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	// visitors
-	computeHash := common.NewComputeHashVisitor(t.hasher)
-	calcAuditPath := common.NewAuditPathVisitor(computeHash)
+	computeHash := common.NewComputeHashVisitor(t.hasher, t.logger)
+	calcAuditPath := common.NewAuditPathVisitor(computeHash, t.logger)
 
 	// build pruning context
-	context := PruningContext{
+	pruning := PruningContext{
 		navigator:     NewHyperTreeNavigator(t.hasher.Len()),
 		cacheResolver: NewSingleTargetedCacheResolver(t.hasher.Len(), t.cacheLevel, eventDigest),
 		cache:         t.cache,
 		store:         t.store,
+		hasher:        t.hasher,
 		defaultHashes: t.defaultHashes,
+		logger:        t.logger,
 	}
 
 	// traverse from root and generate a visitable pruned tree
-	pruned := NewSearchPruner(eventDigest, context).Prune()
+	pruner := NewSearchPruner(eventDigest, pruning)
+	pruned, err := t.prune(ctx, pruner)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	print := common.NewPrintVisitor(t.hasher.Len())
-	pruned.PreOrder(print)
-	log.Debugf("Pruned tree: %s", print.Result())
+	t.debugPruned(pruned)
 
 	// visit the pruned tree
-	pruned.PostOrder(calcAuditPath)
+	counting := common.NewCountingVisitor(calcAuditPath)
+	t.visit(ctx, pruned, counting)
+	t.metrics.ObserveNodesVisited("get", counting.Result()+pruner.Collapsed())
+	t.metrics.ObserveAuditPathSize("get", len(calcAuditPath.Result()))
 
 	return pair.Value, NewMembershipProof(calcAuditPath.Result()), nil // include version in audit path visitor
 }
 
-func (t *HyperTree) VerifyMembership(proof *MembershipProof, version uint64, eventDigest, expectedDigest common.Digest) bool {
+func (t *HyperTree) VerifyMembership(ctx context.Context, proof *MembershipProof, version uint64, eventDigest, expectedDigest common.Digest) (bool, error) {
 	t.lock.Lock()
 	defer t.lock.Unlock()
 
-	log.Debugf("Verifying membership for eventDigest %x", eventDigest)
+	defer t.observeLatency("verify_membership", time.Now())
+	ctx, span := trace.Start(ctx, "hyper.VerifyMembership")
+	defer span.End()
+
+	t.logger.Debug("Verifying membership", log.Hex("event", eventDigest))
 
 	// visitors
-	computeHash := common.NewComputeHashVisitor(t.hasher)
+	computeHash := common.NewComputeHashVisitor(t.hasher, t.logger)
 
 	// build pruning context
 	versionAsBytes := util.Uint64AsBytes(version)
-	context := PruningContext{
+	pruning := PruningContext{
 		navigator:     NewHyperTreeNavigator(t.hasher.Len()),
 		cacheResolver: NewSingleTargetedCacheResolver(t.hasher.Len(), t.cacheLevel, eventDigest),
 		cache:         proof.AuditPath,
 		store:         t.store,
+		hasher:        t.hasher,
 		defaultHashes: t.defaultHashes,
+		logger:        t.logger,
 	}
 
 	// traverse from root and generate a visitable pruned tree
-	pruned := NewVerifyPruner(eventDigest, versionAsBytes, context).Prune()
+	pruned, err := t.prune(ctx, NewVerifyPruner(eventDigest, versionAsBytes, pruning))
+	if err == common.ErrIncompleteAuditPath {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
 
-	print := common.NewPrintVisitor(t.hasher.Len())
-	pruned.PreOrder(print)
-	log.Debugf("Pruned tree: %s", print.Result())
+	t.debugPruned(pruned)
+
+	// visit the pruned tree
+	counting := common.NewCountingVisitor(computeHash)
+	recomputed := t.visit(ctx, pruned, counting).(common.Digest)
+	t.metrics.ObserveNodesVisited("verify_membership", counting.Result())
+	t.metrics.ObserveAuditPathSize("verify_membership", len(proof.AuditPath))
+	return bytes.Equal(recomputed, expectedDigest), nil
+}
+
+func (t *HyperTree) VerifyNonMembership(ctx context.Context, proof *MembershipProof, eventDigest, expectedDigest common.Digest) (bool, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	defer t.observeLatency("verify_non_membership", time.Now())
+	ctx, span := trace.Start(ctx, "hyper.VerifyNonMembership")
+	defer span.End()
+
+	t.logger.Debug("Verifying non-membership", log.Hex("event", eventDigest))
+
+	// visitors
+	computeHash := common.NewComputeHashVisitor(t.hasher, t.logger)
+
+	// build pruning context
+	pruning := PruningContext{
+		navigator:     NewHyperTreeNavigator(t.hasher.Len()),
+		cacheResolver: NewSingleTargetedCacheResolver(t.hasher.Len(), t.cacheLevel, eventDigest),
+		cache:         proof.AuditPath,
+		store:         t.store,
+		hasher:        t.hasher,
+		defaultHashes: t.defaultHashes,
+		logger:        t.logger,
+	}
+
+	// traverse from root and generate a visitable pruned tree
+	pruned, err := t.prune(ctx, NewVerifyAbsencePruner(eventDigest, pruning))
+	if err == common.ErrIncompleteAuditPath {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	t.debugPruned(pruned)
 
 	// visit the pruned tree
-	recomputed := pruned.PostOrder(computeHash).(common.Digest)
-	return bytes.Equal(recomputed, expectedDigest)
+	counting := common.NewCountingVisitor(computeHash)
+	recomputed := t.visit(ctx, pruned, counting).(common.Digest)
+	t.metrics.ObserveNodesVisited("verify_non_membership", counting.Result())
+	t.metrics.ObserveAuditPathSize("verify_non_membership", len(proof.AuditPath))
+	return bytes.Equal(recomputed, expectedDigest), nil
 }
@@ -1,17 +1,23 @@
 package hyper
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"testing"
 
 	"github.com/aalda/trees/common"
 	"github.com/aalda/trees/log"
 	"github.com/aalda/trees/storage/bplus"
+	"github.com/aalda/trees/trace"
 	"github.com/aalda/trees/util"
 	"github.com/bbva/qed/testutils/rand"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+var ctx = context.Background()
+
 func TestAdd(t *testing.T) {
 
 	log.SetLogger("TestAdd", log.DEBUG)
@@ -38,7 +44,8 @@ func TestAdd(t *testing.T) {
 
 	for i, c := range testCases {
 		index := uint64(i)
-		commitment := tree.Add(c.eventDigest, index)
+		commitment, err := tree.Add(ctx, c.eventDigest, index)
+		require.NoError(t, err)
 		require.Equalf(t, c.expectedRootHash, commitment.Digest, "Incorrect root hash for index %d", i)
 	}
 }
@@ -55,10 +62,11 @@ func TestProveMembership(t *testing.T) {
 	simpleCache := common.NewSimpleCache(10)
 	tree := NewHyperTree(new(common.XorHasher), store, simpleCache, 2)
 
-	rh := tree.Add(digest, index)
+	rh, err := tree.Add(ctx, digest, index)
+	require.NoError(t, err)
 	assert.Equal(t, rh.Digest, common.Digest{0x0}, "Incorrect root hash")
 
-	_, pf, err := tree.Get(digest)
+	_, pf, err := tree.Get(ctx, digest)
 	assert.Nil(t, err, "Error adding to the tree: %v", err)
 
 	ap := common.AuditPath{
@@ -87,13 +95,16 @@ func TestProveMembershipConsecutive(t *testing.T) {
 	simpleCache := common.NewSimpleCache(10)
 	tree := NewHyperTree(new(common.XorHasher), store, simpleCache, 2)
 
-	rh := tree.Add(digest, index)
+	rh, err := tree.Add(ctx, digest, index)
+	require.NoError(t, err)
 	assert.Equal(t, rh.Digest, common.Digest{0x0}, "Incorrect root hash")
 
-	tree.Add(hasher.Do(common.Digest{0x1}), uint64(1))
-	tree.Add(hasher.Do(common.Digest{0x2}), uint64(2))
+	_, err = tree.Add(ctx, hasher.Do(common.Digest{0x1}), uint64(1))
+	require.NoError(t, err)
+	_, err = tree.Add(ctx, hasher.Do(common.Digest{0x2}), uint64(2))
+	require.NoError(t, err)
 
-	_, pf, err := tree.Get(digest)
+	_, pf, err := tree.Get(ctx, digest)
 	assert.Nil(t, err, "Error adding to the tree: %v", err)
 
 	ap := common.AuditPath{
@@ -110,6 +121,18 @@ func TestProveMembershipConsecutive(t *testing.T) {
 
 }
 
+func TestGetUnknownKey(t *testing.T) {
+
+	log.SetLogger("TestGetUnknownKey", log.DEBUG)
+
+	tree := NewHyperTree(new(common.XorHasher), bplus.NewBPlusTreeStorage(), common.NewSimpleCache(10), 2)
+	_, err := tree.Add(ctx, common.Digest{0x1}, uint64(0))
+	require.NoError(t, err)
+
+	_, _, err = tree.Get(ctx, common.Digest{0x2})
+	assert.Equal(t, common.ErrKeyNotFound, err, "Unknown keys should not be found")
+}
+
 func TestAddAndVerifyXor(t *testing.T) {
 
 	log.SetLogger("TestAddAndVerifyXor", log.DEBUG)
@@ -122,14 +145,16 @@ func TestAddAndVerifyXor(t *testing.T) {
 	key := hasher.Do(common.Digest("a test event"))
 	value := uint64(0)
 
-	commitment := tree.Add(key, value)
+	commitment, err := tree.Add(ctx, key, value)
+	require.NoError(t, err)
 
-	actualValue, proof, err := tree.Get(key)
+	actualValue, proof, err := tree.Get(ctx, key)
 	assert.Nil(t, err, "Error must be nil")
 
 	assert.Equal(t, util.Uint64AsBytes(value), actualValue, "Incorrect actual value")
 
-	correct := tree.VerifyMembership(proof, value, key, commitment.Digest)
+	correct, err := tree.VerifyMembership(ctx, proof, value, key, commitment.Digest)
+	require.NoError(t, err)
 
 	if !correct {
 		t.Errorf("Key %x should be a member", key)
@@ -148,20 +173,251 @@ func TestAddAndVerifySha256(t *testing.T) {
 	key := hasher.Do(common.Digest("a test event"))
 	value := uint64(0)
 
-	commitment := tree.Add(key, value)
+	commitment, err := tree.Add(ctx, key, value)
+	require.NoError(t, err)
 
-	actualValue, proof, err := tree.Get(key)
+	actualValue, proof, err := tree.Get(ctx, key)
 	assert.Nil(t, err, "Error must be nil")
 
 	assert.Equal(t, util.Uint64AsBytes(value), actualValue, "Incorrect actual value")
 
-	correct := tree.VerifyMembership(proof, value, key, commitment.Digest)
+	correct, err := tree.VerifyMembership(ctx, proof, value, key, commitment.Digest)
+	require.NoError(t, err)
 
 	if !correct {
 		t.Errorf("Key %x should be a member", key)
 	}
 }
 
+func TestAddWithCacheLevelFarAboveLeaves(t *testing.T) {
+
+	log.SetLogger("TestAddWithCacheLevelFarAboveLeaves", log.SILENT)
+
+	hasher := common.NewSha256Hasher()
+	cached := NewHyperTree(common.NewSha256Hasher(), bplus.NewBPlusTreeStorage(), common.NewSimpleCache(10), 2)
+	streamed := NewHyperTree(common.NewSha256Hasher(), bplus.NewBPlusTreeStorage(), common.NewSimpleCache(10), hasher.Len()-4)
+
+	var commitment *common.Commitment
+	for i := uint64(0); i < 64; i++ {
+		key := hasher.Do(util.Uint64AsBytes(i))
+		expected, err := cached.Add(ctx, key, i)
+		require.NoError(t, err)
+		commitment, err = streamed.Add(ctx, key, i)
+		require.NoError(t, err)
+		require.Equalf(t, expected.Digest, commitment.Digest, "Incorrect root hash for index %d", i)
+	}
+
+	for i := uint64(0); i < 64; i += 7 {
+		key := hasher.Do(util.Uint64AsBytes(i))
+		value, proof, err := streamed.Get(ctx, key)
+		require.NoError(t, err)
+		require.Equal(t, util.Uint64AsBytes(i), value, "Incorrect actual value")
+		verified, err := streamed.VerifyMembership(ctx, proof, i, key, commitment.Digest)
+		require.NoError(t, err)
+		require.Truef(t, verified, "Key %x should be a member", key)
+	}
+
+	key := hasher.Do(util.Uint64AsBytes(31))
+	expected, _, err := cached.Remove(ctx, key)
+	require.NoError(t, err)
+	rh, _, err := streamed.Remove(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, expected, rh, "Incorrect root hash after removal")
+}
+
+type nodesVisited struct {
+	common.NoopTreeMetrics
+	nodes map[string]int
+}
+
+func (m *nodesVisited) ObserveNodesVisited(operation string, nodes int) {
+	m.nodes[operation] = nodes
+}
+
+func TestNodesVisitedWithCollapsedSubtrees(t *testing.T) {
+
+	log.SetLogger("TestNodesVisitedWithCollapsedSubtrees", log.SILENT)
+
+	// the nodes under the cache level are hashed while pruning, but they are
+	// still visited: the path to the leaf and the siblings along it
+	hasher := new(common.XorHasher)
+	expected := 2*int(hasher.Len()) + 1
+	for _, cacheLevel := range []uint16{2, hasher.Len() - 1} {
+		metrics := &nodesVisited{nodes: make(map[string]int)}
+		tree := NewHyperTree(new(common.XorHasher), bplus.NewBPlusTreeStorage(), common.NewSimpleCache(10), cacheLevel)
+		tree.SetMetrics(metrics)
+
+		_, err := tree.Add(ctx, common.Digest{0x1}, 0)
+		require.NoError(t, err)
+		_, _, err = tree.Get(ctx, common.Digest{0x1})
+		require.NoError(t, err)
+		assert.Equalf(t, expected, metrics.nodes["add"], "Incorrect nodes visited by add with cache level %d", cacheLevel)
+		assert.Equalf(t, expected, metrics.nodes["get"], "Incorrect nodes visited by get with cache level %d", cacheLevel)
+	}
+}
+
+func TestRemove(t *testing.T) {
+
+	log.SetLogger("TestRemove", log.DEBUG)
+
+	hasher := common.NewSha256Hasher()
+	keys := []common.Digest{
+		hasher.Do(common.Digest("first event")),
+		hasher.Do(common.Digest("second event")),
+		hasher.Do(common.Digest("third event")),
+	}
+
+	tree := NewHyperTree(common.NewSha256Hasher(), bplus.NewBPlusTreeStorage(), common.NewSimpleCache(10), 2)
+	expected := NewHyperTree(common.NewSha256Hasher(), bplus.NewBPlusTreeStorage(), common.NewSimpleCache(10), 2)
+
+	var before *common.Commitment
+	var err error
+	for i, key := range keys {
+		before, err = tree.Add(ctx, key, uint64(i))
+		require.NoError(t, err)
+	}
+	_, err = expected.Add(ctx, keys[0], uint64(0))
+	require.NoError(t, err)
+	after, err := expected.Add(ctx, keys[2], uint64(2))
+	require.NoError(t, err)
+
+	rh, proof, err := tree.Remove(ctx, keys[1])
+	require.NoError(t, err)
+	assert.Equal(t, after.Digest, rh, "Incorrect root hash after removal")
+
+	verified, err := tree.VerifyNonMembership(ctx, proof, keys[1], rh)
+	require.NoError(t, err)
+	assert.True(t, verified, "Key %x should not be a member", keys[1])
+	verified, err = tree.VerifyNonMembership(ctx, proof, keys[1], before.Digest)
+	require.NoError(t, err)
+	assert.False(t, verified, "Key %x was a member of the previous root", keys[1])
+
+	_, _, err = tree.Get(ctx, keys[1])
+	assert.Equal(t, common.ErrKeyNotFound, err, "Removed key should not be found")
+
+	value, proof, err := tree.Get(ctx, keys[2])
+	require.NoError(t, err)
+	verified, err = tree.VerifyMembership(ctx, proof, 2, keys[2], rh)
+	require.NoError(t, err)
+	assert.True(t, verified, "Key %x should still be a member", keys[2])
+	assert.Equal(t, util.Uint64AsBytes(2), value, "Incorrect actual value")
+}
+
+func TestRemoveAll(t *testing.T) {
+
+	log.SetLogger("TestRemoveAll", log.DEBUG)
+
+	store := bplus.NewBPlusTreeStorage()
+	tree := NewHyperTree(new(common.XorHasher), store, common.NewSimpleCache(10), 2)
+
+	for i := 0; i < 10; i++ {
+		_, err := tree.Add(ctx, common.Digest{byte(i)}, uint64(i))
+		require.NoError(t, err)
+	}
+	var rh common.Digest
+	for i := 0; i < 10; i++ {
+		var err error
+		rh, _, err = tree.Remove(ctx, common.Digest{byte(i)})
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, common.Digest{0x0}, rh, "An empty tree should have the default root hash")
+	for _, prefix := range []byte{common.IndexPrefix, common.HyperCachePrefix} {
+		it := store.GetAll(ctx, prefix)
+		assert.False(t, it.Next(), "Store should have no entries under prefix %d", prefix)
+		it.Close()
+	}
+}
+
+func TestAddAndVerifyBolt(t *testing.T) {
+
+	log.SetLogger("TestAddAndVerifyBolt", log.SILENT)
+
+	store, closeF := openBoltStore("/var/tmp/hyper_tree_test_bolt.db")
+	defer closeF()
+
+	hasher := common.NewSha256Hasher()
+	tree := NewHyperTree(common.NewSha256Hasher(), store, common.NewSimpleCache(10), hasher.Len()-4)
+	expected := NewHyperTree(common.NewSha256Hasher(), bplus.NewBPlusTreeStorage(), common.NewSimpleCache(10), hasher.Len()-4)
+
+	var commitment *common.Commitment
+	for i := uint64(0); i < 16; i++ {
+		key := hasher.Do(util.Uint64AsBytes(i))
+		expectedCommitment, err := expected.Add(ctx, key, i)
+		require.NoError(t, err)
+		commitment, err = tree.Add(ctx, key, i)
+		require.NoError(t, err)
+		require.Equalf(t, expectedCommitment.Digest, commitment.Digest, "Incorrect root hash for index %d", i)
+	}
+
+	key := hasher.Do(util.Uint64AsBytes(3))
+	value, proof, err := tree.Get(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, util.Uint64AsBytes(3), value, "Incorrect actual value")
+	verified, err := tree.VerifyMembership(ctx, proof, 3, key, commitment.Digest)
+	require.NoError(t, err)
+	assert.True(t, verified, "Key %x should be a member", key)
+}
+
+func TestLoadCache(t *testing.T) {
+
+	log.SetLogger("TestLoadCache", log.SILENT)
+
+	hasher := common.NewSha256Hasher()
+	store := bplus.NewBPlusTreeStorage()
+	tree := NewHyperTree(common.NewSha256Hasher(), store, common.NewSimpleCache(10), hasher.Len()-8)
+	expected := NewHyperTree(common.NewSha256Hasher(), bplus.NewBPlusTreeStorage(), common.NewSimpleCache(10), hasher.Len()-8)
+
+	for i := uint64(0); i < 32; i++ {
+		key := hasher.Do(util.Uint64AsBytes(i))
+		_, err := tree.Add(ctx, key, i)
+		require.NoError(t, err)
+		_, err = expected.Add(ctx, key, i)
+		require.NoError(t, err)
+	}
+
+	reopened := NewHyperTree(common.NewSha256Hasher(), store, common.NewSimpleCache(10), hasher.Len()-8)
+	require.NoError(t, reopened.LoadCache(ctx))
+
+	key := hasher.Do(util.Uint64AsBytes(32))
+	commitment, err := reopened.Add(ctx, key, 32)
+	require.NoError(t, err)
+	expectedCommitment, err := expected.Add(ctx, key, 32)
+	require.NoError(t, err)
+	assert.Equal(t, expectedCommitment.Digest, commitment.Digest, "Incorrect root hash after loading the cache")
+}
+
+func TestLoadCacheInconsistent(t *testing.T) {
+
+	log.SetLogger("TestLoadCacheInconsistent", log.SILENT)
+
+	position := func(index byte, height uint16) []byte {
+		return NewPosition([]byte{index}, height).Bytes()
+	}
+	padded := position(0x0, 4)
+	padded[33] = 0x1
+
+	testCases := []struct {
+		name       string
+		key, value []byte
+	}{
+		{"short key", []byte{0x0, 0x4}, common.Digest{0x0}},
+		{"dirty padding", padded, common.Digest{0x0}},
+		{"height under the cache level", position(0x0, 2), common.Digest{0x0}},
+		{"root height", position(0x0, 8), common.Digest{0x0}},
+		{"misaligned index", position(0x1, 4), common.Digest{0x0}},
+		{"digest length", position(0x0, 4), common.Digest{0x0, 0x0}},
+	}
+
+	for _, c := range testCases {
+		store := bplus.NewBPlusTreeStorage()
+		require.NoError(t, store.Mutate(ctx, []common.Mutation{*common.NewMutation(common.HyperCachePrefix, c.key, c.value)}))
+		tree := NewHyperTree(new(common.XorHasher), store, common.NewSimpleCache(10), 2)
+		err := tree.LoadCache(ctx)
+		assert.Truef(t, errors.Is(err, ErrInconsistentCache), "Expected an inconsistent cache error for the %s case, got %v", c.name, err)
+	}
+}
+
 func BenchmarkAdd(b *testing.B) {
 
 	log.SetLogger("BenchmarkAdd", log.SILENT)
@@ -177,6 +433,302 @@ func BenchmarkAdd(b *testing.B) {
 	b.N = 100000
 	for i := 0; i < b.N; i++ {
 		key := hasher.Do(rand.Bytes(32))
-		tree.Add(key, uint64(i))
+		tree.Add(ctx, key, uint64(i))
+	}
+}
+
+func BenchmarkAddBolt(b *testing.B) {
+
+	log.SetLogger("BenchmarkAddBolt", log.SILENT)
+
+	store, closeF := openBoltStore("/var/tmp/hyper_tree_test_bolt.db")
+	defer closeF()
+
+	hasher := common.NewSha256Hasher()
+	simpleCache := common.NewSimpleCache(0)
+	tree := NewHyperTree(common.NewSha256Hasher(), store, simpleCache, hasher.Len()-25)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := hasher.Do(rand.Bytes(32))
+		tree.Add(ctx, key, uint64(i))
+	}
+}
+
+func BenchmarkAddPebble(b *testing.B) {
+
+	log.SetLogger("BenchmarkAddPebble", log.SILENT)
+
+	store, closeF := openPebbleStore("/var/tmp/hyper_tree_test_pebble.db")
+	defer closeF()
+
+	hasher := common.NewSha256Hasher()
+	simpleCache := common.NewSimpleCache(0)
+	tree := NewHyperTree(common.NewSha256Hasher(), store, simpleCache, hasher.Len()-25)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := hasher.Do(rand.Bytes(32))
+		tree.Add(ctx, key, uint64(i))
+	}
+}
+
+func TestTracing(t *testing.T) {
+
+	log.SetLogger("TestTracing", log.DEBUG)
+
+	recorder := trace.NewRecorder()
+	tracedCtx := trace.WithTracer(ctx, recorder)
+
+	tree := NewHyperTree(new(common.XorHasher), bplus.NewBPlusTreeStorage(), common.NewSimpleCache(10), 2)
+	_, err := tree.Add(tracedCtx, common.Digest{0x1}, 0)
+	require.NoError(t, err)
+
+	spans := make(map[string]trace.RecordedSpan)
+	for _, span := range recorder.Spans() {
+		spans[span.Name] = span
+	}
+	add, ok := spans["hyper.Add"]
+	require.True(t, ok, "The operation must be traced")
+	require.Equal(t, 0, add.ParentID, "The operation must be a root span")
+	for _, name := range []string{"hyper.Prune", "hyper.Visit", "hyper.Mutate"} {
+		span, ok := spans[name]
+		require.Truef(t, ok, "Span %s must be recorded", name)
+		require.Equalf(t, add.ID, span.ParentID, "Span %s must be a child of the operation", name)
+		require.False(t, span.End.Before(span.Start))
+	}
+	rangeQuery, ok := spans["hyper.RangeQuery"]
+	require.True(t, ok, "The range queries must be traced")
+	require.Equal(t, spans["hyper.Prune"].ID, rangeQuery.ParentID, "The range queries must be children of the pruning")
+	require.Contains(t, spans["hyper.Mutate"].Attributes, "mutations")
+
+	recorder.Reset()
+	_, _, err = tree.Get(ctx, common.Digest{0x1})
+	require.NoError(t, err)
+	require.Empty(t, recorder.Spans(), "Untraced contexts must not be recorded")
+}
+
+func TestVerifyIncompleteAuditPath(t *testing.T) {
+
+	log.SetLogger("TestVerifyIncompleteAuditPath", log.SILENT)
+
+	tree := NewHyperTree(new(common.XorHasher), bplus.NewBPlusTreeStorage(), common.NewSimpleCache(10), 2)
+	commitment, err := tree.Add(ctx, common.Digest{0x1}, 0)
+	require.NoError(t, err)
+	_, proof, err := tree.Get(ctx, common.Digest{0x1})
+	require.NoError(t, err)
+
+	incomplete := NewMembershipProof(common.AuditPath{})
+	for id, digest := range proof.AuditPath {
+		incomplete.AuditPath[id] = digest
+		break
+	}
+	verified, err := tree.VerifyMembership(ctx, incomplete, 0, common.Digest{0x1}, commitment.Digest)
+	require.NoError(t, err)
+	assert.False(t, verified, "A proof missing digests should not verify")
+
+	// the path of another key misses the siblings of this one
+	verified, err = tree.VerifyNonMembership(ctx, proof, common.Digest{0x80}, commitment.Digest)
+	require.NoError(t, err)
+	assert.False(t, verified, "A proof of another key should not verify")
+}
+
+func TestVisitorsLogThroughTheTreeLogger(t *testing.T) {
+
+	log.SetLogger("TestVisitorsLogThroughTheTreeLogger", log.SILENT)
+
+	var buf bytes.Buffer
+	tree := NewHyperTree(new(common.XorHasher), bplus.NewBPlusTreeStorage(), common.NewSimpleCache(10), 2)
+	tree.SetLogger(log.New(&buf, log.NewTextEncoder(), log.DebugLevel).Named("hyper"))
+	_, err := tree.Add(ctx, common.Digest{0x1}, 0)
+	require.NoError(t, err)
+	_, _, err = tree.Get(ctx, common.Digest{0x1})
+	require.NoError(t, err)
+
+	for _, msg := range []string{"Computing root hash", "Caching digest", "Adding cacheable to path"} {
+		assert.Containsf(t, buf.String(), msg, "The visitors should log %q through the tree logger", msg)
+	}
+}
+
+// cancellingStore cancels the operation as soon as it starts a range query,
+// as a client disconnecting in the middle of a traversal would.
+type cancellingStore struct {
+	common.Store
+	cancel context.CancelFunc
+}
+
+func (s cancellingStore) Iterate(ctx context.Context, prefix byte, start, end []byte) common.KVIterator {
+	s.cancel()
+	return s.Store.Iterate(ctx, prefix, start, end)
+}
+
+func TestCancellation(t *testing.T) {
+
+	log.SetLogger("TestCancellation", log.DEBUG)
+
+	store := bplus.NewBPlusTreeStorage()
+	tree := NewHyperTree(new(common.XorHasher), store, common.NewSimpleCache(10), 2)
+	commitment, err := tree.Add(ctx, common.Digest{0x1}, 0)
+	require.NoError(t, err)
+	_, proof, err := tree.Get(ctx, common.Digest{0x1})
+	require.NoError(t, err)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = tree.Add(cancelled, common.Digest{0x2}, 1)
+	require.Equal(t, context.Canceled, err)
+	_, _, err = tree.Get(cancelled, common.Digest{0x1})
+	require.Equal(t, context.Canceled, err)
+	_, err = tree.VerifyMembership(cancelled, proof, 0, common.Digest{0x1}, commitment.Digest)
+	require.Equal(t, context.Canceled, err)
+	_, _, err = tree.Remove(cancelled, common.Digest{0x1})
+	require.Equal(t, context.Canceled, err)
+
+	interrupted, cancel := context.WithCancel(ctx)
+	defer cancel()
+	tree = NewHyperTree(new(common.XorHasher), cancellingStore{store, cancel}, common.NewSimpleCache(10), 2)
+	_, err = tree.Add(interrupted, common.Digest{0x2}, 1)
+	require.Equal(t, context.Canceled, err)
+
+	_, err = store.Get(ctx, common.IndexPrefix, common.Digest{0x2})
+	require.Equal(t, common.ErrKeyNotFound, err, "Cancelled insertions must not be persisted")
+	_, _, err = tree.Get(ctx, common.Digest{0x1})
+	require.NoError(t, err, "Cancellation must not affect later operations")
+}
+
+var errBrokenIterator = errors.New("broken iterator")
+
+// brokenIteratorStore fails every range query after yielding its first pair,
+// or on close if closeFails is set.
+type brokenIteratorStore struct {
+	common.Store
+	closeFails bool
+}
+
+func (s brokenIteratorStore) Iterate(ctx context.Context, prefix byte, start, end []byte) common.KVIterator {
+	return &brokenIterator{s.Store.Iterate(ctx, prefix, start, end), s.closeFails, false}
+}
+
+type brokenIterator struct {
+	common.KVIterator
+	closeFails bool
+	advanced   bool
+}
+
+func (i *brokenIterator) Next() bool {
+	if i.closeFails || !i.advanced {
+		i.advanced = true
+		return i.KVIterator.Next()
+	}
+	return false
+}
+
+func (i *brokenIterator) Err() error {
+	if i.closeFails {
+		return i.KVIterator.Err()
+	}
+	return errBrokenIterator
+}
+
+func (i *brokenIterator) Close() error {
+	i.KVIterator.Close()
+	if i.closeFails {
+		return errBrokenIterator
+	}
+	return nil
+}
+
+func TestBrokenIterator(t *testing.T) {
+
+	log.SetLogger("TestBrokenIterator", log.SILENT)
+
+	hasher := common.NewSha256Hasher()
+	store := bplus.NewBPlusTreeStorage()
+	tree := NewHyperTree(common.NewSha256Hasher(), store, common.NewSimpleCache(10), hasher.Len()-4)
+	for i := uint64(0); i < 16; i++ {
+		_, err := tree.Add(ctx, hasher.Do(util.Uint64AsBytes(i)), i)
+		require.NoError(t, err)
+	}
+	before, err := common.CollectRange(store.GetAll(ctx, common.HyperCachePrefix))
+	require.NoError(t, err)
+
+	for _, closeFails := range []bool{false, true} {
+		broken := NewHyperTree(common.NewSha256Hasher(), brokenIteratorStore{store, closeFails}, common.NewSimpleCache(10), hasher.Len()-4)
+		require.NoError(t, broken.LoadCache(ctx))
+
+		key := hasher.Do(util.Uint64AsBytes(16))
+		_, err = broken.Add(ctx, key, 16)
+		require.Equal(t, errBrokenIterator, err, "A failed range query must fail the insertion")
+		_, _, err = broken.Remove(ctx, hasher.Do(util.Uint64AsBytes(0)))
+		require.Equal(t, errBrokenIterator, err, "A failed range query must fail the removal")
+		_, _, err = broken.Get(ctx, hasher.Do(util.Uint64AsBytes(0)))
+		require.Equal(t, errBrokenIterator, err, "A failed range query must fail the search")
+
+		_, err = store.Get(ctx, common.IndexPrefix, key)
+		require.Equal(t, common.ErrKeyNotFound, err, "Failed insertions must not be persisted")
+		after, err := common.CollectRange(store.GetAll(ctx, common.HyperCachePrefix))
+		require.NoError(t, err)
+		require.Equal(t, before, after, "Failed operations must not touch the cache")
+	}
+}
+
+var errBrokenRead = errors.New("broken read")
+
+// brokenReadStore fails the reads of cached digests while broken is set.
+type brokenReadStore struct {
+	common.Store
+	broken *bool
+}
+
+func (s brokenReadStore) Get(ctx context.Context, prefix byte, key []byte) (*common.KVPair, error) {
+	if *s.broken && prefix == common.HyperCachePrefix {
+		return nil, errBrokenRead
+	}
+	return s.Store.Get(ctx, prefix, key)
+}
+
+func TestBrokenCacheReads(t *testing.T) {
+
+	log.SetLogger("TestBrokenCacheReads", log.SILENT)
+
+	hasher := common.NewSha256Hasher()
+	store := bplus.NewBPlusTreeStorage()
+	broken := false
+	faulty := brokenReadStore{store, &broken}
+	// the digests evicted from the first level are read again from the store
+	cache := common.NewTwoLevelCacheWithFirstLevel(common.NewLRUCache(4), common.NewPassThroughCache(common.HyperCachePrefix, faulty))
+	tree := NewHyperTree(common.NewSha256Hasher(), faulty, cache, hasher.Len()-4)
+	reference := NewHyperTree(common.NewSha256Hasher(), bplus.NewBPlusTreeStorage(), common.NewSimpleCache(10), hasher.Len()-4)
+	for i := uint64(0); i < 50; i++ {
+		key := hasher.Do(util.Uint64AsBytes(i))
+		commitment, err := tree.Add(ctx, key, i)
+		require.NoError(t, err)
+		expected, err := reference.Add(ctx, key, i)
+		require.NoError(t, err)
+		require.Equalf(t, expected.Digest, commitment.Digest, "Incorrect root hash for index %d", i)
 	}
+	before, err := common.CollectRange(store.GetAll(ctx, common.HyperCachePrefix))
+	require.NoError(t, err)
+
+	broken = true
+	key := hasher.Do(util.Uint64AsBytes(50))
+	_, err = tree.Add(ctx, key, 50)
+	require.Equal(t, errBrokenRead, err, "A failed cache read must fail the insertion")
+	_, _, err = tree.Remove(ctx, hasher.Do(util.Uint64AsBytes(0)))
+	require.Equal(t, errBrokenRead, err, "A failed cache read must fail the removal")
+	_, _, err = tree.Get(ctx, hasher.Do(util.Uint64AsBytes(0)))
+	require.Equal(t, errBrokenRead, err, "A failed cache read must fail the search")
+
+	_, err = store.Get(ctx, common.IndexPrefix, key)
+	require.Equal(t, common.ErrKeyNotFound, err, "Failed insertions must not be persisted")
+	after, err := common.CollectRange(store.GetAll(ctx, common.HyperCachePrefix))
+	require.NoError(t, err)
+	require.Equal(t, before, after, "Failed operations must not touch the cache")
+
+	broken = false
+	commitment, err := tree.Add(ctx, key, 50)
+	require.NoError(t, err)
+	expected, err := reference.Add(ctx, key, 50)
+	require.NoError(t, err)
+	require.Equal(t, expected.Digest, commitment.Digest, "A failed read must not corrupt later insertions")
 }
@@ -0,0 +1,233 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Entry is a log line before being encoded.
+type Entry struct {
+	Time      time.Time
+	Level     Level
+	Component string
+	File      string
+	Line      int
+	Message   string
+	Fields    []Field
+}
+
+// Encoder writes entries to a buffer, one per line.
+type Encoder interface {
+	Encode(buf *bytes.Buffer, entry *Entry)
+}
+
+// TextEncoder writes human readable lines in the format of the standard
+// logger, followed by the fields as key=value pairs:
+//
+//	hyper: 2006/01/02 15:04:05.000000 DEBUG tree.go:96: Adding event event=0a version=3
+type TextEncoder struct{}
+
+func NewTextEncoder() Encoder {
+	return TextEncoder{}
+}
+
+const textTimeLayout = "2006/01/02 15:04:05.000000"
+
+func (TextEncoder) Encode(buf *bytes.Buffer, entry *Entry) {
+	if entry.Component != "" {
+		buf.WriteString(entry.Component)
+		buf.WriteString(": ")
+	}
+	var scratch [64]byte
+	buf.Write(entry.Time.AppendFormat(scratch[:0], textTimeLayout))
+	buf.WriteByte(' ')
+	buf.WriteString(entry.Level.upper())
+	if entry.File != "" {
+		buf.WriteByte(' ')
+		buf.WriteString(entry.File)
+		buf.WriteByte(':')
+		buf.Write(strconv.AppendInt(scratch[:0], int64(entry.Line), 10))
+		buf.WriteByte(':')
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(entry.Message)
+	for _, f := range entry.Fields {
+		buf.WriteByte(' ')
+		buf.WriteString(f.Key)
+		buf.WriteByte('=')
+		appendTextValue(buf, f)
+	}
+	buf.WriteByte('\n')
+}
+
+func appendTextValue(buf *bytes.Buffer, f Field) {
+	var scratch [32]byte
+	switch f.typ {
+	case stringField:
+		appendTextString(buf, f.str)
+	case intField:
+		buf.Write(strconv.AppendInt(scratch[:0], int64(f.num), 10))
+	case uintField:
+		buf.Write(strconv.AppendUint(scratch[:0], f.num, 10))
+	case boolField:
+		buf.Write(strconv.AppendBool(scratch[:0], f.num == 1))
+	case durationField:
+		buf.WriteString(time.Duration(f.num).String())
+	case hexField:
+		appendHex(buf, f.bytes)
+	case stringerField:
+		if f.value == nil {
+			buf.WriteString("<nil>")
+			return
+		}
+		appendTextString(buf, f.value.(fmt.Stringer).String())
+	case errorField:
+		if f.value == nil {
+			buf.WriteString("<nil>")
+			return
+		}
+		appendTextString(buf, f.value.(error).Error())
+	default:
+		appendTextString(buf, fmt.Sprint(f.value))
+	}
+}
+
+// appendTextString quotes the values that could not be told apart from the
+// surrounding pairs otherwise.
+func appendTextString(buf *bytes.Buffer, s string) {
+	if s != "" && !strings.ContainsAny(s, " =\"\t\r\n") {
+		buf.WriteString(s)
+		return
+	}
+	buf.WriteString(strconv.Quote(s))
+}
+
+// JSONEncoder writes one JSON object per line, with the fields after the
+// time, level, component, caller and msg keys.
+type JSONEncoder struct{}
+
+func NewJSONEncoder() Encoder {
+	return JSONEncoder{}
+}
+
+func (JSONEncoder) Encode(buf *bytes.Buffer, entry *Entry) {
+	var scratch [64]byte
+	buf.WriteString(`{"time":"`)
+	buf.Write(entry.Time.AppendFormat(scratch[:0], time.RFC3339Nano))
+	buf.WriteString(`","level":"`)
+	buf.WriteString(entry.Level.String())
+	buf.WriteByte('"')
+	if entry.Component != "" {
+		buf.WriteString(`,"component":`)
+		appendJSONString(buf, entry.Component)
+	}
+	if entry.File != "" {
+		buf.WriteString(`,"caller":"`)
+		appendJSONEscaped(buf, entry.File)
+		buf.WriteByte(':')
+		buf.Write(strconv.AppendInt(scratch[:0], int64(entry.Line), 10))
+		buf.WriteByte('"')
+	}
+	buf.WriteString(`,"msg":`)
+	appendJSONString(buf, entry.Message)
+	for _, f := range entry.Fields {
+		buf.WriteByte(',')
+		appendJSONString(buf, f.Key)
+		buf.WriteByte(':')
+		appendJSONValue(buf, f)
+	}
+	buf.WriteString("}\n")
+}
+
+func appendJSONValue(buf *bytes.Buffer, f Field) {
+	var scratch [32]byte
+	switch f.typ {
+	case stringField:
+		appendJSONString(buf, f.str)
+	case intField:
+		buf.Write(strconv.AppendInt(scratch[:0], int64(f.num), 10))
+	case uintField:
+		buf.Write(strconv.AppendUint(scratch[:0], f.num, 10))
+	case boolField:
+		buf.Write(strconv.AppendBool(scratch[:0], f.num == 1))
+	case durationField:
+		appendJSONString(buf, time.Duration(f.num).String())
+	case hexField:
+		buf.WriteByte('"')
+		appendHex(buf, f.bytes)
+		buf.WriteByte('"')
+	case stringerField:
+		if f.value == nil {
+			buf.WriteString("null")
+			return
+		}
+		appendJSONString(buf, f.value.(fmt.Stringer).String())
+	case errorField:
+		if f.value == nil {
+			buf.WriteString("null")
+			return
+		}
+		appendJSONString(buf, f.value.(error).Error())
+	default:
+		encoded, err := json.Marshal(f.value)
+		if err != nil {
+			appendJSONString(buf, fmt.Sprint(f.value))
+			return
+		}
+		buf.Write(encoded)
+	}
+}
+
+func appendJSONString(buf *bytes.Buffer, s string) {
+	buf.WriteByte('"')
+	appendJSONEscaped(buf, s)
+	buf.WriteByte('"')
+}
+
+const hexDigits = "0123456789abcdef"
+
+func appendJSONEscaped(buf *bytes.Buffer, s string) {
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				buf.WriteByte('\\')
+				buf.WriteByte(c)
+			case c == '\n':
+				buf.WriteString(`\n`)
+			case c == '\r':
+				buf.WriteString(`\r`)
+			case c == '\t':
+				buf.WriteString(`\t`)
+			case c < 0x20:
+				buf.WriteString(`\u00`)
+				buf.WriteByte(hexDigits[c>>4])
+				buf.WriteByte(hexDigits[c&0xf])
+			default:
+				buf.WriteByte(c)
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			buf.WriteString("\ufffd")
+		} else {
+			buf.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+}
+
+func appendHex(buf *bytes.Buffer, value []byte) {
+	for _, b := range value {
+		buf.WriteByte(hexDigits[b>>4])
+		buf.WriteByte(hexDigits[b&0xf])
+	}
+}
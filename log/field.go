@@ -0,0 +1,78 @@
+package log
+
+import (
+	"fmt"
+	"time"
+)
+
+type fieldType uint8
+
+const (
+	stringField fieldType = iota
+	intField
+	uintField
+	boolField
+	durationField
+	hexField
+	stringerField
+	errorField
+	anyField
+)
+
+// Field is a key/value pair attached to a log entry. Fields are built with
+// the typed constructors below, which do not allocate, and are only encoded
+// when the entry is written.
+type Field struct {
+	Key   string
+	typ   fieldType
+	num   uint64
+	str   string
+	bytes []byte
+	value interface{}
+}
+
+func String(key, value string) Field {
+	return Field{Key: key, typ: stringField, str: value}
+}
+
+func Int(key string, value int) Field {
+	return Field{Key: key, typ: intField, num: uint64(value)}
+}
+
+func Uint64(key string, value uint64) Field {
+	return Field{Key: key, typ: uintField, num: value}
+}
+
+func Bool(key string, value bool) Field {
+	var num uint64
+	if value {
+		num = 1
+	}
+	return Field{Key: key, typ: boolField, num: num}
+}
+
+func Duration(key string, value time.Duration) Field {
+	return Field{Key: key, typ: durationField, num: uint64(value)}
+}
+
+// Hex encodes the value in hexadecimal, as digests are usually printed.
+func Hex(key string, value []byte) Field {
+	return Field{Key: key, typ: hexField, bytes: value}
+}
+
+// Stringer defers the call to String until the entry is written, so that
+// positions and other expensive values are not formatted for disabled levels.
+func Stringer(key string, value fmt.Stringer) Field {
+	return Field{Key: key, typ: stringerField, value: value}
+}
+
+// Err adds the error under the "error" key.
+func Err(err error) Field {
+	return Field{Key: "error", typ: errorField, value: err}
+}
+
+// Any encodes the value with fmt in text, or as JSON in JSON. Boxing the
+// value may allocate, so the typed constructors should be preferred.
+func Any(key string, value interface{}) Field {
+	return Field{Key: key, typ: anyField, value: value}
+}
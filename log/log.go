@@ -2,7 +2,7 @@ package log
 
 import (
 	"fmt"
-	"log"
+	"io"
 	"os"
 )
 
@@ -12,107 +12,139 @@ const (
 	ERROR  = "error"
 	INFO   = "info"
 	DEBUG  = "debug"
-
-	caller = 4
 )
 
-// Private interface for the std variable.
-type logger interface {
-	Error(v ...interface{})
-	Errorf(format string, v ...interface{})
-
-	Info(v ...interface{})
-	Infof(format string, v ...interface{})
-
-	Debug(v ...interface{})
-	Debugf(format string, v ...interface{})
-}
+// output is where the loggers created by SetLogger write.
+var output io.Writer = os.Stderr
 
 // The default logger is an log.ERROR level.
-var std logger = newError(os.Stdout, "Qed: ", log.Ldate|log.Ltime|log.Lmicroseconds|log.Lshortfile)
+var std = New(output, NewTextEncoder(), ErrorLevel)
 
 // To allow mocking we require a switchable variable.
 var osExit = os.Exit
 
-// Below is the public interface for the logger, a proxy for the switchable
-// implementation defined in std.
+// Default returns the logger used by the package level functions, from which
+// the component loggers are usually derived.
+func Default() *Logger {
+	return std
+}
 
-// Error is the public log function to write to stdOut and stop execution.
-func Error(v ...interface{}) {
-	std.Error(v...)
+// SetDefault replaces the logger used by the package level functions. The
+// loggers already derived from the previous one are not affected.
+func SetDefault(l *Logger) {
+	std = l
 }
 
-var (
+// SetOutput redirects the default logger, the component loggers derived from
+// it and the ones created later by SetLogger to the given writer. The output
+// is stderr by default.
+func SetOutput(out io.Writer) {
+	output = out
+	std.SetOutput(out)
+}
 
-	// Fatal is the public log function to write to stdOut and stop execution
-	// Same as Error.
-	Fatal func(...interface{}) = Error
+// Below is the public interface for the logger, a proxy for the default
+// logger.
 
-	// Panic is the public log function to write to stdOut and stop execution
-	// Same as Error.
-	Panic func(...interface{}) = Error
-)
+// Error is the public log function to write errors.
+func Error(msg string, fields ...Field) {
+	if !std.Enabled(ErrorLevel) {
+		return
+	}
+	std.write(ErrorLevel, 1, msg, fields)
+}
 
-// Errorf is the public log function with params to write to stdOut and stop
-// execution.
+// Errorf is the public log function to write errors with params.
 func Errorf(format string, v ...interface{}) {
-	std.Errorf(format, v...)
+	if !std.Enabled(ErrorLevel) {
+		return
+	}
+	std.write(ErrorLevel, 1, fmt.Sprintf(format, v...), nil)
+}
+
+// Fatal is the public log function to write an error and stop execution with
+// exit code 1.
+func Fatal(msg string, fields ...Field) {
+	if std.Enabled(ErrorLevel) {
+		std.write(ErrorLevel, 1, msg, fields)
+	}
+	osExit(1)
 }
 
-var (
+// Fatalf is the public log function with params to write an error and stop
+// execution with exit code 1.
+func Fatalf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	if std.Enabled(ErrorLevel) {
+		std.write(ErrorLevel, 1, msg, nil)
+	}
+	osExit(1)
+}
 
-	// Fatalf is the public log function with params to write to stdOut and
-	// stop execution. Same as Errorf
-	Fatalf func(string, ...interface{}) = Errorf
+// Panic is the public log function to write an error and panic with the
+// message.
+func Panic(msg string, fields ...Field) {
+	if std.Enabled(ErrorLevel) {
+		std.write(ErrorLevel, 1, msg, fields)
+	}
+	panic(msg)
+}
 
-	// Panicf is the public log function with params to write to stdOut and
-	// stop execution. Same as Errorf
-	Panicf func(string, ...interface{}) = Errorf
-)
+// Panicf is the public log function with params to write an error and panic
+// with the message.
+func Panicf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	if std.Enabled(ErrorLevel) {
+		std.write(ErrorLevel, 1, msg, nil)
+	}
+	panic(msg)
+}
 
 // Info is the public log function to write information relative to the usage
-// of the qed package.
-func Info(v ...interface{}) {
-	std.Info(v...)
+// of the package.
+func Info(msg string, fields ...Field) {
+	if !std.Enabled(InfoLevel) {
+		return
+	}
+	std.write(InfoLevel, 1, msg, fields)
 }
 
-// Info is the public log function to write information with params relative
-// to the usage of the qed package.
+// Infof is the public log function to write information with params relative
+// to the usage of the package.
 func Infof(format string, v ...interface{}) {
-	std.Infof(format, v...)
+	if !std.Enabled(InfoLevel) {
+		return
+	}
+	std.write(InfoLevel, 1, fmt.Sprintf(format, v...), nil)
 }
 
 // Debug is the public log function to write information relative to internal
 // debug information.
-func Debug(v ...interface{}) {
-	std.Debug(v...)
+func Debug(msg string, fields ...Field) {
+	if !std.Enabled(DebugLevel) {
+		return
+	}
+	std.write(DebugLevel, 1, msg, fields)
 }
 
 // Debugf is the public log function to write information with params relative
 // to internal debug information.
 func Debugf(format string, v ...interface{}) {
-	std.Debugf(format, v...)
+	if !std.Enabled(DebugLevel) {
+		return
+	}
+	std.write(DebugLevel, 1, fmt.Sprintf(format, v...), nil)
 }
 
-// SetLogger is a function that switches between verbosity loggers. Default
-// is error level. Available levels are "silent", "debug", "info" and "error".
+// SetLogger is a function that switches the default logger to a text logger
+// of the given verbosity. Default is error level. Available levels are
+// "silent", "debug", "info" and "error".
 func SetLogger(namespace, level string) {
-
-	prefix := fmt.Sprintf("%s: ", namespace)
-
-	switch level {
-	case SILENT:
-		std = newSilent()
-	case ERROR:
-		std = newError(os.Stdout, prefix, log.Ldate|log.Ltime|log.Lmicroseconds|log.Lshortfile)
-	case INFO:
-		std = newInfo(os.Stdout, prefix, log.Ldate|log.Ltime|log.Lmicroseconds|log.Lshortfile)
-	case DEBUG:
-		std = newDebug(os.Stdout, prefix, log.Ldate|log.Ltime|log.Lmicroseconds|log.Lshortfile)
-	default:
-		l := newInfo(os.Stdout, prefix, log.Ldate|log.Ltime|log.Lmicroseconds|log.Lshortfile)
-		l.Infof("Incorrect level of verbosity (%v) fallback to log.INFO", level)
-		std = l
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		std = New(output, NewTextEncoder(), InfoLevel).Named(namespace)
+		std.Info("Incorrect level of verbosity, fallback to log.INFO", String("level", level))
+		return
 	}
-
+	std = New(output, NewTextEncoder(), lvl).Named(namespace)
 }
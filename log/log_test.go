@@ -0,0 +1,117 @@
+package log
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockExit replaces osExit to record the exit codes instead of terminating
+// the test binary.
+func mockExit(t *testing.T) *[]int {
+	codes := new([]int)
+	previous := osExit
+	osExit = func(code int) {
+		*codes = append(*codes, code)
+	}
+	t.Cleanup(func() {
+		osExit = previous
+	})
+	return codes
+}
+
+// captureOutput points the package output to a buffer for the duration of
+// the test.
+func captureOutput(t *testing.T) *bytes.Buffer {
+	previousOutput, previousDefault := output, std
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	t.Cleanup(func() {
+		output, std = previousOutput, previousDefault
+	})
+	return &buf
+}
+
+func TestFatal(t *testing.T) {
+	codes := mockExit(t)
+	buf := captureOutput(t)
+
+	SetLogger("TestFatal", ERROR)
+	Fatal("cannot open store", String("path", "/tmp/db"))
+	Fatalf("cannot open store %s", "/tmp/other")
+	Default().Named("balloon").Fatal("diverged")
+
+	require.Equal(t, []int{1, 1, 1}, *codes)
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, 3)
+	assert.Contains(t, lines[0], "ERROR log_test.go:")
+	assert.True(t, strings.HasSuffix(lines[0], "cannot open store path=/tmp/db"))
+	assert.True(t, strings.HasSuffix(lines[1], "cannot open store /tmp/other"))
+	assert.True(t, strings.HasPrefix(lines[2], "TestFatal.balloon: "))
+
+	buf.Reset()
+	SetLogger("TestFatal", SILENT)
+	Fatal("silently")
+	require.Equal(t, []int{1, 1, 1, 1}, *codes, "Silent loggers must exit too")
+	require.Empty(t, buf.String())
+}
+
+func TestPanic(t *testing.T) {
+	codes := mockExit(t)
+	buf := captureOutput(t)
+
+	SetLogger("TestPanic", ERROR)
+	assert.PanicsWithValue(t, "inconsistent cache", func() {
+		Panic("inconsistent cache", Int("entries", 3))
+	})
+	assert.PanicsWithValue(t, "inconsistent cache at 3", func() {
+		Panicf("inconsistent cache at %d", 3)
+	})
+	assert.PanicsWithValue(t, "wrong audit path", func() {
+		Default().Named("hyper").Panic("wrong audit path")
+	})
+	assert.Empty(t, *codes, "Panics must not exit")
+	assert.Equal(t, 3, strings.Count(buf.String(), "\n"))
+	assert.Contains(t, buf.String(), "inconsistent cache entries=3")
+}
+
+func TestSetOutput(t *testing.T) {
+	buf := captureOutput(t)
+
+	SetLogger("TestSetOutput", INFO)
+	component := Default().Named("history")
+
+	var redirected bytes.Buffer
+	SetOutput(&redirected)
+	component.Info("written")
+	Info("written too")
+	SetLogger("TestSetOutput", INFO)
+	Info("and after switching loggers")
+
+	assert.Empty(t, buf.String())
+	assert.Equal(t, 3, strings.Count(redirected.String(), "\n"))
+}
+
+func TestFatalExitsProcess(t *testing.T) {
+	if os.Getenv("LOG_TEST_FATAL") == "1" {
+		Fatal("exiting", Int("code", 1))
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestFatalExitsProcess$")
+	cmd.Env = append(os.Environ(), "LOG_TEST_FATAL=1")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+
+	exitErr, ok := err.(*exec.ExitError)
+	require.True(t, ok, "The process must fail, got %v", err)
+	require.Equal(t, 1, exitErr.ExitCode())
+	require.Contains(t, stderr.String(), "exiting code=1", "Errors must be written to stderr")
+	require.NotContains(t, stdout.String(), "exiting")
+}
@@ -0,0 +1,210 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Level is the severity of an entry. Loggers drop the entries below their
+// level.
+type Level int8
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	ErrorLevel
+	SilentLevel
+)
+
+var levelNames = [...]string{DEBUG, INFO, ERROR, SILENT}
+
+var upperLevelNames = [...]string{"DEBUG", "INFO", "ERROR", "SILENT"}
+
+func (l Level) String() string {
+	if l < DebugLevel || l > SilentLevel {
+		return fmt.Sprintf("level(%d)", l)
+	}
+	return levelNames[l]
+}
+
+func (l Level) upper() string {
+	if l < DebugLevel || l > SilentLevel {
+		return l.String()
+	}
+	return upperLevelNames[l]
+}
+
+// ParseLevel accepts the same names as SetLogger.
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if n == name {
+			return Level(i), nil
+		}
+	}
+	return SilentLevel, fmt.Errorf("unknown log level %q", name)
+}
+
+// sink is shared by a logger and all the loggers derived from it, so that
+// their lines are not interleaved.
+type sink struct {
+	lock sync.Mutex
+	out  io.Writer
+}
+
+func (s *sink) write(p []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.out.Write(p)
+}
+
+// Logger writes structured entries with an encoder. Named and With return
+// new loggers sharing the same output, so SetOutput redirects all of them.
+//
+// Logging at a disabled level does not allocate as long as the fields are
+// built with the typed constructors, so there is no need to guard calls on
+// hot paths. Formatting the message, as the f-suffixed functions of the
+// package do, is only done for enabled levels but boxing their arguments may
+// still allocate.
+type Logger struct {
+	sink      *sink
+	encoder   Encoder
+	level     Level
+	component string
+	fields    []Field
+	now       func() time.Time
+}
+
+func New(out io.Writer, encoder Encoder, level Level) *Logger {
+	return &Logger{
+		sink:    &sink{out: out},
+		encoder: encoder,
+		level:   level,
+		now:     time.Now,
+	}
+}
+
+// Named returns a logger for a component. Nested components are joined with
+// dots.
+func (l *Logger) Named(component string) *Logger {
+	named := *l
+	if l.component == "" {
+		named.component = component
+	} else {
+		named.component = l.component + "." + component
+	}
+	return &named
+}
+
+// With returns a logger that adds the fields to all of its entries.
+func (l *Logger) With(fields ...Field) *Logger {
+	with := *l
+	with.fields = make([]Field, 0, len(l.fields)+len(fields))
+	with.fields = append(with.fields, l.fields...)
+	with.fields = append(with.fields, fields...)
+	return &with
+}
+
+// SetOutput redirects the logger and all the loggers sharing its output to
+// the given writer.
+func (l *Logger) SetOutput(out io.Writer) {
+	l.sink.lock.Lock()
+	defer l.sink.lock.Unlock()
+	l.sink.out = out
+}
+
+func (l *Logger) Level() Level {
+	return l.level
+}
+
+// Enabled is meant to guard the debug output that is expensive to build
+// even before being logged, like printing a whole pruned tree.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level && level < SilentLevel
+}
+
+func (l *Logger) Debug(msg string, fields ...Field) {
+	if !l.Enabled(DebugLevel) {
+		return
+	}
+	l.write(DebugLevel, 1, msg, fields)
+}
+
+func (l *Logger) Info(msg string, fields ...Field) {
+	if !l.Enabled(InfoLevel) {
+		return
+	}
+	l.write(InfoLevel, 1, msg, fields)
+}
+
+func (l *Logger) Error(msg string, fields ...Field) {
+	if !l.Enabled(ErrorLevel) {
+		return
+	}
+	l.write(ErrorLevel, 1, msg, fields)
+}
+
+// Fatal writes the entry at the error level and terminates the process with
+// exit code 1, even if the logger is silent.
+func (l *Logger) Fatal(msg string, fields ...Field) {
+	if l.Enabled(ErrorLevel) {
+		l.write(ErrorLevel, 1, msg, fields)
+	}
+	osExit(1)
+}
+
+// Panic writes the entry at the error level and panics with the message,
+// even if the logger is silent.
+func (l *Logger) Panic(msg string, fields ...Field) {
+	if l.Enabled(ErrorLevel) {
+		l.write(ErrorLevel, 1, msg, fields)
+	}
+	panic(msg)
+}
+
+// entryPool keeps the buffers of the entries being written, so that logging
+// at an enabled level does not allocate either unless a field needs to.
+var entryPool = sync.Pool{
+	New: func() interface{} {
+		return new(pooledEntry)
+	},
+}
+
+type pooledEntry struct {
+	entry Entry
+	buf   bytes.Buffer
+}
+
+// write encodes the entry and writes it. The fields are copied to a pooled
+// entry before being handed to the encoder so that callers can keep their
+// variadic arguments on the stack. skip is the number of frames between the
+// caller of the logger and write.
+func (l *Logger) write(level Level, skip int, msg string, fields []Field) {
+	pooled := entryPool.Get().(*pooledEntry)
+	entry := &pooled.entry
+	entry.Time = l.now()
+	entry.Level = level
+	entry.Component = l.component
+	entry.Message = msg
+	entry.Fields = append(append(entry.Fields[:0], l.fields...), fields...)
+	if _, file, line, ok := runtime.Caller(skip + 1); ok {
+		entry.File, entry.Line = filepath.Base(file), line
+	} else {
+		entry.File, entry.Line = "", 0
+	}
+
+	pooled.buf.Reset()
+	l.encoder.Encode(&pooled.buf, entry)
+	l.sink.write(pooled.buf.Bytes())
+
+	// do not keep the values alive while pooled
+	for i := range entry.Fields {
+		entry.Fields[i] = Field{}
+	}
+	entry.Fields = entry.Fields[:0]
+	entryPool.Put(pooled)
+}
@@ -0,0 +1,173 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testTime = time.Date(2019, 3, 14, 15, 9, 26, 535000000, time.UTC)
+
+func newTestLogger(buf *bytes.Buffer, encoder Encoder, level Level) *Logger {
+	l := New(buf, encoder, level)
+	l.now = func() time.Time { return testTime }
+	return l
+}
+
+// countingStringer records whether it has been formatted.
+type countingStringer struct {
+	calls int
+}
+
+func (s *countingStringer) String() string {
+	s.calls++
+	return "Pos(00, 8)"
+}
+
+func TestTextEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newTestLogger(&buf, NewTextEncoder(), InfoLevel).Named("balloon").Named("hyper").With(String("tree", "main"))
+
+	_, _, line, _ := runtime.Caller(0)
+	logger.Info("Adding event", Hex("event", []byte{0x0a, 0xff}), Uint64("version", 3), Int("delta", -1),
+		Bool("cached", true), Duration("took", 1500*time.Millisecond), String("note", "two words"), Err(errors.New("boom")))
+
+	expected := fmt.Sprintf("balloon.hyper: 2019/03/14 15:09:26.535000 INFO logger_test.go:%d: Adding event "+
+		"tree=main event=0aff version=3 delta=-1 cached=true took=1.5s note=\"two words\" error=boom\n", line+1)
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestJSONEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newTestLogger(&buf, NewJSONEncoder(), DebugLevel).Named("history")
+
+	logger.Debug("Proving \"consistency\"\n", Uint64("start", 1), Uint64("end", 8),
+		Stringer("position", &countingStringer{}), Err(nil), Any("versions", []int{1, 8}), String("control", "\x01"))
+
+	var decoded map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded), "Entries must be valid JSON: %s", buf.String())
+	assert.Equal(t, "2019-03-14T15:09:26.535Z", decoded["time"])
+	assert.Equal(t, "debug", decoded["level"])
+	assert.Equal(t, "history", decoded["component"])
+	assert.True(t, strings.HasPrefix(decoded["caller"].(string), "logger_test.go:"))
+	assert.Equal(t, "Proving \"consistency\"\n", decoded["msg"])
+	assert.Equal(t, float64(1), decoded["start"])
+	assert.Equal(t, float64(8), decoded["end"])
+	assert.Equal(t, "Pos(00, 8)", decoded["position"])
+	assert.Nil(t, decoded["error"])
+	assert.Equal(t, []interface{}{float64(1), float64(8)}, decoded["versions"])
+	assert.Equal(t, "\x01", decoded["control"])
+	assert.True(t, strings.HasSuffix(buf.String(), "}\n"), "Entries must be written one per line")
+}
+
+func TestLevels(t *testing.T) {
+	for _, name := range []string{DEBUG, INFO, ERROR, SILENT} {
+		level, err := ParseLevel(name)
+		require.NoError(t, err)
+		require.Equal(t, name, level.String())
+	}
+	_, err := ParseLevel("verbose")
+	require.Error(t, err)
+
+	var buf bytes.Buffer
+	stringer := new(countingStringer)
+	logger := newTestLogger(&buf, NewTextEncoder(), ErrorLevel)
+	logger.Debug("debug", Stringer("position", stringer))
+	logger.Info("info", Stringer("position", stringer))
+	require.Empty(t, buf.String(), "Entries below the level must be dropped")
+	require.Equal(t, 0, stringer.calls, "Fields of dropped entries must not be formatted")
+
+	logger.Error("error", Stringer("position", stringer))
+	require.Contains(t, buf.String(), "ERROR")
+	require.Equal(t, 1, stringer.calls)
+
+	buf.Reset()
+	silent := newTestLogger(&buf, NewTextEncoder(), SilentLevel)
+	silent.Error("error")
+	require.False(t, silent.Enabled(SilentLevel))
+	require.Empty(t, buf.String(), "Silent loggers must not write anything")
+}
+
+func TestDefaultLogger(t *testing.T) {
+	defer SetDefault(Default())
+
+	var buf bytes.Buffer
+	SetDefault(newTestLogger(&buf, NewTextEncoder(), InfoLevel))
+	Debugf("dropped %d", 1)
+	Infof("written %d", 2)
+	Info("structured", Int("n", 3))
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[0], "logger_test.go:")
+	assert.True(t, strings.HasSuffix(lines[0], "written 2"))
+	assert.True(t, strings.HasSuffix(lines[1], "structured n=3"))
+}
+
+func TestDisabledLevelsDoNotAllocate(t *testing.T) {
+	logger := New(ioutil.Discard, NewTextEncoder(), InfoLevel).Named("hyper")
+	stringer := new(countingStringer)
+	digest := []byte{0x0a, 0xff}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		logger.Debug("Computing node hash", Stringer("position", stringer), Hex("event", digest), Uint64("version", 3))
+	})
+	require.Equal(t, float64(0), allocs)
+
+	defer SetDefault(Default())
+	SetDefault(logger)
+	allocs = testing.AllocsPerRun(100, func() {
+		Debug("Computing node hash", Stringer("position", stringer), Uint64("version", 3))
+	})
+	require.Equal(t, float64(0), allocs)
+}
+
+func BenchmarkDisabled(b *testing.B) {
+	logger := New(ioutil.Discard, NewTextEncoder(), InfoLevel)
+	stringer := new(countingStringer)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		logger.Debug("Computing node hash", Stringer("position", stringer), Uint64("version", uint64(i)))
+	}
+}
+
+func BenchmarkDisabledf(b *testing.B) {
+	defer SetDefault(Default())
+	SetDefault(New(ioutil.Discard, NewTextEncoder(), InfoLevel))
+	stringer := new(countingStringer)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Debugf("Computing node hash in position %v with version %d", stringer, i)
+	}
+}
+
+func BenchmarkText(b *testing.B) {
+	logger := New(ioutil.Discard, NewTextEncoder(), DebugLevel).Named("hyper")
+	stringer := new(countingStringer)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		logger.Debug("Computing node hash", Stringer("position", stringer), Uint64("version", uint64(i)))
+	}
+}
+
+func BenchmarkJSON(b *testing.B) {
+	logger := New(ioutil.Discard, NewJSONEncoder(), DebugLevel).Named("hyper")
+	stringer := new(countingStringer)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		logger.Debug("Computing node hash", Stringer("position", stringer), Uint64("version", uint64(i)))
+	}
+}
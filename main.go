@@ -1,5 +1,11 @@
 package main
 
-func main() {
+import (
+	"os"
+
+	"github.com/aalda/trees/cli"
+)
 
+func main() {
+	os.Exit(cli.Main(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
 }
@@ -0,0 +1,160 @@
+// Package metrics collects the counters reported by the trees and exposes
+// them in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const namespace = "trees"
+
+// CacheCounters implements common.CacheMetrics for a single cache layer.
+type CacheCounters struct {
+	hits, misses, fallbacks, storeErrors uint64
+}
+
+func (c *CacheCounters) Hit()        { atomic.AddUint64(&c.hits, 1) }
+func (c *CacheCounters) Miss()       { atomic.AddUint64(&c.misses, 1) }
+func (c *CacheCounters) Fallback()   { atomic.AddUint64(&c.fallbacks, 1) }
+func (c *CacheCounters) StoreError() { atomic.AddUint64(&c.storeErrors, 1) }
+
+func (c *CacheCounters) Hits() uint64        { return atomic.LoadUint64(&c.hits) }
+func (c *CacheCounters) Misses() uint64      { return atomic.LoadUint64(&c.misses) }
+func (c *CacheCounters) Fallbacks() uint64   { return atomic.LoadUint64(&c.fallbacks) }
+func (c *CacheCounters) StoreErrors() uint64 { return atomic.LoadUint64(&c.storeErrors) }
+
+// Registry keeps the counters of every instrumented component and serves
+// them over HTTP.
+type Registry struct {
+	lock   sync.Mutex
+	caches map[string]*CacheCounters
+	trees  map[string]*TreeHistograms
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		caches: make(map[string]*CacheCounters),
+		trees:  make(map[string]*TreeHistograms),
+	}
+}
+
+// Cache returns the counters of the named cache layer, creating them the
+// first time.
+func (r *Registry) Cache(layer string) *CacheCounters {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	counters, ok := r.caches[layer]
+	if !ok {
+		counters = new(CacheCounters)
+		r.caches[layer] = counters
+	}
+	return counters
+}
+
+// Tree returns the histograms of the named tree, creating them the first
+// time.
+func (r *Registry) Tree(name string) *TreeHistograms {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	histograms, ok := r.trees[name]
+	if !ok {
+		histograms = newTreeHistograms()
+		r.trees[name] = histograms
+	}
+	return histograms
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// WriteTo writes all the metrics in the Prometheus text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.lock.Lock()
+	layers := make([]string, 0, len(r.caches))
+	caches := make(map[string]*CacheCounters, len(r.caches))
+	for layer, counters := range r.caches {
+		layers = append(layers, layer)
+		caches[layer] = counters
+	}
+	names := make([]string, 0, len(r.trees))
+	trees := make(map[string]*TreeHistograms, len(r.trees))
+	for name, histograms := range r.trees {
+		names = append(names, name)
+		trees[name] = histograms
+	}
+	r.lock.Unlock()
+	sort.Strings(layers)
+	sort.Strings(names)
+
+	out := &countingWriter{w: bufio.NewWriter(w)}
+	cacheFamilies := []struct {
+		name, help string
+		value      func(*CacheCounters) uint64
+	}{
+		{"cache_hits_total", "Reads served by a cache layer.", (*CacheCounters).Hits},
+		{"cache_misses_total", "Reads not found in a cache layer.", (*CacheCounters).Misses},
+		{"cache_fallbacks_total", "Reads answered with a default hash.", (*CacheCounters).Fallbacks},
+		{"cache_store_errors_total", "Reads that failed in the underlying store.", (*CacheCounters).StoreErrors},
+	}
+	for _, f := range cacheFamilies {
+		writeHeader(out, f.name, f.help, "counter")
+		for _, layer := range layers {
+			fmt.Fprintf(out, "%s_%s{layer=\"%s\"} %d\n", namespace, f.name, escapeLabel(layer), f.value(caches[layer]))
+		}
+	}
+	for family, f := range treeFamilies {
+		writeHeader(out, f.name, f.help, "histogram")
+		for _, name := range names {
+			trees[name].write(out, family, name)
+		}
+	}
+	return out.n, out.flush()
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s_%s %s\n", namespace, name, help)
+	fmt.Fprintf(w, "# TYPE %s_%s %s\n", namespace, name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
+
+func (c *countingWriter) flush() error {
+	if c.err != nil {
+		return c.err
+	}
+	return c.w.Flush()
+}
@@ -0,0 +1,161 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aalda/trees/common"
+	"github.com/aalda/trees/hyper"
+	"github.com/aalda/trees/storage/bplus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var ctx = context.Background()
+
+var _ common.CacheMetrics = new(CacheCounters)
+
+type failingStore struct {
+	common.Store
+}
+
+func (s failingStore) Get(ctx context.Context, prefix byte, key []byte) (*common.KVPair, error) {
+	return nil, errors.New("broken store")
+}
+
+func get(t *testing.T, handler http.Handler) string {
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/plain; version=0.0.4; charset=utf-8", resp.Header.Get("Content-Type"))
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestCacheMetrics(t *testing.T) {
+	registry := NewRegistry()
+	store := bplus.NewBPlusTreeStorage()
+	present := hyper.NewPosition([]byte{0x0}, 4)
+	absent := hyper.NewPosition([]byte{0x10}, 4)
+	require.NoError(t, store.Mutate(ctx, []common.Mutation{*common.NewMutation(common.HyperCachePrefix, present.Bytes(), common.Digest{0x1})}))
+
+	passThrough := common.NewPassThroughCache(common.HyperCachePrefix, store)
+	passThrough.SetMetrics(registry.Cache("store"))
+	twoLevel := common.NewTwoLevelCache(10, passThrough)
+	twoLevel.SetMetrics(registry.Cache("memory"))
+	fallback := common.NewFallbackCache([]byte{0x0}, 8, new(common.XorHasher), twoLevel)
+	fallback.SetMetrics(registry.Cache("fallback"))
+	broken := common.NewPassThroughCache(common.HyperCachePrefix, failingStore{store})
+	broken.SetMetrics(registry.Cache("broken"))
+
+	fallback.Get(ctx, present) // memory miss, store hit
+	fallback.Get(ctx, present) // memory hit
+	fallback.Get(ctx, absent)  // memory miss, store miss, fallback
+	broken.Get(ctx, present)   // store error
+
+	body := get(t, registry)
+	expected := []string{
+		`trees_cache_hits_total{layer="fallback"} 2`,
+		`trees_cache_hits_total{layer="memory"} 1`,
+		`trees_cache_hits_total{layer="store"} 1`,
+		`trees_cache_misses_total{layer="memory"} 2`,
+		`trees_cache_misses_total{layer="store"} 1`,
+		`trees_cache_fallbacks_total{layer="fallback"} 1`,
+		`trees_cache_store_errors_total{layer="broken"} 1`,
+		`trees_cache_store_errors_total{layer="store"} 0`,
+		"# TYPE trees_cache_hits_total counter",
+		"# HELP trees_cache_fallbacks_total Reads answered with a default hash.",
+	}
+	for _, line := range expected {
+		assert.Contains(t, body, line+"\n")
+	}
+}
+
+func TestSimpleCacheMetrics(t *testing.T) {
+	registry := NewRegistry()
+	cache := common.NewSimpleCache(10)
+	cache.SetMetrics(registry.Cache("simple"))
+	pos := hyper.NewPosition([]byte{0x0}, 4)
+
+	cache.Get(ctx, pos)
+	cache.Put(pos, common.Digest{0x1})
+	cache.Get(ctx, pos)
+
+	counters := registry.Cache("simple")
+	assert.Equal(t, uint64(1), counters.Hits())
+	assert.Equal(t, uint64(1), counters.Misses())
+}
+
+func TestLabelEscaping(t *testing.T) {
+	registry := NewRegistry()
+	registry.Cache("a \"quoted\"\\layer\n").Hit()
+
+	body := get(t, registry)
+	assert.Contains(t, body, `trees_cache_hits_total{layer="a \"quoted\"\\layer\n"} 1`)
+	assert.Equal(t, 1, strings.Count(body, "# TYPE trees_cache_hits_total counter"))
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	NewRegistry().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+}
+
+func TestTreeMetrics(t *testing.T) {
+	registry := NewRegistry()
+	store := bplus.NewBPlusTreeStorage()
+	tree := hyper.NewHyperTree(new(common.XorHasher), store, common.NewSimpleCache(10), 2)
+	tree.SetMetrics(registry.Tree("hyper"))
+
+	for i := 0; i < 2; i++ {
+		_, err := tree.Add(ctx, common.Digest{byte(i)}, uint64(i))
+		require.NoError(t, err)
+	}
+	_, proof, err := tree.Get(ctx, common.Digest{0x0})
+	require.NoError(t, err)
+
+	body := get(t, registry)
+	expected := []string{
+		"# TYPE trees_tree_operation_duration_seconds histogram",
+		`trees_tree_operation_duration_seconds_count{tree="hyper",operation="add"} 2`,
+		`trees_tree_operation_duration_seconds_bucket{tree="hyper",operation="add",le="+Inf"} 2`,
+		`trees_tree_operation_duration_seconds_count{tree="hyper",operation="get"} 1`,
+		`trees_tree_mutations_count{tree="hyper",operation="add"} 2`,
+		`trees_tree_nodes_visited_count{tree="hyper",operation="get"} 1`,
+		fmt.Sprintf(`trees_tree_audit_path_size_sum{tree="hyper",operation="get"} %d`, len(proof.AuditPath)),
+	}
+	for _, line := range expected {
+		assert.Contains(t, body, line+"\n")
+	}
+	// the first add writes the leaf and a cached node per level over the
+	// cache level
+	assert.Contains(t, body, `trees_tree_mutations_bucket{tree="hyper",operation="add",le="16"} 2`+"\n")
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{1, 2, 4})
+	for _, v := range []float64{0.5, 1, 3, 10} {
+		h.observe(v)
+	}
+
+	var out strings.Builder
+	h.write(&out, "x", `l="v"`)
+	assert.Equal(t, `x_bucket{l="v",le="1"} 2
+x_bucket{l="v",le="2"} 2
+x_bucket{l="v",le="4"} 3
+x_bucket{l="v",le="+Inf"} 4
+x_sum{l="v"} 14.5
+x_count{l="v"} 4
+`, out.String())
+}
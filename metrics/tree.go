@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// from 100µs to ~1.6s
+	latencyBuckets = exponentialBuckets(0.0001, 2, 15)
+	// from 1 to 4096
+	sizeBuckets = exponentialBuckets(1, 4, 7)
+)
+
+type treeFamily struct {
+	name, help string
+	buckets    []float64
+}
+
+var treeFamilies = []treeFamily{
+	{"tree_operation_duration_seconds", "Latency of the tree operations.", latencyBuckets},
+	{"tree_nodes_visited", "Nodes of the pruned tree visited by an operation.", sizeBuckets},
+	{"tree_mutations", "Mutations written to the store by an operation.", sizeBuckets},
+	{"tree_audit_path_size", "Digests in the audit path built or verified by an operation.", sizeBuckets},
+}
+
+const (
+	latencyFamily = iota
+	nodesVisitedFamily
+	mutationsFamily
+	auditPathSizeFamily
+	numTreeFamilies
+)
+
+// TreeHistograms implements common.TreeMetrics for a single tree, keeping a
+// histogram per operation for every measurement.
+type TreeHistograms struct {
+	lock       sync.Mutex
+	histograms [numTreeFamilies]map[string]*histogram
+}
+
+func newTreeHistograms() *TreeHistograms {
+	t := new(TreeHistograms)
+	for i := range t.histograms {
+		t.histograms[i] = make(map[string]*histogram)
+	}
+	return t
+}
+
+func (t *TreeHistograms) observe(family int, operation string, value float64) {
+	t.lock.Lock()
+	h, ok := t.histograms[family][operation]
+	if !ok {
+		h = newHistogram(treeFamilies[family].buckets)
+		t.histograms[family][operation] = h
+	}
+	t.lock.Unlock()
+	h.observe(value)
+}
+
+func (t *TreeHistograms) ObserveLatency(operation string, latency time.Duration) {
+	t.observe(latencyFamily, operation, latency.Seconds())
+}
+
+func (t *TreeHistograms) ObserveNodesVisited(operation string, nodes int) {
+	t.observe(nodesVisitedFamily, operation, float64(nodes))
+}
+
+func (t *TreeHistograms) ObserveMutations(operation string, mutations int) {
+	t.observe(mutationsFamily, operation, float64(mutations))
+}
+
+func (t *TreeHistograms) ObserveAuditPathSize(operation string, size int) {
+	t.observe(auditPathSizeFamily, operation, float64(size))
+}
+
+func (t *TreeHistograms) write(w io.Writer, family int, tree string) {
+	t.lock.Lock()
+	operations := make([]string, 0, len(t.histograms[family]))
+	for operation := range t.histograms[family] {
+		operations = append(operations, operation)
+	}
+	histograms := make([]*histogram, len(operations))
+	sort.Strings(operations)
+	for i, operation := range operations {
+		histograms[i] = t.histograms[family][operation]
+	}
+	t.lock.Unlock()
+
+	name := fmt.Sprintf("%s_%s", namespace, treeFamilies[family].name)
+	for i, operation := range operations {
+		labels := fmt.Sprintf("tree=\"%s\",operation=\"%s\"", escapeLabel(tree), escapeLabel(operation))
+		histograms[i].write(w, name, labels)
+	}
+}
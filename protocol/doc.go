@@ -0,0 +1,39 @@
+// Package protocol defines the JSON encoding of the proofs and commitments of
+// a balloon, shared by the tools that exchange them.
+//
+// Proofs are written as an envelope telling what they prove and the hasher
+// they were built with, so that they can be verified without any other
+// context:
+//
+//	{
+//	  "kind": "membership",
+//	  "hasher": "sha256",
+//	  "proof": {
+//	    "eventDigest": "5a7c...",
+//	    "version": 3,
+//	    "currentVersion": 9,
+//	    "hyperDigest": "e4b0...",
+//	    "auditPath": {"0|255": "1f3a...", "128|7": "09cd..."}
+//	  }
+//	}
+//
+// The kind is one of:
+//
+//	membership   the event was added with version, as of the hyper digest
+//	             committed by currentVersion.
+//	history      the event added with index, whose digest is eventDigest, is
+//	             part of the history digest committed by version.
+//	consistency  the history digest committed by end extends the one
+//	             committed by start, with startDigest and endDigest.
+//
+// The hasher is "sha256" or "xor". Digests are hexadecimal strings and audit
+// paths map the position identifiers of the trees to their digests. Versions
+// and indexes are plain JSON numbers.
+//
+// Commitments are written as bare objects with the version, eventDigest,
+// hyperDigest and historyDigest keys.
+//
+// Services accept the events to add as an object with either an event key,
+// holding the base64 encoded event, or a digest key holding the hexadecimal
+// digest of the event. They report failures as an object with an error key.
+package protocol
@@ -0,0 +1,307 @@
+package protocol
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aalda/trees/balloon"
+	"github.com/aalda/trees/common"
+)
+
+const (
+	KindMembership  = "membership"
+	KindHistory     = "history"
+	KindConsistency = "consistency"
+)
+
+var (
+	ErrUnknownKind   = errors.New("unknown proof kind")
+	ErrUnknownHasher = errors.New("unknown hasher")
+)
+
+var hashers = map[string]func() common.Hasher{
+	"sha256": func() common.Hasher { return common.NewSha256Hasher() },
+	"xor":    func() common.Hasher { return common.XorHasher{} },
+}
+
+// Hasher returns the constructor of the hasher with the given name.
+func Hasher(name string) (func() common.Hasher, error) {
+	hasherF, ok := hashers[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownHasher, name)
+	}
+	return hasherF, nil
+}
+
+// Hex is a byte slice encoded as a hexadecimal string.
+type Hex []byte
+
+func (h Hex) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(h)), nil
+}
+
+func (h *Hex) UnmarshalText(text []byte) error {
+	decoded, err := hex.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+	*h = decoded
+	return nil
+}
+
+// ParseDigest decodes a hexadecimal digest, checking that it has the length
+// of the digests of the hasher.
+func ParseDigest(s string, hasher common.Hasher) (common.Digest, error) {
+	digest, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid digest %q: %v", s, err)
+	}
+	if len(digest) != int(hasher.Len()/8) {
+		return nil, fmt.Errorf("invalid digest %q: expected %d bytes, got %d", s, hasher.Len()/8, len(digest))
+	}
+	return digest, nil
+}
+
+type AuditPath map[string]Hex
+
+func newAuditPath(path common.AuditPath) AuditPath {
+	encoded := make(AuditPath, len(path))
+	for pos, digest := range path {
+		encoded[pos] = Hex(digest)
+	}
+	return encoded
+}
+
+func (p AuditPath) decode() common.AuditPath {
+	decoded := make(common.AuditPath, len(p))
+	for pos, digest := range p {
+		decoded[pos] = common.Digest(digest)
+	}
+	return decoded
+}
+
+type Commitment struct {
+	Version       uint64 `json:"version"`
+	EventDigest   Hex    `json:"eventDigest"`
+	HyperDigest   Hex    `json:"hyperDigest"`
+	HistoryDigest Hex    `json:"historyDigest"`
+}
+
+func NewCommitment(c *balloon.Commitment) *Commitment {
+	return &Commitment{
+		Version:       c.Version,
+		EventDigest:   Hex(c.EventDigest),
+		HyperDigest:   Hex(c.HyperDigest),
+		HistoryDigest: Hex(c.HistoryDigest),
+	}
+}
+
+func (c *Commitment) Decode() *balloon.Commitment {
+	return &balloon.Commitment{
+		Version:       c.Version,
+		EventDigest:   common.Digest(c.EventDigest),
+		HyperDigest:   common.Digest(c.HyperDigest),
+		HistoryDigest: common.Digest(c.HistoryDigest),
+	}
+}
+
+// AddRequest adds either an event, hashed by the server, or the digest of an
+// event hashed by the client with the hasher of the server.
+type AddRequest struct {
+	Event  []byte `json:"event,omitempty"`
+	Digest Hex    `json:"digest,omitempty"`
+}
+
+// Error is the body of the failed responses of the services.
+type Error struct {
+	Error string `json:"error"`
+}
+
+type MembershipProof struct {
+	EventDigest    Hex       `json:"eventDigest"`
+	Version        uint64    `json:"version"`
+	CurrentVersion uint64    `json:"currentVersion"`
+	HyperDigest    Hex       `json:"hyperDigest"`
+	AuditPath      AuditPath `json:"auditPath"`
+}
+
+func NewMembershipProof(p *balloon.MembershipProof) *MembershipProof {
+	return &MembershipProof{
+		EventDigest:    Hex(p.EventDigest),
+		Version:        p.Version,
+		CurrentVersion: p.CurrentVersion,
+		HyperDigest:    Hex(p.HyperDigest),
+		AuditPath:      newAuditPath(p.AuditPath),
+	}
+}
+
+func (p *MembershipProof) Decode() *balloon.MembershipProof {
+	return &balloon.MembershipProof{
+		EventDigest:    common.Digest(p.EventDigest),
+		Version:        p.Version,
+		CurrentVersion: p.CurrentVersion,
+		HyperDigest:    common.Digest(p.HyperDigest),
+		AuditPath:      p.AuditPath.decode(),
+	}
+}
+
+type HistoryProof struct {
+	Index         uint64    `json:"index"`
+	Version       uint64    `json:"version"`
+	EventDigest   Hex       `json:"eventDigest"`
+	HistoryDigest Hex       `json:"historyDigest"`
+	AuditPath     AuditPath `json:"auditPath"`
+}
+
+func NewHistoryProof(p *balloon.HistoryProof) *HistoryProof {
+	return &HistoryProof{
+		Index:         p.Index,
+		Version:       p.Version,
+		EventDigest:   Hex(p.EventDigest),
+		HistoryDigest: Hex(p.HistoryDigest),
+		AuditPath:     newAuditPath(p.AuditPath),
+	}
+}
+
+func (p *HistoryProof) Decode() *balloon.HistoryProof {
+	return &balloon.HistoryProof{
+		Index:         p.Index,
+		Version:       p.Version,
+		EventDigest:   common.Digest(p.EventDigest),
+		HistoryDigest: common.Digest(p.HistoryDigest),
+		AuditPath:     p.AuditPath.decode(),
+	}
+}
+
+type ConsistencyProof struct {
+	Start       uint64    `json:"start"`
+	End         uint64    `json:"end"`
+	StartDigest Hex       `json:"startDigest"`
+	EndDigest   Hex       `json:"endDigest"`
+	AuditPath   AuditPath `json:"auditPath"`
+}
+
+func NewConsistencyProof(p *balloon.ConsistencyProof) *ConsistencyProof {
+	return &ConsistencyProof{
+		Start:       p.Start,
+		End:         p.End,
+		StartDigest: Hex(p.StartDigest),
+		EndDigest:   Hex(p.EndDigest),
+		AuditPath:   newAuditPath(p.AuditPath),
+	}
+}
+
+func (p *ConsistencyProof) Decode() *balloon.ConsistencyProof {
+	return &balloon.ConsistencyProof{
+		Start:       p.Start,
+		End:         p.End,
+		StartDigest: common.Digest(p.StartDigest),
+		EndDigest:   common.Digest(p.EndDigest),
+		AuditPath:   p.AuditPath.decode(),
+	}
+}
+
+// Envelope is the document proofs are written in. Proof holds a
+// *MembershipProof, a *HistoryProof or a *ConsistencyProof, depending on Kind.
+type Envelope struct {
+	Kind   string      `json:"kind"`
+	Hasher string      `json:"hasher"`
+	Proof  interface{} `json:"proof"`
+}
+
+// NewEnvelope wraps one of the proofs of this package, setting its kind.
+func NewEnvelope(hasher string, proof interface{}) (*Envelope, error) {
+	var kind string
+	switch proof.(type) {
+	case *MembershipProof:
+		kind = KindMembership
+	case *HistoryProof:
+		kind = KindHistory
+	case *ConsistencyProof:
+		kind = KindConsistency
+	default:
+		return nil, fmt.Errorf("%w: %T", ErrUnknownKind, proof)
+	}
+	return &Envelope{Kind: kind, Hasher: hasher, Proof: proof}, nil
+}
+
+func (e *Envelope) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Kind   string          `json:"kind"`
+		Hasher string          `json:"hasher"`
+		Proof  json.RawMessage `json:"proof"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	var proof interface{}
+	switch raw.Kind {
+	case KindMembership:
+		proof = new(MembershipProof)
+	case KindHistory:
+		proof = new(HistoryProof)
+	case KindConsistency:
+		proof = new(ConsistencyProof)
+	default:
+		return fmt.Errorf("%w: %q", ErrUnknownKind, raw.Kind)
+	}
+	if len(raw.Proof) == 0 {
+		return errors.New("missing proof")
+	}
+	if err := json.Unmarshal(raw.Proof, proof); err != nil {
+		return err
+	}
+	e.Kind, e.Hasher, e.Proof = raw.Kind, raw.Hasher, proof
+	return nil
+}
+
+// Root returns the digest the proof is verified against, which callers have
+// to compare with the one they trust.
+func (e *Envelope) Root() common.Digest {
+	switch proof := e.Proof.(type) {
+	case *MembershipProof:
+		return common.Digest(proof.HyperDigest)
+	case *HistoryProof:
+		return common.Digest(proof.HistoryDigest)
+	case *ConsistencyProof:
+		return common.Digest(proof.EndDigest)
+	}
+	return nil
+}
+
+// Verify checks the proof against the digests it carries, with the hasher
+// named in the envelope.
+func (e *Envelope) Verify(ctx context.Context) (bool, error) {
+	hasherF, err := Hasher(e.Hasher)
+	if err != nil {
+		return false, err
+	}
+	switch proof := e.Proof.(type) {
+	case *MembershipProof:
+		return proof.Decode().Verify(ctx, hasherF())
+	case *HistoryProof:
+		return proof.Decode().Verify(ctx, hasherF())
+	case *ConsistencyProof:
+		return proof.Decode().Verify(ctx, hasherF())
+	}
+	return false, fmt.Errorf("%w: %T", ErrUnknownKind, e.Proof)
+}
+
+// Write encodes a commitment or an envelope as indented JSON.
+func Write(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func ReadEnvelope(r io.Reader) (*Envelope, error) {
+	var e Envelope
+	if err := json.NewDecoder(r).Decode(&e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
@@ -0,0 +1,103 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aalda/trees/balloon"
+	"github.com/aalda/trees/common"
+	"github.com/aalda/trees/log"
+	"github.com/aalda/trees/storage/bplus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoundTrip(t *testing.T) {
+
+	log.SetLogger("TestRoundTrip", log.SILENT)
+
+	ctx := context.Background()
+	b, err := balloon.NewBalloon(bplus.NewBPlusTreeStorage(), func() common.Hasher { return common.NewSha256Hasher() })
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := b.Add(ctx, []byte(fmt.Sprintf("event %d", i)))
+		require.NoError(t, err)
+	}
+
+	membership, err := b.Get(ctx, common.NewSha256Hasher().Do([]byte("event 3")))
+	require.NoError(t, err)
+	history, err := b.ProveMembership(ctx, 3, 7)
+	require.NoError(t, err)
+	consistency, err := b.ProveConsistency(ctx, 2, 9)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		proof    interface{}
+		kind     string
+		root     common.Digest
+		expected interface{}
+	}{
+		{NewMembershipProof(membership), KindMembership, membership.HyperDigest, membership},
+		{NewHistoryProof(history), KindHistory, history.HistoryDigest, history},
+		{NewConsistencyProof(consistency), KindConsistency, consistency.EndDigest, consistency},
+	}
+
+	for i, c := range testCases {
+		envelope, err := NewEnvelope("sha256", c.proof)
+		require.NoError(t, err)
+
+		var buf bytes.Buffer
+		require.NoError(t, Write(&buf, envelope))
+		decoded, err := ReadEnvelope(&buf)
+		require.NoError(t, err)
+
+		assert.Equal(t, c.kind, decoded.Kind, "Incorrect kind in test case %d", i)
+		assert.Equal(t, c.root, decoded.Root(), "Incorrect root in test case %d", i)
+		assert.Equal(t, c.proof, decoded.Proof, "Incorrect proof in test case %d", i)
+		ok, err := decoded.Verify(ctx)
+		require.NoError(t, err)
+		assert.True(t, ok, "The decoded proof should verify in test case %d", i)
+	}
+
+	assert.Equal(t, membership, NewMembershipProof(membership).Decode(), "Incorrect membership proof")
+	assert.Equal(t, history, NewHistoryProof(history).Decode(), "Incorrect history proof")
+	assert.Equal(t, consistency, NewConsistencyProof(consistency).Decode(), "Incorrect consistency proof")
+}
+
+func TestReadInvalidEnvelopes(t *testing.T) {
+
+	testCases := []string{
+		`{"kind": "unknown", "hasher": "sha256", "proof": {}}`,
+		`{"kind": "membership", "hasher": "sha256"}`,
+		`{"kind": "history", "hasher": "sha256", "proof": {"eventDigest": "zz"}}`,
+		`not json`,
+	}
+
+	for i, c := range testCases {
+		_, err := ReadEnvelope(strings.NewReader(c))
+		assert.Error(t, err, "The envelope should not be read in test case %d", i)
+	}
+
+	envelope, err := ReadEnvelope(strings.NewReader(`{"kind": "history", "hasher": "md5", "proof": {}}`))
+	require.NoError(t, err)
+	_, err = envelope.Verify(context.Background())
+	assert.Error(t, err, "An unknown hasher should not verify")
+}
+
+func TestParseDigest(t *testing.T) {
+
+	hasher := common.NewSha256Hasher()
+	digest := hasher.Do([]byte("event"))
+
+	parsed, err := ParseDigest(fmt.Sprintf("%x", digest), hasher)
+	require.NoError(t, err)
+	assert.Equal(t, common.Digest(digest), parsed, "Incorrect digest")
+
+	_, err = ParseDigest("0a0b", hasher)
+	assert.Error(t, err, "A short digest should be rejected")
+	_, err = ParseDigest("not hex", hasher)
+	assert.Error(t, err, "A non hexadecimal digest should be rejected")
+}
@@ -0,0 +1,266 @@
+// Package rebuild regenerates the trees of a balloon from its event digests,
+// the only source of truth left when the caches of a store are damaged.
+package rebuild
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/aalda/trees/balloon"
+	"github.com/aalda/trees/common"
+	"github.com/aalda/trees/protocol"
+	"github.com/aalda/trees/util"
+)
+
+var (
+	ErrStoreNotEmpty = errors.New("the store to rebuild into is not empty")
+	ErrInvalidIndex  = errors.New("the index does not hold one event per version")
+)
+
+// Source streams event digests in version order. It must be closed once it
+// is no longer used.
+type Source interface {
+	Next() bool
+	Digest() common.Digest
+	Err() error
+	Close() error
+}
+
+type sliceSource struct {
+	digests []common.Digest
+	next    int
+}
+
+func (s *sliceSource) Next() bool {
+	if s.next == len(s.digests) {
+		return false
+	}
+	s.next++
+	return true
+}
+
+func (s *sliceSource) Digest() common.Digest {
+	return s.digests[s.next-1]
+}
+
+func (s *sliceSource) Err() error {
+	return nil
+}
+
+func (s *sliceSource) Close() error {
+	return nil
+}
+
+// FromIndex reads the event digests from the leaves of the hyper tree, which
+// map every digest to the version that added it. The index is keyed by
+// digest, so it is loaded in memory to be sorted by version. It fails with
+// ErrInvalidIndex unless there is exactly one digest for every version,
+// which is not the case if an event was added more than once.
+func FromIndex(ctx context.Context, store common.Store) (Source, error) {
+	it := store.GetAll(ctx, common.IndexPrefix)
+	defer it.Close()
+
+	type leaf struct {
+		version uint64
+		digest  common.Digest
+	}
+	var leaves []leaf
+	for it.Next() {
+		pair := it.Pair()
+		if len(pair.Value) != 8 {
+			return nil, fmt.Errorf("%w: invalid version of %x", ErrInvalidIndex, pair.Key)
+		}
+		leaves = append(leaves, leaf{util.BytesAsUint64(pair.Value), pair.Key})
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(leaves, func(i, j int) bool { return leaves[i].version < leaves[j].version })
+	digests := make([]common.Digest, len(leaves))
+	for i, l := range leaves {
+		if l.version != uint64(i) {
+			return nil, fmt.Errorf("%w: no event for version %d", ErrInvalidIndex, i)
+		}
+		digests[i] = l.digest
+	}
+	return &sliceSource{digests: digests}, nil
+}
+
+type readerSource struct {
+	scanner *bufio.Scanner
+	hasher  common.Hasher
+	line    int
+	digest  common.Digest
+	err     error
+}
+
+// FromReader reads the event digests from a text file with one hexadecimal
+// digest per line, in version order. Blank lines are skipped.
+func FromReader(r io.Reader, hasherF func() common.Hasher) Source {
+	return &readerSource{scanner: bufio.NewScanner(r), hasher: hasherF()}
+}
+
+func (s *readerSource) Next() bool {
+	if s.err != nil {
+		return false
+	}
+	for s.scanner.Scan() {
+		s.line++
+		line := strings.TrimSpace(s.scanner.Text())
+		if line == "" {
+			continue
+		}
+		if s.digest, s.err = protocol.ParseDigest(line, s.hasher); s.err != nil {
+			s.err = fmt.Errorf("line %d: %v", s.line, s.err)
+			return false
+		}
+		return true
+	}
+	s.err = s.scanner.Err()
+	return false
+}
+
+func (s *readerSource) Digest() common.Digest {
+	return s.digest
+}
+
+func (s *readerSource) Err() error {
+	return s.err
+}
+
+func (s *readerSource) Close() error {
+	return nil
+}
+
+// Expected gives the commitments the rebuilt versions are compared with. It
+// is implemented by balloons and by the verifying HTTP client, and Recorded
+// reads them from the write-ahead log of a store. Versions it has no
+// commitment for are reported with balloon.ErrVersionNotFound.
+type Expected interface {
+	Commitment(ctx context.Context, version uint64) (*balloon.Commitment, error)
+}
+
+type recorded struct {
+	store common.Store
+}
+
+// Recorded returns the commitments recorded in the write-ahead log of the
+// store, which do not depend on its trees.
+func Recorded(store common.Store) Expected {
+	return recorded{store}
+}
+
+func (r recorded) Commitment(ctx context.Context, version uint64) (*balloon.Commitment, error) {
+	return balloon.RecordedCommitment(ctx, r.store, version)
+}
+
+// Mismatch is a rebuilt version whose roots differ from the expected ones.
+// When the source ends before the expected versions, it is the first version
+// missing and Rebuilt is nil.
+type Mismatch struct {
+	Version  uint64
+	Expected *balloon.Commitment
+	Rebuilt  *balloon.Commitment
+}
+
+type Result struct {
+	// Versions is the number of versions rebuilt.
+	Versions uint64
+	// Last is the commitment of the last version rebuilt, if any.
+	Last *balloon.Commitment
+	// Mismatch is the first version whose roots differ from the expected
+	// ones, if any. The history digests of the later versions depend on it,
+	// so they are not compared.
+	Mismatch *Mismatch
+}
+
+// Rebuild adds the digests of the source to a new balloon in the store,
+// which must be empty, and compares the roots of every version with the
+// expected ones, if given. Every digest is added even after a mismatch, so
+// that the store ends up with the trees of the whole source. A source missing
+// the last expected versions is a mismatch too. The source is closed once
+// read.
+func Rebuild(ctx context.Context, source Source, store common.Store, hasherF func() common.Hasher, expected Expected) (*Result, error) {
+	defer source.Close()
+
+	for _, prefix := range []byte{common.VersionPrefix, common.IndexPrefix, common.HyperCachePrefix, common.HistoryCachePrefix} {
+		empty, err := isEmpty(ctx, store, prefix)
+		if err != nil {
+			return nil, err
+		}
+		if !empty {
+			return nil, ErrStoreNotEmpty
+		}
+	}
+	b, err := balloon.NewBalloon(store, hasherF)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{}
+	for source.Next() {
+		commitment, err := b.AddDigest(ctx, source.Digest())
+		if err != nil {
+			return nil, err
+		}
+		result.Versions++
+		result.Last = commitment
+		if expected == nil || result.Mismatch != nil {
+			continue
+		}
+		if result.Mismatch, err = compare(ctx, expected, commitment); err != nil {
+			return nil, err
+		}
+	}
+	if err := source.Err(); err != nil {
+		return nil, err
+	}
+	if expected != nil && result.Mismatch == nil {
+		if result.Mismatch, err = missing(ctx, expected, result.Versions); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func isEmpty(ctx context.Context, store common.Store, prefix byte) (bool, error) {
+	it := store.GetAll(ctx, prefix)
+	defer it.Close()
+	if it.Next() {
+		return false, nil
+	}
+	return true, it.Err()
+}
+
+// missing reports the version after the last rebuilt one if it is expected.
+func missing(ctx context.Context, expected Expected, version uint64) (*Mismatch, error) {
+	commitment, err := expected.Commitment(ctx, version)
+	if err == balloon.ErrVersionNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Mismatch{Version: version, Expected: commitment}, nil
+}
+
+func compare(ctx context.Context, expected Expected, rebuilt *balloon.Commitment) (*Mismatch, error) {
+	commitment, err := expected.Commitment(ctx, rebuilt.Version)
+	if err == balloon.ErrVersionNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(commitment.HyperDigest, rebuilt.HyperDigest) && bytes.Equal(commitment.HistoryDigest, rebuilt.HistoryDigest) {
+		return nil, nil
+	}
+	return &Mismatch{Version: rebuilt.Version, Expected: commitment, Rebuilt: rebuilt}, nil
+}
@@ -0,0 +1,148 @@
+package rebuild
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aalda/trees/balloon"
+	"github.com/aalda/trees/balloon/balloontest"
+	"github.com/aalda/trees/common"
+	"github.com/aalda/trees/log"
+	"github.com/aalda/trees/storage/bplus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// digests returns the file with the digests of the events, one per line.
+func digests(events uint64) string {
+	var lines []string
+	for i := uint64(0); i < events; i++ {
+		lines = append(lines, hex.EncodeToString(balloontest.Sha256Hasher().Do(balloontest.Event(i))))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func TestRebuildFromIndex(t *testing.T) {
+
+	log.SetLogger("TestRebuildFromIndex", log.SILENT)
+
+	damaged := bplus.NewBPlusTreeStorage()
+	balloontest.NewBalloon(t, damaged, 20)
+	for _, prefix := range []byte{common.HyperCachePrefix, common.HistoryCachePrefix} {
+		cached, err := common.CollectRange(damaged.GetAll(balloontest.Ctx, prefix))
+		require.NoError(t, err)
+		mutations := make([]common.Mutation, 0, len(cached))
+		for _, pair := range cached {
+			mutations = append(mutations, *common.NewDeleteMutation(prefix, pair.Key))
+		}
+		require.NoError(t, damaged.Mutate(balloontest.Ctx, mutations))
+	}
+
+	source, err := FromIndex(balloontest.Ctx, damaged)
+	require.NoError(t, err)
+	store := bplus.NewBPlusTreeStorage()
+	result, err := Rebuild(balloontest.Ctx, source, store, balloontest.Sha256Hasher, Recorded(damaged))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(20), result.Versions, "Incorrect number of versions")
+	assert.Nil(t, result.Mismatch, "The rebuilt roots should match the recorded ones")
+
+	recorded, err := balloon.RecordedCommitment(balloontest.Ctx, damaged, 19)
+	require.NoError(t, err)
+	assert.Equal(t, recorded, result.Last, "Incorrect last commitment")
+
+	b, err := balloon.NewBalloon(store, balloontest.Sha256Hasher)
+	require.NoError(t, err)
+	proof, err := b.Get(balloontest.Ctx, balloontest.Sha256Hasher().Do(balloontest.Event(7)))
+	require.NoError(t, err)
+	verified, err := proof.Verify(balloontest.Ctx, balloontest.Sha256Hasher())
+	require.NoError(t, err)
+	assert.True(t, verified, "The rebuilt balloon should prove its events")
+}
+
+func TestRebuildFromReader(t *testing.T) {
+
+	log.SetLogger("TestRebuildFromReader", log.SILENT)
+
+	expected := balloontest.NewBalloon(t, bplus.NewBPlusTreeStorage(), 10)
+
+	// the expected balloon is behind the file
+	source := FromReader(strings.NewReader("\n"+digests(12)+"\n"), balloontest.Sha256Hasher)
+	result, err := Rebuild(balloontest.Ctx, source, bplus.NewBPlusTreeStorage(), balloontest.Sha256Hasher, expected)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(12), result.Versions, "Incorrect number of versions")
+	assert.Nil(t, result.Mismatch, "The rebuilt roots should match the expected ones")
+
+	// without expected roots
+	result, err = Rebuild(balloontest.Ctx, FromReader(strings.NewReader(""), balloontest.Sha256Hasher), bplus.NewBPlusTreeStorage(), balloontest.Sha256Hasher, nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), result.Versions, "Incorrect number of versions")
+	assert.Nil(t, result.Last, "Nothing should be rebuilt")
+
+	_, err = Rebuild(balloontest.Ctx, FromReader(strings.NewReader(digests(3)+"abc\n"), balloontest.Sha256Hasher), bplus.NewBPlusTreeStorage(), balloontest.Sha256Hasher, nil)
+	assert.Error(t, err, "An invalid digest should fail")
+	assert.Contains(t, err.Error(), "line 4", "The invalid line should be reported")
+}
+
+func TestRebuildMismatch(t *testing.T) {
+
+	log.SetLogger("TestRebuildMismatch", log.SILENT)
+
+	expected := balloontest.NewBalloon(t, bplus.NewBPlusTreeStorage(), 10)
+	lines := strings.Split(digests(10), "\n")
+	lines[5] = hex.EncodeToString(balloontest.Sha256Hasher().Do([]byte("forged")))
+
+	source := FromReader(strings.NewReader(strings.Join(lines, "\n")), balloontest.Sha256Hasher)
+	result, err := Rebuild(balloontest.Ctx, source, bplus.NewBPlusTreeStorage(), balloontest.Sha256Hasher, expected)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(10), result.Versions, "Every version should be rebuilt")
+	require.NotNil(t, result.Mismatch, "The forged version should not match")
+	assert.Equal(t, uint64(5), result.Mismatch.Version, "Incorrect first mismatching version")
+
+	commitment, err := expected.Commitment(balloontest.Ctx, 5)
+	require.NoError(t, err)
+	assert.Equal(t, commitment, result.Mismatch.Expected, "Incorrect expected commitment")
+	assert.Equal(t, uint64(5), result.Mismatch.Rebuilt.Version, "Incorrect rebuilt commitment")
+}
+
+func TestRebuildTruncated(t *testing.T) {
+
+	log.SetLogger("TestRebuildTruncated", log.SILENT)
+
+	expected := balloontest.NewBalloon(t, bplus.NewBPlusTreeStorage(), 10)
+	source := FromReader(strings.NewReader(digests(7)), balloontest.Sha256Hasher)
+	result, err := Rebuild(balloontest.Ctx, source, bplus.NewBPlusTreeStorage(), balloontest.Sha256Hasher, expected)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(7), result.Versions, "Incorrect number of versions")
+	require.NotNil(t, result.Mismatch, "The missing versions should not match")
+	assert.Equal(t, uint64(7), result.Mismatch.Version, "Incorrect first missing version")
+	assert.Nil(t, result.Mismatch.Rebuilt, "The missing version should not be rebuilt")
+
+	commitment, err := expected.Commitment(balloontest.Ctx, 7)
+	require.NoError(t, err)
+	assert.Equal(t, commitment, result.Mismatch.Expected, "Incorrect expected commitment")
+
+	// an empty source misses every version
+	result, err = Rebuild(balloontest.Ctx, FromReader(strings.NewReader(""), balloontest.Sha256Hasher), bplus.NewBPlusTreeStorage(), balloontest.Sha256Hasher, expected)
+	require.NoError(t, err)
+	require.NotNil(t, result.Mismatch, "The missing versions should not match")
+	assert.Equal(t, uint64(0), result.Mismatch.Version, "Incorrect first missing version")
+}
+
+func TestRebuildInvalidStores(t *testing.T) {
+
+	log.SetLogger("TestRebuildInvalidStores", log.SILENT)
+
+	// an event added twice leaves a version out of the index
+	store := bplus.NewBPlusTreeStorage()
+	b := balloontest.NewBalloon(t, store, 3)
+	_, err := b.Add(balloontest.Ctx, balloontest.Event(1))
+	require.NoError(t, err)
+	_, err = FromIndex(balloontest.Ctx, store)
+	assert.True(t, errors.Is(err, ErrInvalidIndex), "The index should be rejected: %v", err)
+
+	source := FromReader(strings.NewReader(digests(3)), balloontest.Sha256Hasher)
+	_, err = Rebuild(balloontest.Ctx, source, store, balloontest.Sha256Hasher, nil)
+	assert.Equal(t, ErrStoreNotEmpty, err, "The store should be empty")
+}
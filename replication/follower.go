@@ -0,0 +1,167 @@
+// Package replication keeps read-only followers of a balloon. A follower
+// replays the events of its leader into its own store and checks that every
+// version it recomputes commits to the same digests as the leader did.
+package replication
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aalda/trees/balloon"
+	"github.com/aalda/trees/common"
+	"github.com/aalda/trees/log"
+)
+
+// Stream delivers the commitments of a leader in version order.
+type Stream interface {
+	Recv() (*balloon.Commitment, error)
+}
+
+// Leader streams its commitments from a version on, replaying the ones
+// already added before following the new ones.
+type Leader interface {
+	Watch(ctx context.Context, fromVersion uint64) (Stream, error)
+}
+
+// LeaderFunc adapts a function to the Leader interface, as needed to follow
+// a remote leader through the gRPC client:
+//
+//	replication.LeaderFunc(func(ctx context.Context, from uint64) (replication.Stream, error) {
+//		stream, err := c.WatchCommitments(ctx, from)
+//		if err != nil {
+//			return nil, err
+//		}
+//		return stream, nil
+//	})
+type LeaderFunc func(ctx context.Context, fromVersion uint64) (Stream, error)
+
+func (f LeaderFunc) Watch(ctx context.Context, fromVersion uint64) (Stream, error) {
+	return f(ctx, fromVersion)
+}
+
+// NewLocalLeader follows a balloon of the same process.
+func NewLocalLeader(b *balloon.Balloon) Leader {
+	return LeaderFunc(func(ctx context.Context, fromVersion uint64) (Stream, error) {
+		return watcherStream{b.Watch(ctx, fromVersion)}, nil
+	})
+}
+
+type watcherStream struct {
+	watcher *balloon.Watcher
+}
+
+func (s watcherStream) Recv() (*balloon.Commitment, error) {
+	commitment, ok := <-s.watcher.C
+	if !ok {
+		if err := s.watcher.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	return commitment, nil
+}
+
+var ErrDiverged = errors.New("the follower diverged from its leader")
+
+// DivergenceError tells the first version whose digests do not match the
+// commitment of the leader. It matches ErrDiverged with errors.Is.
+type DivergenceError struct {
+	Version  uint64
+	Leader   *balloon.Commitment
+	Follower *balloon.Commitment
+}
+
+func (e *DivergenceError) Error() string {
+	return fmt.Sprintf("%v at version %d", ErrDiverged, e.Version)
+}
+
+func (e *DivergenceError) Is(target error) bool {
+	return target == ErrDiverged
+}
+
+// Follower replays the events of a leader into its own balloon, which must
+// not be added to by anyone else. It can be queried through Balloon.
+type Follower struct {
+	balloon *balloon.Balloon
+	leader  Leader
+	logger  *log.Logger
+}
+
+// NewFollower opens the balloon of the follower over its store, resuming
+// from the last version it replayed.
+func NewFollower(store common.Store, hasherF func() common.Hasher, leader Leader) (*Follower, error) {
+	b, err := balloon.NewBalloon(store, hasherF)
+	if err != nil {
+		return nil, err
+	}
+	return &Follower{
+		balloon: b,
+		leader:  leader,
+		logger:  log.Default().Named("replication"),
+	}, nil
+}
+
+func (f *Follower) SetLogger(logger *log.Logger) {
+	f.logger = logger
+}
+
+// Balloon returns the balloon of the follower to query it. Adding to it
+// breaks the replication.
+func (f *Follower) Balloon() *balloon.Balloon {
+	return f.balloon
+}
+
+// Run replays the commitments of the leader until the context is done, the
+// stream fails or the follower diverges, which it reports with a
+// *DivergenceError. The last version replayed is checked again first, so
+// that a follower that diverged keeps refusing to run once restarted.
+func (f *Follower) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	next := f.balloon.Version()
+	from := next
+	if next > 0 {
+		from = next - 1
+	}
+	stream, err := f.leader.Watch(ctx, from)
+	if err != nil {
+		return err
+	}
+
+	for {
+		leader, err := stream.Recv()
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			return err
+		}
+
+		var follower *balloon.Commitment
+		switch {
+		case leader.Version < next:
+			follower, err = f.balloon.Commitment(ctx, leader.Version)
+		case leader.Version == next:
+			follower, err = f.balloon.AddDigest(ctx, leader.EventDigest)
+			next++
+		default:
+			return fmt.Errorf("the leader skipped from version %d to %d", next, leader.Version)
+		}
+		if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(leader.EventDigest, follower.EventDigest) ||
+			!bytes.Equal(leader.HyperDigest, follower.HyperDigest) ||
+			!bytes.Equal(leader.HistoryDigest, follower.HistoryDigest) {
+			f.logger.Error("Diverged from the leader", log.Uint64("version", leader.Version),
+				log.Hex("leader_history", leader.HistoryDigest), log.Hex("follower_history", follower.HistoryDigest))
+			return &DivergenceError{leader.Version, leader, follower}
+		}
+		f.logger.Debug("Replayed version", log.Uint64("version", leader.Version))
+	}
+}
@@ -0,0 +1,163 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aalda/trees/balloon"
+	"github.com/aalda/trees/balloon/balloontest"
+	"github.com/aalda/trees/log"
+	"github.com/aalda/trees/storage/bplus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// run starts the follower and returns the channel its result is sent to.
+func run(ctx context.Context, f *Follower) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- f.Run(ctx)
+	}()
+	return done
+}
+
+func waitFor(t *testing.T, done <-chan error) error {
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(10 * time.Second):
+		require.FailNow(t, "Timed out waiting for the follower")
+		return nil
+	}
+}
+
+func waitForVersion(t *testing.T, f *Follower, version uint64) {
+	deadline := time.Now().Add(10 * time.Second)
+	for f.Balloon().Version() < version {
+		require.True(t, time.Now().Before(deadline), "Timed out waiting for version %d", version)
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFollow(t *testing.T) {
+
+	log.SetLogger("TestFollow", log.SILENT)
+
+	leader := balloontest.NewBalloon(t, bplus.NewBPlusTreeStorage(), 10)
+	store := bplus.NewBPlusTreeStorage()
+	follower, err := NewFollower(store, balloontest.Sha256Hasher, NewLocalLeader(leader))
+	require.NoError(t, err)
+
+	runCtx, cancel := context.WithCancel(balloontest.Ctx)
+	done := run(runCtx, follower)
+	waitForVersion(t, follower, 10)
+
+	for i := uint64(10); i < 20; i++ {
+		_, err := leader.Add(balloontest.Ctx, balloontest.Event(i))
+		require.NoError(t, err)
+	}
+	waitForVersion(t, follower, 20)
+
+	for i := uint64(0); i < 20; i++ {
+		expected, err := leader.Commitment(balloontest.Ctx, i)
+		require.NoError(t, err)
+		replayed, err := follower.Balloon().Commitment(balloontest.Ctx, i)
+		require.NoError(t, err)
+		assert.Equal(t, expected, replayed, "Incorrect replayed commitment %d", i)
+	}
+	proof, err := follower.Balloon().ProveConsistency(balloontest.Ctx, 3, 19)
+	require.NoError(t, err)
+	verified, err := proof.Verify(balloontest.Ctx, balloontest.Sha256Hasher())
+	require.NoError(t, err)
+	assert.True(t, verified, "The follower should serve valid proofs")
+
+	cancel()
+	assert.Equal(t, context.Canceled, waitFor(t, done), "The follower should stop with its context")
+
+	// a restarted follower resumes from its store
+	for i := uint64(20); i < 25; i++ {
+		_, err := leader.Add(balloontest.Ctx, balloontest.Event(i))
+		require.NoError(t, err)
+	}
+	follower, err = NewFollower(store, balloontest.Sha256Hasher, NewLocalLeader(leader))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(20), follower.Balloon().Version(), "The follower should resume from its store")
+	runCtx, cancel = context.WithCancel(balloontest.Ctx)
+	defer cancel()
+	done = run(runCtx, follower)
+	waitForVersion(t, follower, 25)
+	cancel()
+	assert.Equal(t, context.Canceled, waitFor(t, done))
+}
+
+// tamperedStream alters the history digest of a version of the leader.
+type tamperedStream struct {
+	Stream
+	version uint64
+}
+
+func (s tamperedStream) Recv() (*balloon.Commitment, error) {
+	commitment, err := s.Stream.Recv()
+	if err == nil && commitment.Version == s.version {
+		tampered := *commitment
+		tampered.HistoryDigest = balloontest.Sha256Hasher().Do([]byte("tampered"))
+		return &tampered, nil
+	}
+	return commitment, err
+}
+
+func TestStopOnDivergence(t *testing.T) {
+
+	log.SetLogger("TestStopOnDivergence", log.SILENT)
+
+	leader := balloontest.NewBalloon(t, bplus.NewBPlusTreeStorage(), 10)
+	local := NewLocalLeader(leader)
+	tampered := LeaderFunc(func(ctx context.Context, fromVersion uint64) (Stream, error) {
+		stream, err := local.Watch(ctx, fromVersion)
+		return tamperedStream{stream, 5}, err
+	})
+
+	store := bplus.NewBPlusTreeStorage()
+	follower, err := NewFollower(store, balloontest.Sha256Hasher, tampered)
+	require.NoError(t, err)
+
+	err = waitFor(t, run(balloontest.Ctx, follower))
+	require.True(t, errors.Is(err, ErrDiverged), "The follower should diverge: %v", err)
+	var divergence *DivergenceError
+	require.True(t, errors.As(err, &divergence))
+	assert.Equal(t, uint64(5), divergence.Version, "Incorrect divergent version")
+	assert.Equal(t, uint64(6), follower.Balloon().Version(), "The follower should stop at the divergent version")
+
+	// the follower keeps refusing to run once restarted
+	follower, err = NewFollower(store, balloontest.Sha256Hasher, tampered)
+	require.NoError(t, err)
+	err = waitFor(t, run(balloontest.Ctx, follower))
+	assert.True(t, errors.Is(err, ErrDiverged), "The restarted follower should diverge: %v", err)
+	assert.Equal(t, uint64(6), follower.Balloon().Version(), "The restarted follower should not replay")
+}
+
+func TestDivergedStore(t *testing.T) {
+
+	log.SetLogger("TestDivergedStore", log.SILENT)
+
+	leader := balloontest.NewBalloon(t, bplus.NewBPlusTreeStorage(), 10)
+
+	// a follower whose store holds another history
+	store := bplus.NewBPlusTreeStorage()
+	other, err := balloon.NewBalloon(store, balloontest.Sha256Hasher)
+	require.NoError(t, err)
+	for i := uint64(0); i < 3; i++ {
+		_, err := other.Add(balloontest.Ctx, []byte(fmt.Sprintf("other %d", i)))
+		require.NoError(t, err)
+	}
+
+	follower, err := NewFollower(store, balloontest.Sha256Hasher, NewLocalLeader(leader))
+	require.NoError(t, err)
+	err = waitFor(t, run(balloontest.Ctx, follower))
+	var divergence *DivergenceError
+	require.True(t, errors.As(err, &divergence), "The follower should diverge: %v", err)
+	assert.Equal(t, uint64(2), divergence.Version, "Incorrect divergent version")
+}
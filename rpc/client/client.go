@@ -0,0 +1,118 @@
+// Package client calls the Trees gRPC service, returning the commitments and
+// proofs as balloon types. It does not verify them.
+package client
+
+import (
+	"context"
+
+	"github.com/aalda/trees/balloon"
+	"github.com/aalda/trees/common"
+	"github.com/aalda/trees/rpc"
+	"github.com/aalda/trees/rpc/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type Client struct {
+	trees pb.TreesClient
+}
+
+// New returns a client over the connection, which is left for the caller to
+// close.
+func New(conn grpc.ClientConnInterface) *Client {
+	return &Client{pb.NewTreesClient(conn)}
+}
+
+func (c *Client) Add(ctx context.Context, event []byte) (*balloon.Commitment, error) {
+	return c.add(ctx, &pb.AddRequest{Payload: &pb.AddRequest_Event{Event: event}})
+}
+
+// AddDigest adds an event hashed with the hasher of the server.
+func (c *Client) AddDigest(ctx context.Context, eventDigest common.Digest) (*balloon.Commitment, error) {
+	return c.add(ctx, &pb.AddRequest{Payload: &pb.AddRequest_Digest{Digest: eventDigest}})
+}
+
+func (c *Client) add(ctx context.Context, request *pb.AddRequest) (*balloon.Commitment, error) {
+	commitment, err := c.trees.Add(ctx, request)
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+	return rpc.DecodeCommitment(commitment), nil
+}
+
+// GetMembershipProof returns the proof and the name of the hasher it has to
+// be verified with.
+func (c *Client) GetMembershipProof(ctx context.Context, eventDigest common.Digest) (*balloon.MembershipProof, string, error) {
+	proof, err := c.trees.GetMembershipProof(ctx, &pb.MembershipRequest{Digest: eventDigest})
+	if err != nil {
+		return nil, "", fromStatus(err)
+	}
+	return rpc.DecodeMembershipProof(proof), proof.Hasher, nil
+}
+
+// GetConsistencyProof returns the proof and the name of the hasher it has to
+// be verified with.
+func (c *Client) GetConsistencyProof(ctx context.Context, start, end uint64) (*balloon.ConsistencyProof, string, error) {
+	proof, err := c.trees.GetConsistencyProof(ctx, &pb.ConsistencyRequest{Start: start, End: end})
+	if err != nil {
+		return nil, "", fromStatus(err)
+	}
+	return rpc.DecodeConsistencyProof(proof), proof.Hasher, nil
+}
+
+// GetRoot returns the commitment of the last version.
+func (c *Client) GetRoot(ctx context.Context) (*balloon.Commitment, error) {
+	return c.getRoot(ctx, &pb.RootRequest{})
+}
+
+func (c *Client) GetRootAt(ctx context.Context, version uint64) (*balloon.Commitment, error) {
+	return c.getRoot(ctx, &pb.RootRequest{Version: &version})
+}
+
+func (c *Client) getRoot(ctx context.Context, request *pb.RootRequest) (*balloon.Commitment, error) {
+	commitment, err := c.trees.GetRoot(ctx, request)
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+	return rpc.DecodeCommitment(commitment), nil
+}
+
+// CommitmentStream receives the commitments watched until its context is
+// done.
+type CommitmentStream struct {
+	stream pb.Trees_WatchCommitmentsClient
+}
+
+func (s *CommitmentStream) Recv() (*balloon.Commitment, error) {
+	commitment, err := s.stream.Recv()
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+	return rpc.DecodeCommitment(commitment), nil
+}
+
+// WatchCommitments streams the commitments from the version on. Cancelling
+// the context stops the stream.
+func (c *Client) WatchCommitments(ctx context.Context, fromVersion uint64) (*CommitmentStream, error) {
+	stream, err := c.trees.WatchCommitments(ctx, &pb.WatchRequest{FromVersion: fromVersion})
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+	return &CommitmentStream{stream}, nil
+}
+
+// fromStatus turns the statuses of the errors of the balloon back into them,
+// so that callers can compare them as if they used the balloon.
+func fromStatus(err error) error {
+	s, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	for _, known := range []error{common.ErrKeyNotFound, balloon.ErrVersionNotFound, balloon.ErrInvalidRange} {
+		if s.Message() == known.Error() && (s.Code() == codes.NotFound || s.Code() == codes.InvalidArgument) {
+			return known
+		}
+	}
+	return err
+}
@@ -0,0 +1,158 @@
+package client
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aalda/trees/balloon"
+	"github.com/aalda/trees/balloon/balloontest"
+	"github.com/aalda/trees/common"
+	"github.com/aalda/trees/log"
+	"github.com/aalda/trees/rpc"
+	"github.com/aalda/trees/storage/bplus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newClient serves a new balloon over an in-process listener and returns a
+// client connected to it.
+func newClient(t *testing.T) *Client {
+	b := balloontest.NewBalloon(t, bplus.NewBPlusTreeStorage(), 0)
+	server, err := rpc.NewServer(b, "sha256")
+	require.NoError(t, err)
+
+	listener := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer()
+	server.Register(grpcServer)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.DialContext(balloontest.Ctx, "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return New(conn)
+}
+
+func TestAddAndProve(t *testing.T) {
+
+	log.SetLogger("TestAddAndProve", log.SILENT)
+
+	c := newClient(t)
+
+	_, err := c.GetRoot(balloontest.Ctx)
+	assert.Equal(t, codes.NotFound, status.Code(err), "An empty balloon should have no root")
+
+	commitments := make([]*balloon.Commitment, 10)
+	for i := uint64(0); i < 10; i++ {
+		commitment, err := c.Add(balloontest.Ctx, balloontest.Event(i))
+		require.NoError(t, err)
+		require.Equal(t, i, commitment.Version, "Incorrect version")
+		commitments[i] = commitment
+	}
+	last, err := c.AddDigest(balloontest.Ctx, balloontest.Sha256Hasher().Do(balloontest.Event(10)))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(10), last.Version, "Incorrect version")
+
+	root, err := c.GetRoot(balloontest.Ctx)
+	require.NoError(t, err)
+	assert.Equal(t, last, root, "Incorrect root")
+	root, err = c.GetRootAt(balloontest.Ctx, 4)
+	require.NoError(t, err)
+	assert.Equal(t, commitments[4], root, "Incorrect root of version 4")
+
+	for i := uint64(0); i < 10; i++ {
+		membership, hasher, err := c.GetMembershipProof(balloontest.Ctx, balloontest.Sha256Hasher().Do(balloontest.Event(i)))
+		require.NoError(t, err)
+		assert.Equal(t, "sha256", hasher, "Incorrect hasher")
+		assert.Equal(t, i, membership.Version, "Incorrect version")
+		assert.Equal(t, last.HyperDigest, membership.HyperDigest, "Incorrect hyper digest")
+		verified, err := membership.Verify(balloontest.Ctx, balloontest.Sha256Hasher())
+		require.NoError(t, err)
+		assert.True(t, verified, "The membership proof of %d should verify", i)
+
+		consistency, _, err := c.GetConsistencyProof(balloontest.Ctx, i, 9)
+		require.NoError(t, err)
+		assert.Equal(t, commitments[9].HistoryDigest, consistency.EndDigest, "Incorrect end digest")
+		verified, err = consistency.Verify(balloontest.Ctx, balloontest.Sha256Hasher())
+		require.NoError(t, err)
+		assert.True(t, verified, "The consistency proof from %d should verify", i)
+	}
+}
+
+func TestErrors(t *testing.T) {
+
+	log.SetLogger("TestErrors", log.SILENT)
+
+	c := newClient(t)
+	for i := uint64(0); i < 3; i++ {
+		_, err := c.Add(balloontest.Ctx, balloontest.Event(i))
+		require.NoError(t, err)
+	}
+
+	_, _, err := c.GetMembershipProof(balloontest.Ctx, balloontest.Sha256Hasher().Do(balloontest.Event(3)))
+	assert.Equal(t, common.ErrKeyNotFound, err, "A missing event should not be found")
+	_, _, err = c.GetConsistencyProof(balloontest.Ctx, 2, 1)
+	assert.Equal(t, balloon.ErrInvalidRange, err, "The start cannot be after the end")
+	_, _, err = c.GetConsistencyProof(balloontest.Ctx, 1, 3)
+	assert.Equal(t, balloon.ErrVersionNotFound, err, "The end should be committed")
+	_, err = c.GetRootAt(balloontest.Ctx, 3)
+	assert.Equal(t, balloon.ErrVersionNotFound, err, "The version should be committed")
+
+	_, err = c.AddDigest(balloontest.Ctx, common.Digest{0x1})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "A short digest should be rejected")
+	_, _, err = c.GetMembershipProof(balloontest.Ctx, common.Digest{0x1})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "A short digest should be rejected")
+}
+
+func TestWatchCommitments(t *testing.T) {
+
+	log.SetLogger("TestWatchCommitments", log.SILENT)
+
+	c := newClient(t)
+	expected := make([]*balloon.Commitment, 10)
+	for i := uint64(0); i < 5; i++ {
+		commitment, err := c.Add(balloontest.Ctx, balloontest.Event(i))
+		require.NoError(t, err)
+		expected[i] = commitment
+	}
+
+	watchCtx, cancel := context.WithTimeout(balloontest.Ctx, 10*time.Second)
+	defer cancel()
+	stream, err := c.WatchCommitments(watchCtx, 2)
+	require.NoError(t, err)
+
+	// the missed commitments are replayed
+	for i := uint64(2); i < 5; i++ {
+		commitment, err := stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, expected[i], commitment, "Incorrect replayed commitment %d", i)
+	}
+
+	// and the new ones followed
+	for i := uint64(5); i < 10; i++ {
+		commitment, err := c.Add(balloontest.Ctx, balloontest.Event(i))
+		require.NoError(t, err)
+		expected[i] = commitment
+	}
+	for i := uint64(5); i < 10; i++ {
+		commitment, err := stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, expected[i], commitment, "Incorrect followed commitment %d", i)
+	}
+
+	cancel()
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Canceled, status.Code(err), "The stream should stop with its context")
+}
@@ -0,0 +1,83 @@
+package rpc
+
+import (
+	"github.com/aalda/trees/balloon"
+	"github.com/aalda/trees/common"
+	"github.com/aalda/trees/rpc/pb"
+)
+
+func EncodeCommitment(c *balloon.Commitment) *pb.Commitment {
+	return &pb.Commitment{
+		Version:       c.Version,
+		EventDigest:   c.EventDigest,
+		HyperDigest:   c.HyperDigest,
+		HistoryDigest: c.HistoryDigest,
+	}
+}
+
+func DecodeCommitment(c *pb.Commitment) *balloon.Commitment {
+	return &balloon.Commitment{
+		Version:       c.Version,
+		EventDigest:   c.EventDigest,
+		HyperDigest:   c.HyperDigest,
+		HistoryDigest: c.HistoryDigest,
+	}
+}
+
+func encodeAuditPath(path common.AuditPath) map[string][]byte {
+	encoded := make(map[string][]byte, len(path))
+	for pos, digest := range path {
+		encoded[pos] = digest
+	}
+	return encoded
+}
+
+func decodeAuditPath(path map[string][]byte) common.AuditPath {
+	decoded := make(common.AuditPath, len(path))
+	for pos, digest := range path {
+		decoded[pos] = digest
+	}
+	return decoded
+}
+
+func EncodeMembershipProof(hasher string, p *balloon.MembershipProof) *pb.MembershipProof {
+	return &pb.MembershipProof{
+		Hasher:         hasher,
+		EventDigest:    p.EventDigest,
+		Version:        p.Version,
+		CurrentVersion: p.CurrentVersion,
+		HyperDigest:    p.HyperDigest,
+		AuditPath:      encodeAuditPath(p.AuditPath),
+	}
+}
+
+func DecodeMembershipProof(p *pb.MembershipProof) *balloon.MembershipProof {
+	return &balloon.MembershipProof{
+		EventDigest:    p.EventDigest,
+		Version:        p.Version,
+		CurrentVersion: p.CurrentVersion,
+		HyperDigest:    p.HyperDigest,
+		AuditPath:      decodeAuditPath(p.AuditPath),
+	}
+}
+
+func EncodeConsistencyProof(hasher string, p *balloon.ConsistencyProof) *pb.ConsistencyProof {
+	return &pb.ConsistencyProof{
+		Hasher:      hasher,
+		Start:       p.Start,
+		End:         p.End,
+		StartDigest: p.StartDigest,
+		EndDigest:   p.EndDigest,
+		AuditPath:   encodeAuditPath(p.AuditPath),
+	}
+}
+
+func DecodeConsistencyProof(p *pb.ConsistencyProof) *balloon.ConsistencyProof {
+	return &balloon.ConsistencyProof{
+		Start:       p.Start,
+		End:         p.End,
+		StartDigest: p.StartDigest,
+		EndDigest:   p.EndDigest,
+		AuditPath:   decodeAuditPath(p.AuditPath),
+	}
+}
@@ -0,0 +1,307 @@
+// Trees serves a balloon to the internal services. The proofs hold the same
+// fields as the JSON proofs of the protocol package, with the digests as raw
+// bytes.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v4.25.1
+// source: trees.proto
+
+package pb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Trees_Add_FullMethodName                 = "/trees.Trees/Add"
+	Trees_GetMembershipProof_FullMethodName  = "/trees.Trees/GetMembershipProof"
+	Trees_GetConsistencyProof_FullMethodName = "/trees.Trees/GetConsistencyProof"
+	Trees_GetRoot_FullMethodName             = "/trees.Trees/GetRoot"
+	Trees_WatchCommitments_FullMethodName    = "/trees.Trees/WatchCommitments"
+)
+
+// TreesClient is the client API for Trees service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type TreesClient interface {
+	// Add appends an event, or the digest of an event hashed with the hasher
+	// of the server, and returns the commitment of its version.
+	Add(ctx context.Context, in *AddRequest, opts ...grpc.CallOption) (*Commitment, error)
+	// GetMembershipProof proves the membership of an event digest as of the
+	// last version.
+	GetMembershipProof(ctx context.Context, in *MembershipRequest, opts ...grpc.CallOption) (*MembershipProof, error)
+	// GetConsistencyProof proves that the history committed by end extends the
+	// one committed by start.
+	GetConsistencyProof(ctx context.Context, in *ConsistencyRequest, opts ...grpc.CallOption) (*ConsistencyProof, error)
+	// GetRoot returns the commitment of a version, the last one by default.
+	GetRoot(ctx context.Context, in *RootRequest, opts ...grpc.CallOption) (*Commitment, error)
+	// WatchCommitments streams the commitments from a version on, replaying
+	// the ones already added before following the new ones.
+	WatchCommitments(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Trees_WatchCommitmentsClient, error)
+}
+
+type treesClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewTreesClient(cc grpc.ClientConnInterface) TreesClient {
+	return &treesClient{cc}
+}
+
+func (c *treesClient) Add(ctx context.Context, in *AddRequest, opts ...grpc.CallOption) (*Commitment, error) {
+	out := new(Commitment)
+	err := c.cc.Invoke(ctx, Trees_Add_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *treesClient) GetMembershipProof(ctx context.Context, in *MembershipRequest, opts ...grpc.CallOption) (*MembershipProof, error) {
+	out := new(MembershipProof)
+	err := c.cc.Invoke(ctx, Trees_GetMembershipProof_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *treesClient) GetConsistencyProof(ctx context.Context, in *ConsistencyRequest, opts ...grpc.CallOption) (*ConsistencyProof, error) {
+	out := new(ConsistencyProof)
+	err := c.cc.Invoke(ctx, Trees_GetConsistencyProof_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *treesClient) GetRoot(ctx context.Context, in *RootRequest, opts ...grpc.CallOption) (*Commitment, error) {
+	out := new(Commitment)
+	err := c.cc.Invoke(ctx, Trees_GetRoot_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *treesClient) WatchCommitments(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Trees_WatchCommitmentsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Trees_ServiceDesc.Streams[0], Trees_WatchCommitments_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &treesWatchCommitmentsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Trees_WatchCommitmentsClient interface {
+	Recv() (*Commitment, error)
+	grpc.ClientStream
+}
+
+type treesWatchCommitmentsClient struct {
+	grpc.ClientStream
+}
+
+func (x *treesWatchCommitmentsClient) Recv() (*Commitment, error) {
+	m := new(Commitment)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// TreesServer is the server API for Trees service.
+// All implementations must embed UnimplementedTreesServer
+// for forward compatibility
+type TreesServer interface {
+	// Add appends an event, or the digest of an event hashed with the hasher
+	// of the server, and returns the commitment of its version.
+	Add(context.Context, *AddRequest) (*Commitment, error)
+	// GetMembershipProof proves the membership of an event digest as of the
+	// last version.
+	GetMembershipProof(context.Context, *MembershipRequest) (*MembershipProof, error)
+	// GetConsistencyProof proves that the history committed by end extends the
+	// one committed by start.
+	GetConsistencyProof(context.Context, *ConsistencyRequest) (*ConsistencyProof, error)
+	// GetRoot returns the commitment of a version, the last one by default.
+	GetRoot(context.Context, *RootRequest) (*Commitment, error)
+	// WatchCommitments streams the commitments from a version on, replaying
+	// the ones already added before following the new ones.
+	WatchCommitments(*WatchRequest, Trees_WatchCommitmentsServer) error
+	mustEmbedUnimplementedTreesServer()
+}
+
+// UnimplementedTreesServer must be embedded to have forward compatible implementations.
+type UnimplementedTreesServer struct {
+}
+
+func (UnimplementedTreesServer) Add(context.Context, *AddRequest) (*Commitment, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Add not implemented")
+}
+func (UnimplementedTreesServer) GetMembershipProof(context.Context, *MembershipRequest) (*MembershipProof, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetMembershipProof not implemented")
+}
+func (UnimplementedTreesServer) GetConsistencyProof(context.Context, *ConsistencyRequest) (*ConsistencyProof, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetConsistencyProof not implemented")
+}
+func (UnimplementedTreesServer) GetRoot(context.Context, *RootRequest) (*Commitment, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetRoot not implemented")
+}
+func (UnimplementedTreesServer) WatchCommitments(*WatchRequest, Trees_WatchCommitmentsServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchCommitments not implemented")
+}
+func (UnimplementedTreesServer) mustEmbedUnimplementedTreesServer() {}
+
+// UnsafeTreesServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to TreesServer will
+// result in compilation errors.
+type UnsafeTreesServer interface {
+	mustEmbedUnimplementedTreesServer()
+}
+
+func RegisterTreesServer(s grpc.ServiceRegistrar, srv TreesServer) {
+	s.RegisterService(&Trees_ServiceDesc, srv)
+}
+
+func _Trees_Add_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TreesServer).Add(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Trees_Add_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TreesServer).Add(ctx, req.(*AddRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Trees_GetMembershipProof_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MembershipRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TreesServer).GetMembershipProof(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Trees_GetMembershipProof_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TreesServer).GetMembershipProof(ctx, req.(*MembershipRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Trees_GetConsistencyProof_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ConsistencyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TreesServer).GetConsistencyProof(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Trees_GetConsistencyProof_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TreesServer).GetConsistencyProof(ctx, req.(*ConsistencyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Trees_GetRoot_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RootRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TreesServer).GetRoot(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Trees_GetRoot_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TreesServer).GetRoot(ctx, req.(*RootRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Trees_WatchCommitments_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(TreesServer).WatchCommitments(m, &treesWatchCommitmentsServer{stream})
+}
+
+type Trees_WatchCommitmentsServer interface {
+	Send(*Commitment) error
+	grpc.ServerStream
+}
+
+type treesWatchCommitmentsServer struct {
+	grpc.ServerStream
+}
+
+func (x *treesWatchCommitmentsServer) Send(m *Commitment) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Trees_ServiceDesc is the grpc.ServiceDesc for Trees service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Trees_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "trees.Trees",
+	HandlerType: (*TreesServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Add",
+			Handler:    _Trees_Add_Handler,
+		},
+		{
+			MethodName: "GetMembershipProof",
+			Handler:    _Trees_GetMembershipProof_Handler,
+		},
+		{
+			MethodName: "GetConsistencyProof",
+			Handler:    _Trees_GetConsistencyProof_Handler,
+		},
+		{
+			MethodName: "GetRoot",
+			Handler:    _Trees_GetRoot_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchCommitments",
+			Handler:       _Trees_WatchCommitments_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "trees.proto",
+}
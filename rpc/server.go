@@ -0,0 +1,137 @@
+// Package rpc serves a balloon over gRPC with the Trees service defined in
+// pb/trees.proto.
+package rpc
+
+import (
+	"context"
+
+	"github.com/aalda/trees/balloon"
+	"github.com/aalda/trees/common"
+	"github.com/aalda/trees/log"
+	"github.com/aalda/trees/protocol"
+	"github.com/aalda/trees/rpc/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Server implements the Trees service over a balloon. The hasher is the name
+// the balloon hasher has in the protocol package, which is written in the
+// proofs.
+type Server struct {
+	pb.UnimplementedTreesServer
+
+	balloon *balloon.Balloon
+	hasher  string
+	hasherF func() common.Hasher
+	logger  *log.Logger
+}
+
+func NewServer(b *balloon.Balloon, hasher string) (*Server, error) {
+	hasherF, err := protocol.Hasher(hasher)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		balloon: b,
+		hasher:  hasher,
+		hasherF: hasherF,
+		logger:  log.Default().Named("rpc"),
+	}, nil
+}
+
+func (s *Server) SetLogger(logger *log.Logger) {
+	s.logger = logger
+}
+
+// Register adds the Trees service to the gRPC server.
+func (s *Server) Register(server *grpc.Server) {
+	pb.RegisterTreesServer(server, s)
+}
+
+func (s *Server) Add(ctx context.Context, request *pb.AddRequest) (*pb.Commitment, error) {
+	var commitment *balloon.Commitment
+	var err error
+	switch payload := request.Payload.(type) {
+	case *pb.AddRequest_Event:
+		commitment, err = s.balloon.Add(ctx, payload.Event)
+	case *pb.AddRequest_Digest:
+		if len(payload.Digest) != int(s.hasherF().Len()/8) {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid digest: expected %d bytes, got %d", s.hasherF().Len()/8, len(payload.Digest))
+		}
+		commitment, err = s.balloon.AddDigest(ctx, payload.Digest)
+	default:
+		return nil, status.Error(codes.InvalidArgument, "an event or a digest is expected")
+	}
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return EncodeCommitment(commitment), nil
+}
+
+func (s *Server) GetMembershipProof(ctx context.Context, request *pb.MembershipRequest) (*pb.MembershipProof, error) {
+	if len(request.Digest) != int(s.hasherF().Len()/8) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid digest: expected %d bytes, got %d", s.hasherF().Len()/8, len(request.Digest))
+	}
+	proof, err := s.balloon.Get(ctx, request.Digest)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return EncodeMembershipProof(s.hasher, proof), nil
+}
+
+func (s *Server) GetConsistencyProof(ctx context.Context, request *pb.ConsistencyRequest) (*pb.ConsistencyProof, error) {
+	proof, err := s.balloon.ProveConsistency(ctx, request.Start, request.End)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return EncodeConsistencyProof(s.hasher, proof), nil
+}
+
+func (s *Server) GetRoot(ctx context.Context, request *pb.RootRequest) (*pb.Commitment, error) {
+	var version uint64
+	if request.Version != nil {
+		version = *request.Version
+	} else {
+		next := s.balloon.Version()
+		if next == 0 {
+			return nil, status.Error(codes.NotFound, "no event has been added yet")
+		}
+		version = next - 1
+	}
+	commitment, err := s.balloon.Commitment(ctx, version)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return EncodeCommitment(commitment), nil
+}
+
+// WatchCommitments sends the commitments already added from the requested
+// version on, and then every new one until the client goes away.
+func (s *Server) WatchCommitments(request *pb.WatchRequest, stream pb.Trees_WatchCommitmentsServer) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	watcher := s.balloon.Watch(ctx, request.FromVersion)
+	for commitment := range watcher.C {
+		if err := stream.Send(EncodeCommitment(commitment)); err != nil {
+			return err
+		}
+	}
+	return s.toStatus(watcher.Err())
+}
+
+// toStatus maps the errors of the balloon to their codes. The unexpected ones
+// are logged and reported without their details.
+func (s *Server) toStatus(err error) error {
+	switch err {
+	case common.ErrKeyNotFound, balloon.ErrVersionNotFound:
+		return status.Error(codes.NotFound, err.Error())
+	case balloon.ErrInvalidRange:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case context.Canceled, context.DeadlineExceeded:
+		return status.FromContextError(err).Err()
+	}
+	s.logger.Error("Request failed", log.Err(err))
+	return status.Error(codes.Internal, "internal error")
+}
@@ -1,77 +1,160 @@
+// Package badger stores the trees in a Badger database.
+//
+// It uses Badger v2, as encryption at rest is not available in v1. The on
+// disk formats of both versions are incompatible, and v2 refuses to open a
+// directory written by v1 with a "manifest has unsupported version" error.
+// Stores created before the upgrade must be migrated once, with the badger
+// tool of each version:
+//
+//	badger backup --dir OLD --backup-file trees.bak   # badger v1.6
+//	badger restore --dir NEW --backup-file trees.bak  # badger v2
+//
+// Backups taken with releases older than v1.6 must go through v1.6 first.
 package badger
 
 import (
 	"bytes"
-	"log"
+	"context"
+	"sync"
+	"time"
 
 	"github.com/aalda/trees/common"
-	"github.com/dgraph-io/badger"
-	"github.com/dgraph-io/badger/options"
+	"github.com/aalda/trees/log"
+	"github.com/dgraph-io/badger/v2"
+	"github.com/dgraph-io/badger/v2/options"
 )
 
+type Options struct {
+	// SyncWrites makes every Mutate wait until it is synced to disk.
+	SyncWrites bool
+	// ValueThreshold is the size above which values are kept in the value
+	// log instead of the LSM tree. Zero keeps the badger default.
+	ValueThreshold int
+	ReadOnly       bool
+	// EncryptionKey enables encryption at rest. It must be 16, 24 or 32
+	// bytes long to select AES-128, AES-192 or AES-256.
+	EncryptionKey []byte
+	// GCInterval is how often the value log garbage collection runs. Zero
+	// disables it.
+	GCInterval time.Duration
+	// Logger reports the garbage collection failures. Nil logs them through
+	// the default logger.
+	Logger *log.Logger
+
+	// afterGC is called after every garbage collection run, for testing.
+	afterGC func()
+}
+
+func DefaultOptions() Options {
+	return Options{
+		SyncWrites: true,
+		GCInterval: 5 * time.Minute,
+	}
+}
+
 type BadgerStore struct {
-	db *badger.DB
+	db        *badger.DB
+	stopGC    chan struct{}
+	gcDone    chan struct{}
+	closeOnce *sync.Once
+}
+
+func NewBadgerStore(path string) (*BadgerStore, error) {
+	return NewBadgerStoreWithOptions(path, DefaultOptions())
 }
 
-func NewBadgerStore(path string) *BadgerStore {
-	opts := badger.DefaultOptions
-	opts.TableLoadingMode = options.MemoryMap
-	opts.ValueLogLoadingMode = options.FileIO
-	opts.Dir = path
-	opts.ValueDir = path
-	opts.SyncWrites = false
-	db, err := badger.Open(opts)
+func NewBadgerStoreWithOptions(path string, opts Options) (*BadgerStore, error) {
+	badgerOpts := badger.DefaultOptions(path).
+		WithTableLoadingMode(options.MemoryMap).
+		WithValueLogLoadingMode(options.FileIO).
+		WithSyncWrites(opts.SyncWrites).
+		WithReadOnly(opts.ReadOnly).
+		WithLogger(nil)
+	if opts.ValueThreshold > 0 {
+		badgerOpts = badgerOpts.WithValueThreshold(opts.ValueThreshold)
+	}
+	if opts.EncryptionKey != nil {
+		// badger needs a cache for the decrypted indices
+		badgerOpts = badgerOpts.
+			WithEncryptionKey(opts.EncryptionKey).
+			WithIndexCacheSize(64 << 20)
+	}
+	db, err := badger.Open(badgerOpts)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	return &BadgerStore{db}
+
+	store := &BadgerStore{
+		db:        db,
+		closeOnce: new(sync.Once),
+	}
+	if opts.GCInterval > 0 && !opts.ReadOnly {
+		store.stopGC = make(chan struct{})
+		store.gcDone = make(chan struct{})
+		logger := opts.Logger
+		if logger == nil {
+			logger = log.Default().Named("badger")
+		}
+		go store.runGC(opts.GCInterval, logger, opts.afterGC)
+	}
+	return store, nil
 }
 
-func (s BadgerStore) Mutate(mutations []common.Mutation) error {
-	return s.db.Update(func(txn *badger.Txn) error {
-		for _, m := range mutations {
-			key := append([]byte{m.Prefix}, m.Key...)
-			err := txn.Set(key, m.Value)
-			if err != nil {
-				return err
+func (s BadgerStore) runGC(interval time.Duration, logger *log.Logger, afterGC func()) {
+	defer close(s.gcDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopGC:
+			return
+		case <-ticker.C:
+			// a single run rewrites at most one log file, so we keep going
+			// until there is nothing left to rewrite
+			var err error
+			for err == nil {
+				err = s.db.RunValueLogGC(0.5)
+			}
+			if err != badger.ErrNoRewrite {
+				logger.Error("Value log garbage collection failed", log.Err(err))
+			}
+			if afterGC != nil {
+				afterGC()
 			}
 		}
-		return nil
-	})
+	}
 }
 
-func (s BadgerStore) GetRange(prefix byte, start, end []byte) (common.KVRange, error) {
-	result := make(common.KVRange, 0)
-	startKey := append([]byte{prefix}, start...)
-	endKey := append([]byte{prefix}, end...)
-	err := s.db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchValues = false
-		it := txn.NewIterator(opts)
-		defer it.Close()
-		for it.Seek(startKey); it.Valid(); it.Next() {
-			item := it.Item()
-			var key []byte
-			key = item.KeyCopy(key)
-			if bytes.Compare(key, endKey) > 0 {
-				break
+func (s BadgerStore) Mutate(ctx context.Context, mutations []common.Mutation) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(func(txn *badger.Txn) error {
+		for _, m := range mutations {
+			key := append([]byte{m.Prefix}, m.Key...)
+			var err error
+			switch m.Op {
+			case common.DeleteOp:
+				err = txn.Delete(key)
+			default:
+				err = txn.Set(key, m.Value)
 			}
-			var value []byte
-			value, err := item.ValueCopy(value)
 			if err != nil {
 				return err
 			}
-			result = append(result, common.KVPair{key[1:], value})
 		}
 		return nil
 	})
-	if err != nil {
-		return nil, err
-	}
-	return result, nil
 }
 
-func (s BadgerStore) Get(prefix byte, key []byte) (*common.KVPair, error) {
+func (s BadgerStore) GetRange(ctx context.Context, prefix byte, start, end []byte) (common.KVRange, error) {
+	return common.CollectRange(s.Iterate(ctx, prefix, start, end))
+}
+
+func (s BadgerStore) Get(ctx context.Context, prefix byte, key []byte) (*common.KVPair, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	result := new(common.KVPair)
 	result.Key = key
 	err := s.db.View(func(txn *badger.Txn) error {
@@ -92,12 +175,113 @@ func (s BadgerStore) Get(prefix byte, key []byte) (*common.KVPair, error) {
 	case nil:
 		return result, nil
 	case badger.ErrKeyNotFound:
-		return result, nil
+		return nil, common.ErrKeyNotFound
 	default:
 		return nil, err
 	}
 }
 
+func (s BadgerStore) Has(ctx context.Context, prefix byte, key []byte) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	err := s.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(append([]byte{prefix}, key...))
+		return err
+	})
+	switch err {
+	case nil:
+		return true, nil
+	case badger.ErrKeyNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func (s BadgerStore) GetAll(ctx context.Context, prefix byte) common.KVIterator {
+	return s.Iterate(ctx, prefix, nil, nil)
+}
+
+func (s BadgerStore) Iterate(ctx context.Context, prefix byte, start, end []byte) common.KVIterator {
+	txn := s.db.NewTransaction(false)
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	return &badgerIterator{
+		ctx:    ctx,
+		txn:    txn,
+		it:     txn.NewIterator(opts),
+		prefix: []byte{prefix},
+		start:  append([]byte{prefix}, start...),
+		end:    end,
+	}
+}
+
+type badgerIterator struct {
+	ctx        context.Context
+	txn        *badger.Txn
+	it         *badger.Iterator
+	prefix     []byte
+	start, end []byte
+	started    bool
+	pair       common.KVPair
+	err        error
+}
+
+func (i *badgerIterator) Next() bool {
+	if i.err != nil {
+		return false
+	}
+	if i.err = i.ctx.Err(); i.err != nil {
+		return false
+	}
+	if i.started {
+		i.it.Next()
+	} else {
+		i.it.Seek(i.start)
+		i.started = true
+	}
+	if !i.it.ValidForPrefix(i.prefix) {
+		return false
+	}
+	item := i.it.Item()
+	key := item.KeyCopy(nil)
+	if i.end != nil && bytes.Compare(key[1:], i.end) > 0 {
+		return false
+	}
+	value, err := item.ValueCopy(nil)
+	if err != nil {
+		i.err = err
+		return false
+	}
+	i.pair = common.NewKVPair(key[1:], value)
+	return true
+}
+
+func (i *badgerIterator) Pair() common.KVPair {
+	return i.pair
+}
+
+func (i *badgerIterator) Err() error {
+	return i.err
+}
+
+func (i *badgerIterator) Close() error {
+	i.it.Close()
+	i.txn.Discard()
+	return nil
+}
+
+// Close waits for the value log garbage collection to stop before closing
+// the database.
 func (s BadgerStore) Close() error {
-	return s.db.Close()
+	var err error
+	s.closeOnce.Do(func() {
+		if s.stopGC != nil {
+			close(s.stopGC)
+			<-s.gcDone
+		}
+		err = s.db.Close()
+	})
+	return err
 }
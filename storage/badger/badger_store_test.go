@@ -0,0 +1,110 @@
+package badger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aalda/trees/common"
+	"github.com/aalda/trees/storage/storetest"
+	"github.com/stretchr/testify/require"
+)
+
+var ctx = context.Background()
+
+func TestBadgerStore(t *testing.T) {
+	storetest.Run(t, storetest.Backend{
+		Open: func(dir string) (common.Store, error) {
+			return NewBadgerStore(dir)
+		},
+		Persistent: true,
+	})
+}
+
+func TestBadgerStoreWithoutSync(t *testing.T) {
+	opts := DefaultOptions()
+	opts.SyncWrites = false
+	storetest.Run(t, storetest.Backend{
+		Open: func(dir string) (common.Store, error) {
+			return NewBadgerStoreWithOptions(dir, opts)
+		},
+		Persistent: true,
+	})
+}
+
+func TestReadOnly(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewBadgerStore(dir)
+	require.NoError(t, err)
+	mutations := []common.Mutation{*common.NewMutation(common.IndexPrefix, []byte{0x1}, []byte{0x1})}
+	require.NoError(t, store.Mutate(ctx, mutations))
+	require.NoError(t, store.Close())
+
+	opts := DefaultOptions()
+	opts.ReadOnly = true
+	store, err = NewBadgerStoreWithOptions(dir, opts)
+	require.NoError(t, err)
+	defer store.Close()
+
+	pair, err := store.Get(ctx, common.IndexPrefix, []byte{0x1})
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x1}, pair.Value)
+	require.Error(t, store.Mutate(ctx, mutations), "A read-only store should reject writes")
+}
+
+func TestEncryption(t *testing.T) {
+	dir := t.TempDir()
+
+	opts := DefaultOptions()
+	opts.EncryptionKey = []byte("0123456789abcdef")
+	store, err := NewBadgerStoreWithOptions(dir, opts)
+	require.NoError(t, err)
+	mutations := []common.Mutation{*common.NewMutation(common.IndexPrefix, []byte{0x1}, []byte("secret"))}
+	require.NoError(t, store.Mutate(ctx, mutations))
+	require.NoError(t, store.Close())
+
+	opts.EncryptionKey = []byte("fedcba9876543210")
+	_, err = NewBadgerStoreWithOptions(dir, opts)
+	require.Error(t, err, "Opening with a different key should fail")
+
+	opts.EncryptionKey = []byte("0123456789abcdef")
+	store, err = NewBadgerStoreWithOptions(dir, opts)
+	require.NoError(t, err)
+	defer store.Close()
+	pair, err := store.Get(ctx, common.IndexPrefix, []byte{0x1})
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret"), pair.Value)
+}
+
+func TestCloseStopsGC(t *testing.T) {
+	dir := t.TempDir()
+
+	runs := make(chan struct{}, 1)
+	opts := DefaultOptions()
+	opts.GCInterval = time.Millisecond
+	opts.afterGC = func() {
+		select {
+		case runs <- struct{}{}:
+		default:
+		}
+	}
+	store, err := NewBadgerStoreWithOptions(dir, opts)
+	require.NoError(t, err)
+
+	select {
+	case <-runs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The garbage collection did not run")
+	}
+
+	done := make(chan error)
+	go func() { done <- store.Close() }()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not wait for the garbage collection to stop")
+	}
+	require.NoError(t, store.Close(), "Closing twice should be a no-op")
+}
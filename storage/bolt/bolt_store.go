@@ -0,0 +1,165 @@
+package bolt
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/aalda/trees/common"
+	"go.etcd.io/bbolt"
+)
+
+// BoltStore keeps every prefix in its own bucket of a single bbolt file.
+type BoltStore struct {
+	db *bbolt.DB
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bbolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &BoltStore{db}, nil
+}
+
+func bucketName(prefix byte) []byte {
+	return []byte{prefix}
+}
+
+func copyBytes(b []byte) []byte {
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
+
+func (s BoltStore) Mutate(ctx context.Context, mutations []common.Mutation) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		for _, m := range mutations {
+			bucket, err := tx.CreateBucketIfNotExists(bucketName(m.Prefix))
+			if err != nil {
+				return err
+			}
+			switch m.Op {
+			case common.DeleteOp:
+				err = bucket.Delete(m.Key)
+			default:
+				err = bucket.Put(m.Key, m.Value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s BoltStore) GetRange(ctx context.Context, prefix byte, start, end []byte) (common.KVRange, error) {
+	return common.CollectRange(s.Iterate(ctx, prefix, start, end))
+}
+
+func (s BoltStore) Get(ctx context.Context, prefix byte, key []byte) (*common.KVPair, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	result := new(common.KVPair)
+	result.Key = key
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(bucketName(prefix))
+		if bucket == nil {
+			return common.ErrKeyNotFound
+		}
+		value := bucket.Get(key)
+		if value == nil {
+			return common.ErrKeyNotFound
+		}
+		result.Value = copyBytes(value)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s BoltStore) Has(ctx context.Context, prefix byte, key []byte) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	var found bool
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(bucketName(prefix))
+		found = bucket != nil && bucket.Get(key) != nil
+		return nil
+	})
+	return found, err
+}
+
+func (s BoltStore) GetAll(ctx context.Context, prefix byte) common.KVIterator {
+	return s.Iterate(ctx, prefix, nil, nil)
+}
+
+func (s BoltStore) Iterate(ctx context.Context, prefix byte, start, end []byte) common.KVIterator {
+	tx, err := s.db.Begin(false)
+	if err != nil {
+		return &boltIterator{err: err}
+	}
+	it := &boltIterator{ctx: ctx, tx: tx, start: start, end: end}
+	if bucket := tx.Bucket(bucketName(prefix)); bucket != nil {
+		it.cursor = bucket.Cursor()
+	}
+	return it
+}
+
+// boltIterator keeps a read transaction open until it is closed, so it must
+// be closed before writing to the store from the same goroutine.
+type boltIterator struct {
+	ctx        context.Context
+	tx         *bbolt.Tx
+	cursor     *bbolt.Cursor
+	start, end []byte
+	started    bool
+	pair       common.KVPair
+	err        error
+}
+
+func (i *boltIterator) Next() bool {
+	if i.err != nil || i.cursor == nil {
+		return false
+	}
+	if i.err = i.ctx.Err(); i.err != nil {
+		return false
+	}
+	var k, v []byte
+	if i.started {
+		k, v = i.cursor.Next()
+	} else {
+		k, v = i.cursor.Seek(i.start)
+		i.started = true
+	}
+	if k == nil || (i.end != nil && bytes.Compare(k, i.end) > 0) {
+		return false
+	}
+	i.pair = common.NewKVPair(copyBytes(k), copyBytes(v))
+	return true
+}
+
+func (i *boltIterator) Pair() common.KVPair {
+	return i.pair
+}
+
+func (i *boltIterator) Err() error {
+	return i.err
+}
+
+func (i *boltIterator) Close() error {
+	if i.tx == nil {
+		return nil
+	}
+	return i.tx.Rollback()
+}
+
+func (s BoltStore) Close() error {
+	return s.db.Close()
+}
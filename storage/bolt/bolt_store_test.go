@@ -0,0 +1,18 @@
+package bolt
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/aalda/trees/common"
+	"github.com/aalda/trees/storage/storetest"
+)
+
+func TestBoltStore(t *testing.T) {
+	storetest.Run(t, storetest.Backend{
+		Open: func(dir string) (common.Store, error) {
+			return NewBoltStore(filepath.Join(dir, "trees.db"))
+		},
+		Persistent: true,
+	})
+}
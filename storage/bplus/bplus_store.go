@@ -1,18 +1,36 @@
 package bplus
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sync"
 
 	"github.com/aalda/trees/common"
 	"github.com/google/btree"
 )
 
 type BPlusTreeStore struct {
-	db *btree.BTree
+	lock sync.RWMutex
+	db   *btree.BTree
 }
 
 func NewBPlusTreeStorage() *BPlusTreeStore {
-	return &BPlusTreeStore{btree.New(2)}
+	return &BPlusTreeStore{db: btree.New(2)}
+}
+
+// Clone returns a copy of the store that shares the btree nodes with the
+// original until either of them is modified.
+func (s *BPlusTreeStore) Clone() *BPlusTreeStore {
+	// cloning changes the copy-on-write context of the original tree
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return &BPlusTreeStore{db: s.db.Clone()}
 }
 
 type KVItem struct {
@@ -23,41 +41,307 @@ func (p KVItem) Less(b btree.Item) bool {
 	return bytes.Compare(p.Key, b.(KVItem).Key) < 0
 }
 
-func (s *BPlusTreeStore) Mutate(mutations []common.Mutation) error {
+func (s *BPlusTreeStore) Mutate(ctx context.Context, mutations []common.Mutation) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	for _, m := range mutations {
 		key := append([]byte{m.Prefix}, m.Key...)
-		s.db.ReplaceOrInsert(KVItem{key, m.Value})
+		switch m.Op {
+		case common.DeleteOp:
+			s.db.Delete(KVItem{key, nil})
+		default:
+			s.db.ReplaceOrInsert(KVItem{key, m.Value})
+		}
 	}
 	return nil
 }
 
-func (s *BPlusTreeStore) GetRange(prefix byte, start, end []byte) (common.KVRange, error) {
-	result := make(common.KVRange, 0)
-	startKey := append([]byte{prefix}, start...)
-	endKey := append([]byte{prefix}, end...)
-	s.db.AscendGreaterOrEqual(KVItem{startKey, nil}, func(i btree.Item) bool {
-		key := i.(KVItem).Key
-		if bytes.Compare(key, endKey) > 0 {
-			return false
-		}
-		result = append(result, common.KVPair{key[1:], i.(KVItem).Value})
-		return true
-	})
-	return result, nil
+func (s *BPlusTreeStore) GetRange(ctx context.Context, prefix byte, start, end []byte) (common.KVRange, error) {
+	return common.CollectRange(s.Iterate(ctx, prefix, start, end))
 }
 
-func (s *BPlusTreeStore) Get(prefix byte, key []byte) (*common.KVPair, error) {
+func (s *BPlusTreeStore) Get(ctx context.Context, prefix byte, key []byte) (*common.KVPair, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	result := new(common.KVPair)
 	result.Key = key
 	k := append([]byte{prefix}, key...)
 	item := s.db.Get(KVItem{k, nil})
-	if item != nil {
-		result.Value = item.(KVItem).Value
+	if item == nil {
+		return nil, common.ErrKeyNotFound
 	}
+	result.Value = item.(KVItem).Value
 	return result, nil
 }
 
-func (s BPlusTreeStore) Close() error {
-	s.db.Clear(false)
+func (s *BPlusTreeStore) Has(ctx context.Context, prefix byte, key []byte) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	k := append([]byte{prefix}, key...)
+	return s.db.Has(KVItem{k, nil}), nil
+}
+
+func (s *BPlusTreeStore) GetAll(ctx context.Context, prefix byte) common.KVIterator {
+	return s.Iterate(ctx, prefix, nil, nil)
+}
+
+func (s *BPlusTreeStore) Iterate(ctx context.Context, prefix byte, start, end []byte) common.KVIterator {
+	return &bplusIterator{
+		ctx:    ctx,
+		store:  s,
+		prefix: prefix,
+		next:   append([]byte{prefix}, start...),
+		end:    end,
+	}
+}
+
+// bplusIterator walks the btree in batches so that it can be paused between
+// calls to Next without holding all the pairs under the prefix in memory.
+type bplusIterator struct {
+	ctx       context.Context
+	store     *BPlusTreeStore
+	prefix    byte
+	next, end []byte
+	batch     []KVItem
+	pos       int
+	exhausted bool
+	pair      common.KVPair
+	err       error
+}
+
+const bplusIteratorBatchSize = 256
+
+func (i *bplusIterator) Next() bool {
+	if i.err != nil {
+		return false
+	}
+	if i.err = i.ctx.Err(); i.err != nil {
+		return false
+	}
+	if i.pos >= len(i.batch) {
+		if i.exhausted {
+			return false
+		}
+		i.fill()
+		if len(i.batch) == 0 {
+			return false
+		}
+	}
+	item := i.batch[i.pos]
+	i.pos++
+	i.pair = common.NewKVPair(item.Key[1:], item.Value)
+	return true
+}
+
+func (i *bplusIterator) fill() {
+	i.store.lock.RLock()
+	defer i.store.lock.RUnlock()
+	i.batch = i.batch[:0]
+	i.pos = 0
+	i.exhausted = true
+	i.store.db.AscendGreaterOrEqual(KVItem{i.next, nil}, func(item btree.Item) bool {
+		kv := item.(KVItem)
+		if kv.Key[0] != i.prefix {
+			return false
+		}
+		if i.end != nil && bytes.Compare(kv.Key[1:], i.end) > 0 {
+			return false
+		}
+		if len(i.batch) == bplusIteratorBatchSize {
+			i.next = kv.Key
+			i.exhausted = false
+			return false
+		}
+		i.batch = append(i.batch, kv)
+		return true
+	})
+}
+
+func (i *bplusIterator) Pair() common.KVPair {
+	return i.pair
+}
+
+func (i *bplusIterator) Err() error {
+	return i.err
+}
+
+func (i *bplusIterator) Close() error {
+	i.batch = nil
+	return nil
+}
+
+// Close leaves the stored pairs untouched, as an in-memory store has no
+// resources to release.
+func (s *BPlusTreeStore) Close() error {
 	return nil
 }
+
+// A snapshot is laid out as the magic string and the format version,
+// followed by the number of pairs and each pair as its length-prefixed key
+// and value, all lengths being uvarints. It ends with the CRC-32 (Castagnoli)
+// of everything before it, big endian.
+var snapshotMagic = []byte("BPTS")
+
+const snapshotVersion = byte(1)
+
+var (
+	ErrInvalidSnapshot  = errors.New("invalid snapshot")
+	ErrSnapshotChecksum = errors.New("snapshot checksum mismatch")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Snapshot writes all the stored pairs to w. Writes to the store are not
+// blocked while the snapshot is being written.
+func (s *BPlusTreeStore) Snapshot(w io.Writer) error {
+	db := s.Clone().db
+
+	crc := crc32.New(castagnoli)
+	buf := bufio.NewWriter(io.MultiWriter(w, crc))
+	var scratch [binary.MaxVarintLen64]byte
+	writeUvarint := func(x uint64) error {
+		n := binary.PutUvarint(scratch[:], x)
+		_, err := buf.Write(scratch[:n])
+		return err
+	}
+
+	if _, err := buf.Write(snapshotMagic); err != nil {
+		return err
+	}
+	if err := buf.WriteByte(snapshotVersion); err != nil {
+		return err
+	}
+	if err := writeUvarint(uint64(db.Len())); err != nil {
+		return err
+	}
+	var err error
+	db.Ascend(func(item btree.Item) bool {
+		kv := item.(KVItem)
+		for _, b := range [][]byte{kv.Key, kv.Value} {
+			if err = writeUvarint(uint64(len(b))); err != nil {
+				return false
+			}
+			if _, err = buf.Write(b); err != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc.Sum32())
+	_, err = w.Write(sum[:])
+	return err
+}
+
+// Restore replaces the contents of the store with the pairs read from a
+// snapshot. The store is left untouched if the snapshot is not valid.
+func (s *BPlusTreeStore) Restore(r io.Reader) error {
+	buf := bufio.NewReader(r)
+	in := &checksumReader{buf, crc32.New(castagnoli)}
+
+	header := make([]byte, len(snapshotMagic)+1)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return snapshotError(err)
+	}
+	if !bytes.Equal(header[:len(snapshotMagic)], snapshotMagic) || header[len(snapshotMagic)] != snapshotVersion {
+		return ErrInvalidSnapshot
+	}
+	count, err := binary.ReadUvarint(in)
+	if err != nil {
+		return snapshotError(err)
+	}
+
+	db := btree.New(2)
+	for i := uint64(0); i < count; i++ {
+		key, err := readBytes(in)
+		if err != nil {
+			return err
+		}
+		value, err := readBytes(in)
+		if err != nil {
+			return err
+		}
+		if len(key) == 0 {
+			return ErrInvalidSnapshot
+		}
+		db.ReplaceOrInsert(KVItem{key, value})
+	}
+
+	expected := in.crc.Sum32()
+	var sum [4]byte
+	if _, err := io.ReadFull(buf, sum[:]); err != nil {
+		return snapshotError(err)
+	}
+	if binary.BigEndian.Uint32(sum[:]) != expected {
+		return ErrSnapshotChecksum
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.db = db
+	return nil
+}
+
+// checksumReader hashes the bytes as they are consumed, so that the reads
+// done ahead by the buffer are not part of the checksum.
+type checksumReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.crc.Write(p[:n])
+	return n, err
+}
+
+func (c *checksumReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.crc.Write([]byte{b})
+	}
+	return b, err
+}
+
+func readBytes(r *checksumReader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, snapshotError(err)
+	}
+	if int64(n) < 0 {
+		return nil, ErrInvalidSnapshot
+	}
+	// the buffer grows with the data actually read, so a corrupted length
+	// cannot make us allocate more than the snapshot holds
+	var b bytes.Buffer
+	if _, err := io.CopyN(&b, r, int64(n)); err != nil {
+		return nil, snapshotError(err)
+	}
+	if n == 0 {
+		return []byte{}, nil
+	}
+	return b.Bytes(), nil
+}
+
+func snapshotError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrInvalidSnapshot
+	}
+	return err
+}
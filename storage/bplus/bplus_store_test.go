@@ -0,0 +1,117 @@
+package bplus
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/aalda/trees/common"
+	"github.com/aalda/trees/storage/storetest"
+	"github.com/stretchr/testify/require"
+)
+
+var ctx = context.Background()
+
+func TestBPlusTreeStore(t *testing.T) {
+	storetest.Run(t, storetest.Backend{
+		Open: func(dir string) (common.Store, error) {
+			return NewBPlusTreeStorage(), nil
+		},
+	})
+}
+
+func fillStore(t *testing.T, store *BPlusTreeStore, prefix byte, n int) {
+	mutations := make([]common.Mutation, 0, n)
+	for i := 0; i < n; i++ {
+		key := []byte{byte(i >> 8), byte(i)}
+		mutations = append(mutations, *common.NewMutation(prefix, key, []byte(fmt.Sprintf("value-%d", i))))
+	}
+	require.NoError(t, store.Mutate(ctx, mutations))
+}
+
+func TestSnapshotAndRestore(t *testing.T) {
+	store := NewBPlusTreeStorage()
+	fillStore(t, store, common.IndexPrefix, 1000)
+	fillStore(t, store, common.HyperCachePrefix, 10)
+	require.NoError(t, store.Mutate(ctx, []common.Mutation{*common.NewMutation(common.VersionPrefix, []byte{0x1}, []byte{})}))
+
+	var snapshot bytes.Buffer
+	require.NoError(t, store.Snapshot(&snapshot))
+
+	restored := NewBPlusTreeStorage()
+	fillStore(t, restored, common.HistoryCachePrefix, 5)
+	require.NoError(t, restored.Restore(&snapshot))
+
+	for _, prefix := range []byte{common.VersionPrefix, common.IndexPrefix, common.HyperCachePrefix, common.HistoryCachePrefix} {
+		expected, err := store.GetRange(ctx, prefix, nil, nil)
+		require.NoError(t, err)
+		actual, err := restored.GetRange(ctx, prefix, nil, nil)
+		require.NoError(t, err)
+		require.Equal(t, expected, actual, "The restored pairs under prefix %d should match", prefix)
+	}
+}
+
+func TestRestoreCorruptedSnapshot(t *testing.T) {
+	store := NewBPlusTreeStorage()
+	fillStore(t, store, common.IndexPrefix, 100)
+	var buf bytes.Buffer
+	require.NoError(t, store.Snapshot(&buf))
+	snapshot := buf.Bytes()
+
+	testCases := []struct {
+		name     string
+		snapshot []byte
+		err      error
+	}{
+		{"empty", []byte{}, ErrInvalidSnapshot},
+		{"bad magic", append([]byte("XXXX"), snapshot[4:]...), ErrInvalidSnapshot},
+		{"truncated", snapshot[:len(snapshot)/2], ErrInvalidSnapshot},
+		{"missing checksum", snapshot[:len(snapshot)-2], ErrInvalidSnapshot},
+		{"flipped bit", flipBit(snapshot, len(snapshot)-5), ErrSnapshotChecksum},
+		{"wrong checksum", flipBit(snapshot, len(snapshot)-1), ErrSnapshotChecksum},
+	}
+
+	for _, c := range testCases {
+		restored := NewBPlusTreeStorage()
+		fillStore(t, restored, common.HistoryCachePrefix, 5)
+		err := restored.Restore(bytes.NewReader(c.snapshot))
+		require.Equal(t, c.err, err, "Unexpected error for the %s snapshot", c.name)
+
+		pairs, err := restored.GetRange(ctx, common.HistoryCachePrefix, nil, nil)
+		require.NoError(t, err)
+		require.Len(t, pairs, 5, "A failed restore should leave the %s store untouched", c.name)
+	}
+}
+
+func flipBit(b []byte, i int) []byte {
+	result := append([]byte{}, b...)
+	result[i] ^= 0x1
+	return result
+}
+
+func TestClone(t *testing.T) {
+	store := NewBPlusTreeStorage()
+	fillStore(t, store, common.IndexPrefix, 100)
+
+	clone := store.Clone()
+	require.NoError(t, clone.Mutate(ctx, []common.Mutation{
+		*common.NewMutation(common.IndexPrefix, []byte{0x0, 0x1}, []byte("changed")),
+		*common.NewDeleteMutation(common.IndexPrefix, []byte{0x0, 0x2}),
+	}))
+	fillStore(t, store, common.HyperCachePrefix, 1)
+
+	pair, err := store.Get(ctx, common.IndexPrefix, []byte{0x0, 0x1})
+	require.NoError(t, err)
+	require.Equal(t, []byte("value-1"), pair.Value, "The original should not see the clone changes")
+	ok, err := store.Has(ctx, common.IndexPrefix, []byte{0x0, 0x2})
+	require.NoError(t, err)
+	require.True(t, ok, "The original should keep the pairs deleted in the clone")
+
+	pair, err = clone.Get(ctx, common.IndexPrefix, []byte{0x0, 0x1})
+	require.NoError(t, err)
+	require.Equal(t, []byte("changed"), pair.Value)
+	ok, err = clone.Has(ctx, common.HyperCachePrefix, []byte{0x0, 0x0})
+	require.NoError(t, err)
+	require.False(t, ok, "The clone should not see the original changes")
+}
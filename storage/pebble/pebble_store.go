@@ -0,0 +1,181 @@
+// Package pebble stores the trees in a Pebble LSM database. It is written
+// against the pebble v1.1 API, where DB.NewIter returns an error; earlier
+// releases return the iterator alone.
+package pebble
+
+import (
+	"context"
+
+	"github.com/aalda/trees/common"
+	"github.com/cockroachdb/pebble"
+)
+
+type Options struct {
+	// SyncWrites makes every Mutate wait until its batch is synced to disk.
+	// Disabling it is faster but the latest acknowledged mutations can be
+	// lost if the machine crashes.
+	SyncWrites bool
+}
+
+func DefaultOptions() Options {
+	return Options{SyncWrites: true}
+}
+
+type PebbleStore struct {
+	db           *pebble.DB
+	writeOptions *pebble.WriteOptions
+}
+
+func NewPebbleStore(path string) (*PebbleStore, error) {
+	return NewPebbleStoreWithOptions(path, DefaultOptions())
+}
+
+func NewPebbleStoreWithOptions(path string, opts Options) (*PebbleStore, error) {
+	db, err := pebble.Open(path, &pebble.Options{})
+	if err != nil {
+		return nil, err
+	}
+	writeOptions := pebble.NoSync
+	if opts.SyncWrites {
+		writeOptions = pebble.Sync
+	}
+	return &PebbleStore{db, writeOptions}, nil
+}
+
+// Mutate applies all the mutations in a single atomic batch.
+func (s PebbleStore) Mutate(ctx context.Context, mutations []common.Mutation) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	batch := s.db.NewBatch()
+	defer batch.Close()
+	for _, m := range mutations {
+		key := append([]byte{m.Prefix}, m.Key...)
+		var err error
+		switch m.Op {
+		case common.DeleteOp:
+			err = batch.Delete(key, nil)
+		default:
+			err = batch.Set(key, m.Value, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return batch.Commit(s.writeOptions)
+}
+
+func (s PebbleStore) GetRange(ctx context.Context, prefix byte, start, end []byte) (common.KVRange, error) {
+	return common.CollectRange(s.Iterate(ctx, prefix, start, end))
+}
+
+func (s PebbleStore) Get(ctx context.Context, prefix byte, key []byte) (*common.KVPair, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	value, closer, err := s.db.Get(append([]byte{prefix}, key...))
+	switch err {
+	case nil:
+	case pebble.ErrNotFound:
+		return nil, common.ErrKeyNotFound
+	default:
+		return nil, err
+	}
+	defer closer.Close()
+	result := new(common.KVPair)
+	result.Key = key
+	result.Value = make([]byte, len(value))
+	copy(result.Value, value)
+	return result, nil
+}
+
+func (s PebbleStore) Has(ctx context.Context, prefix byte, key []byte) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	_, closer, err := s.db.Get(append([]byte{prefix}, key...))
+	switch err {
+	case nil:
+		return true, closer.Close()
+	case pebble.ErrNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func (s PebbleStore) GetAll(ctx context.Context, prefix byte) common.KVIterator {
+	return s.Iterate(ctx, prefix, nil, nil)
+}
+
+func (s PebbleStore) Iterate(ctx context.Context, prefix byte, start, end []byte) common.KVIterator {
+	opts := &pebble.IterOptions{
+		LowerBound: append([]byte{prefix}, start...),
+	}
+	// upper bounds are exclusive, so we use the smallest key after the
+	// inclusive end or, with no end, the next prefix
+	switch {
+	case end != nil:
+		opts.UpperBound = append(append([]byte{prefix}, end...), 0x0)
+	case prefix < 0xff:
+		opts.UpperBound = []byte{prefix + 1}
+	}
+	it, err := s.db.NewIter(opts)
+	if err != nil {
+		return &pebbleIterator{err: err}
+	}
+	return &pebbleIterator{ctx: ctx, it: it}
+}
+
+type pebbleIterator struct {
+	ctx     context.Context
+	it      *pebble.Iterator
+	started bool
+	pair    common.KVPair
+	err     error
+}
+
+func (i *pebbleIterator) Next() bool {
+	if i.err != nil || i.it == nil {
+		return false
+	}
+	if i.err = i.ctx.Err(); i.err != nil {
+		return false
+	}
+	var valid bool
+	if i.started {
+		valid = i.it.Next()
+	} else {
+		valid = i.it.First()
+		i.started = true
+	}
+	if !valid {
+		i.err = i.it.Error()
+		return false
+	}
+	key := make([]byte, len(i.it.Key())-1)
+	copy(key, i.it.Key()[1:])
+	value := make([]byte, len(i.it.Value()))
+	copy(value, i.it.Value())
+	i.pair = common.NewKVPair(key, value)
+	return true
+}
+
+func (i *pebbleIterator) Pair() common.KVPair {
+	return i.pair
+}
+
+func (i *pebbleIterator) Err() error {
+	return i.err
+}
+
+func (i *pebbleIterator) Close() error {
+	if i.it == nil {
+		return nil
+	}
+	return i.it.Close()
+}
+
+func (s PebbleStore) Close() error {
+	return s.db.Close()
+}
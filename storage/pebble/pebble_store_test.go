@@ -0,0 +1,26 @@
+package pebble
+
+import (
+	"testing"
+
+	"github.com/aalda/trees/common"
+	"github.com/aalda/trees/storage/storetest"
+)
+
+func TestPebbleStore(t *testing.T) {
+	storetest.Run(t, storetest.Backend{
+		Open: func(dir string) (common.Store, error) {
+			return NewPebbleStore(dir)
+		},
+		Persistent: true,
+	})
+}
+
+func TestPebbleStoreWithoutSync(t *testing.T) {
+	storetest.Run(t, storetest.Backend{
+		Open: func(dir string) (common.Store, error) {
+			return NewPebbleStoreWithOptions(dir, Options{SyncWrites: false})
+		},
+		Persistent: true,
+	})
+}
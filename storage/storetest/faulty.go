@@ -0,0 +1,85 @@
+package storetest
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/aalda/trees/common"
+)
+
+var ErrInjectedFault = errors.New("injected fault")
+
+// FaultyStore wraps a store to make its writes fail on demand, so that tests
+// can simulate a process dying between two mutations.
+type FaultyStore struct {
+	common.Store
+	lock      sync.Mutex
+	remaining int
+	failing   bool
+	torn      bool
+	dropped   map[byte]bool
+}
+
+func NewFaultyStore(store common.Store) *FaultyStore {
+	return &FaultyStore{Store: store}
+}
+
+// FailAfter lets the next n calls to Mutate succeed and makes all the
+// following ones fail with ErrInjectedFault until Heal is called. If torn is
+// set, the first failing call persists the first half of its mutations, as a
+// store without atomic batches would when interrupted.
+func (s *FaultyStore) FailAfter(n int, torn bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.remaining = n
+	s.failing = true
+	s.torn = torn
+}
+
+// Drop makes the following calls to Mutate silently discard the mutations
+// under the given prefix until Heal is called, as a store that does not sync
+// its writes could lose some of them in a crash while keeping later ones.
+func (s *FaultyStore) Drop(prefix byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.dropped == nil {
+		s.dropped = make(map[byte]bool)
+	}
+	s.dropped[prefix] = true
+}
+
+func (s *FaultyStore) Heal() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failing = false
+	s.dropped = nil
+}
+
+func (s *FaultyStore) Mutate(ctx context.Context, mutations []common.Mutation) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.dropped) > 0 {
+		kept := make([]common.Mutation, 0, len(mutations))
+		for _, m := range mutations {
+			if !s.dropped[m.Prefix] {
+				kept = append(kept, m)
+			}
+		}
+		mutations = kept
+	}
+	if !s.failing {
+		return s.Store.Mutate(ctx, mutations)
+	}
+	if s.remaining > 0 {
+		s.remaining--
+		return s.Store.Mutate(ctx, mutations)
+	}
+	if s.torn {
+		s.torn = false
+		if err := s.Store.Mutate(ctx, mutations[:len(mutations)/2]); err != nil {
+			return err
+		}
+	}
+	return ErrInjectedFault
+}
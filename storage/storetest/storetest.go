@@ -0,0 +1,334 @@
+// Package storetest provides a conformance suite that every common.Store
+// implementation is expected to pass.
+package storetest
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/aalda/trees/common"
+	"github.com/aalda/trees/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Backend describes how to open the store under test.
+type Backend struct {
+	// Open returns a store rooted at the given directory.
+	Open func(dir string) (common.Store, error)
+	// Persistent backends must return the data written before closing when
+	// the same directory is opened again.
+	Persistent bool
+}
+
+// Run executes the whole suite against the given backend, using a fresh
+// store for every test.
+func Run(t *testing.T, backend Backend) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, store common.Store)
+	}{
+		{"SetGet", testSetGet},
+		{"Overwrite", testOverwrite},
+		{"Delete", testDelete},
+		{"RangeBounds", testRangeBounds},
+		{"PrefixIsolation", testPrefixIsolation},
+		{"EmptyValues", testEmptyValues},
+		{"LargeBatch", testLargeBatch},
+		{"Concurrency", testConcurrency},
+		{"Cancellation", testCancellation},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			store, err := backend.Open(t.TempDir())
+			require.NoError(t, err)
+			defer store.Close()
+			test.run(t, store)
+		})
+	}
+	t.Run("Close", func(t *testing.T) {
+		testClose(t, backend)
+	})
+}
+
+var ctx = context.Background()
+
+func set(prefix byte, key, value []byte) common.Mutation {
+	return *common.NewMutation(prefix, key, value)
+}
+
+func keys(r common.KVRange) [][]byte {
+	result := make([][]byte, len(r))
+	for i, pair := range r {
+		result[i] = pair.Key
+	}
+	return result
+}
+
+func iterate(t *testing.T, it common.KVIterator) common.KVRange {
+	result, err := common.CollectRange(it)
+	require.NoError(t, err)
+	return result
+}
+
+func testSetGet(t *testing.T, store common.Store) {
+	require.NoError(t, store.Mutate(ctx, []common.Mutation{
+		set(common.IndexPrefix, []byte("key"), []byte("value")),
+	}))
+
+	pair, err := store.Get(ctx, common.IndexPrefix, []byte("key"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("key"), pair.Key)
+	assert.Equal(t, []byte("value"), pair.Value)
+
+	found, err := store.Has(ctx, common.IndexPrefix, []byte("key"))
+	require.NoError(t, err)
+	assert.True(t, found, "Stored key should be found")
+
+	_, err = store.Get(ctx, common.IndexPrefix, []byte("missing"))
+	assert.Equal(t, common.ErrKeyNotFound, err, "Missing keys should not be found")
+
+	found, err = store.Has(ctx, common.IndexPrefix, []byte("missing"))
+	require.NoError(t, err)
+	assert.False(t, found, "Missing keys should not be found")
+}
+
+func testOverwrite(t *testing.T, store common.Store) {
+	require.NoError(t, store.Mutate(ctx, []common.Mutation{
+		set(common.IndexPrefix, []byte("key"), []byte("first")),
+	}))
+	require.NoError(t, store.Mutate(ctx, []common.Mutation{
+		set(common.IndexPrefix, []byte("key"), []byte("second")),
+		set(common.IndexPrefix, []byte("key"), []byte("third")),
+	}))
+
+	pair, err := store.Get(ctx, common.IndexPrefix, []byte("key"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("third"), pair.Value, "The last write should win")
+	assert.Len(t, iterate(t, store.GetAll(ctx, common.IndexPrefix)), 1, "Overwrites should not duplicate keys")
+}
+
+func testDelete(t *testing.T, store common.Store) {
+	require.NoError(t, store.Mutate(ctx, []common.Mutation{
+		set(common.IndexPrefix, []byte("a"), []byte("1")),
+		set(common.IndexPrefix, []byte("b"), []byte("2")),
+	}))
+	require.NoError(t, store.Mutate(ctx, []common.Mutation{
+		*common.NewDeleteMutation(common.IndexPrefix, []byte("a")),
+		*common.NewDeleteMutation(common.IndexPrefix, []byte("missing")),
+	}))
+
+	_, err := store.Get(ctx, common.IndexPrefix, []byte("a"))
+	assert.Equal(t, common.ErrKeyNotFound, err, "Deleted keys should not be found")
+	assert.Equal(t, [][]byte{[]byte("b")}, keys(iterate(t, store.GetAll(ctx, common.IndexPrefix))))
+}
+
+func testRangeBounds(t *testing.T, store common.Store) {
+	stored := [][]byte{{0x1}, {0x2}, {0x3}, {0x3, 0x0}, {0x4}, {0x5, 0x5}}
+	mutations := make([]common.Mutation, 0)
+	for _, key := range stored {
+		mutations = append(mutations, set(common.IndexPrefix, key, key))
+	}
+	require.NoError(t, store.Mutate(ctx, mutations))
+
+	testCases := []struct {
+		start, end []byte
+		expected   [][]byte
+	}{
+		{[]byte{0x2}, []byte{0x4}, [][]byte{{0x2}, {0x3}, {0x3, 0x0}, {0x4}}},
+		{[]byte{0x2}, []byte{0x3}, [][]byte{{0x2}, {0x3}}},
+		{[]byte{0x3, 0x0}, []byte{0x3, 0x0}, [][]byte{{0x3, 0x0}}},
+		{[]byte{0x0}, []byte{0x1}, [][]byte{{0x1}}},
+		{[]byte{0x4, 0x0}, []byte{0x5}, [][]byte{}},
+		{[]byte{0x5}, []byte{0x6}, [][]byte{{0x5, 0x5}}},
+		{[]byte{0x6}, []byte{0x9}, [][]byte{}},
+		{nil, []byte{0x2}, [][]byte{{0x1}, {0x2}}},
+		{[]byte{0x4}, nil, [][]byte{{0x4}, {0x5, 0x5}}},
+		{nil, nil, stored},
+	}
+
+	for i, c := range testCases {
+		kvRange, err := store.GetRange(ctx, common.IndexPrefix, c.start, c.end)
+		require.NoError(t, err)
+		assert.Equalf(t, c.expected, keys(kvRange), "Invalid range in test case %d", i)
+		assert.Equalf(t, c.expected, keys(iterate(t, store.Iterate(ctx, common.IndexPrefix, c.start, c.end))), "Invalid iteration in test case %d", i)
+		for _, pair := range kvRange {
+			assert.Equalf(t, pair.Key, pair.Value, "Invalid value in test case %d", i)
+		}
+	}
+}
+
+func testPrefixIsolation(t *testing.T, store common.Store) {
+	prefixes := []byte{common.VersionPrefix, common.IndexPrefix, common.HyperCachePrefix, common.HistoryCachePrefix}
+	mutations := make([]common.Mutation, 0)
+	for _, prefix := range prefixes {
+		for _, key := range [][]byte{{0x0}, {0x1}, {0xff, 0xff}} {
+			mutations = append(mutations, set(prefix, key, []byte{prefix}))
+		}
+	}
+	require.NoError(t, store.Mutate(ctx, mutations))
+
+	for _, prefix := range prefixes {
+		pair, err := store.Get(ctx, prefix, []byte{0x1})
+		require.NoError(t, err)
+		assert.Equalf(t, []byte{prefix}, pair.Value, "Invalid value under prefix %d", prefix)
+
+		all := iterate(t, store.GetAll(ctx, prefix))
+		assert.Equalf(t, [][]byte{{0x0}, {0x1}, {0xff, 0xff}}, keys(all), "Invalid keys under prefix %d", prefix)
+		for _, pair := range all {
+			assert.Equalf(t, []byte{prefix}, pair.Value, "Value from another prefix under prefix %d", prefix)
+		}
+
+		kvRange, err := store.GetRange(ctx, prefix, []byte{0x1}, []byte{0xff, 0xff, 0xff})
+		require.NoError(t, err)
+		assert.Equalf(t, [][]byte{{0x1}, {0xff, 0xff}}, keys(kvRange), "Range crossed prefix %d", prefix)
+	}
+
+	require.NoError(t, store.Mutate(ctx, []common.Mutation{
+		*common.NewDeleteMutation(common.IndexPrefix, []byte{0x1}),
+	}))
+	found, err := store.Has(ctx, common.HyperCachePrefix, []byte{0x1})
+	require.NoError(t, err)
+	assert.True(t, found, "Deletes should not cross prefixes")
+}
+
+func testEmptyValues(t *testing.T, store common.Store) {
+	require.NoError(t, store.Mutate(ctx, []common.Mutation{
+		set(common.IndexPrefix, []byte("empty"), []byte{}),
+	}))
+
+	pair, err := store.Get(ctx, common.IndexPrefix, []byte("empty"))
+	require.NoError(t, err, "Keys with empty values should be found")
+	assert.Empty(t, pair.Value)
+
+	found, err := store.Has(ctx, common.IndexPrefix, []byte("empty"))
+	require.NoError(t, err)
+	assert.True(t, found, "Keys with empty values should be found")
+
+	all := iterate(t, store.GetAll(ctx, common.IndexPrefix))
+	require.Len(t, all, 1)
+	assert.Empty(t, all[0].Value)
+}
+
+func testLargeBatch(t *testing.T, store common.Store) {
+	size := uint64(10000)
+	mutations := make([]common.Mutation, 0, size)
+	for i := uint64(0); i < size; i++ {
+		// big endian keys so that the order of the keys matches the order of i
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, i)
+		mutations = append(mutations, set(common.HyperCachePrefix, key, util.Uint64AsBytes(i)))
+	}
+	require.NoError(t, store.Mutate(ctx, mutations))
+
+	it := store.GetAll(ctx, common.HyperCachePrefix)
+	defer it.Close()
+	var count uint64
+	var previous []byte
+	for it.Next() {
+		pair := it.Pair()
+		require.Equalf(t, count, util.BytesAsUint64(pair.Value), "Unexpected pair at position %d", count)
+		require.True(t, previous == nil || bytes.Compare(previous, pair.Key) < 0, "Keys should be sorted")
+		previous = pair.Key
+		count++
+	}
+	require.NoError(t, it.Err())
+	assert.Equal(t, size, count, "Every pair in the batch should be stored")
+
+	kvRange, err := store.GetRange(ctx, common.HyperCachePrefix, mutations[100].Key, mutations[8099].Key)
+	require.NoError(t, err)
+	assert.Len(t, kvRange, 8000)
+}
+
+func testConcurrency(t *testing.T, store common.Store) {
+	writers, writes := 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				key := []byte(fmt.Sprintf("%02d-%04d", w, i))
+				if err := store.Mutate(ctx, []common.Mutation{set(common.IndexPrefix, key, key)}); err != nil {
+					t.Error(err)
+					return
+				}
+				pair, err := store.Get(ctx, common.IndexPrefix, key)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if !bytes.Equal(key, pair.Value) {
+					t.Errorf("Read %s instead of %s", pair.Value, key)
+				}
+				it := store.GetAll(ctx, common.IndexPrefix)
+				for it.Next() {
+				}
+				it.Close()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	assert.Len(t, iterate(t, store.GetAll(ctx, common.IndexPrefix)), writers*writes)
+}
+
+func testCancellation(t *testing.T, store common.Store) {
+	mutations := make([]common.Mutation, 10)
+	for i := range mutations {
+		mutations[i] = set(common.IndexPrefix, util.Uint64AsBytes(uint64(i)), []byte("value"))
+	}
+	require.NoError(t, store.Mutate(ctx, mutations))
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	err := store.Mutate(cancelled, []common.Mutation{set(common.IndexPrefix, []byte("key"), []byte("value"))})
+	assert.Equal(t, context.Canceled, err, "Mutations should not be applied once cancelled")
+	_, err = store.Get(ctx, common.IndexPrefix, []byte("key"))
+	assert.Equal(t, common.ErrKeyNotFound, err, "Cancelled mutations should not be persisted")
+
+	_, err = store.Get(cancelled, common.IndexPrefix, util.Uint64AsBytes(0))
+	assert.Equal(t, context.Canceled, err)
+	_, err = store.Has(cancelled, common.IndexPrefix, util.Uint64AsBytes(0))
+	assert.Equal(t, context.Canceled, err)
+	_, err = store.GetRange(cancelled, common.IndexPrefix, nil, nil)
+	assert.Equal(t, context.Canceled, err)
+
+	// iterations stop as soon as the context is cancelled
+	iterating, cancel := context.WithCancel(ctx)
+	defer cancel()
+	it := store.GetAll(iterating, common.IndexPrefix)
+	defer it.Close()
+	require.True(t, it.Next())
+	require.True(t, it.Next())
+	cancel()
+	assert.False(t, it.Next(), "Iterators should stop once cancelled")
+	assert.Equal(t, context.Canceled, it.Err())
+}
+
+func testClose(t *testing.T, backend Backend) {
+	dir := t.TempDir()
+	store, err := backend.Open(dir)
+	require.NoError(t, err)
+	require.NoError(t, store.Mutate(ctx, []common.Mutation{
+		set(common.IndexPrefix, []byte("key"), []byte("value")),
+	}))
+	require.NoError(t, store.Close(), "Closing a store should not fail")
+
+	if !backend.Persistent {
+		return
+	}
+
+	store, err = backend.Open(dir)
+	require.NoError(t, err)
+	defer store.Close()
+	pair, err := store.Get(ctx, common.IndexPrefix, []byte("key"))
+	require.NoError(t, err, "Data should survive closing the store")
+	assert.Equal(t, []byte("value"), pair.Value)
+}
@@ -0,0 +1,99 @@
+package trace
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RecordedSpan is a finished span kept by a Recorder.
+type RecordedSpan struct {
+	ID, ParentID int
+	Name         string
+	Attributes   map[string]interface{}
+	Start, End   time.Time
+}
+
+// Recorder is an in-memory Tracer keeping every finished span, meant for
+// tests and debugging.
+type Recorder struct {
+	lock   sync.Mutex
+	nextID int
+	spans  []RecordedSpan
+}
+
+func NewRecorder() *Recorder {
+	return new(Recorder)
+}
+
+type spanKey struct{}
+
+func (r *Recorder) Start(ctx context.Context, name string) (context.Context, Span) {
+	r.lock.Lock()
+	r.nextID++
+	id := r.nextID
+	r.lock.Unlock()
+
+	parentID := 0
+	if parent, ok := ctx.Value(spanKey{}).(*recordingSpan); ok {
+		parentID = parent.span.ID
+	}
+	span := &recordingSpan{
+		recorder: r,
+		span: RecordedSpan{
+			ID:         id,
+			ParentID:   parentID,
+			Name:       name,
+			Attributes: make(map[string]interface{}),
+			Start:      time.Now(),
+		},
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Spans returns the finished spans in the order they ended.
+func (r *Recorder) Spans() []RecordedSpan {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	spans := make([]RecordedSpan, len(r.spans))
+	copy(spans, r.spans)
+	return spans
+}
+
+func (r *Recorder) Reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.spans = nil
+}
+
+type recordingSpan struct {
+	lock     sync.Mutex
+	recorder *Recorder
+	span     RecordedSpan
+	ended    bool
+}
+
+func (s *recordingSpan) SetAttribute(key string, value interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.ended {
+		s.span.Attributes[key] = value
+	}
+}
+
+// End records the span the first time it is called.
+func (s *recordingSpan) End() {
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended = true
+	s.span.End = time.Now()
+	span := s.span
+	s.lock.Unlock()
+
+	s.recorder.lock.Lock()
+	defer s.recorder.lock.Unlock()
+	s.recorder.spans = append(s.recorder.spans, span)
+}
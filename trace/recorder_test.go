@@ -0,0 +1,38 @@
+package trace
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecorder(t *testing.T) {
+	recorder := NewRecorder()
+	ctx := WithTracer(context.Background(), recorder)
+
+	ctx, parent := Start(ctx, "parent")
+	_, child := Start(ctx, "child")
+	child.SetAttribute("key", "value")
+	child.End()
+	child.SetAttribute("late", true)
+	parent.End()
+
+	spans := recorder.Spans()
+	require.Len(t, spans, 2)
+	require.Equal(t, "child", spans[0].Name)
+	require.Equal(t, "parent", spans[1].Name)
+	require.Equal(t, spans[1].ID, spans[0].ParentID)
+	require.Equal(t, 0, spans[1].ParentID)
+	require.Equal(t, map[string]interface{}{"key": "value"}, spans[0].Attributes)
+
+	recorder.Reset()
+	require.Empty(t, recorder.Spans())
+}
+
+func TestNoTracer(t *testing.T) {
+	ctx, span := Start(context.Background(), "span")
+	span.SetAttribute("key", "value")
+	span.End()
+	require.NotNil(t, ctx)
+}
@@ -0,0 +1,38 @@
+// Package trace lets the trees report spans to a pluggable tracer carried in
+// the context, so that a slow operation can be broken down into its steps.
+package trace
+
+import "context"
+
+// Tracer starts spans. Start returns a context carrying the new span, so
+// that the spans started from it become its children.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+type Span interface {
+	SetAttribute(key string, value interface{})
+	End()
+}
+
+type tracerKey struct{}
+
+// WithTracer returns a context whose operations report their spans to the
+// given tracer.
+func WithTracer(ctx context.Context, tracer Tracer) context.Context {
+	return context.WithValue(ctx, tracerKey{}, tracer)
+}
+
+// Start starts a span with the tracer carried by the context, if any.
+func Start(ctx context.Context, name string) (context.Context, Span) {
+	tracer, ok := ctx.Value(tracerKey{}).(Tracer)
+	if !ok {
+		return ctx, noopSpan{}
+	}
+	return tracer.Start(ctx, name)
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpan) End()                                       {}